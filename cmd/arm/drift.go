@@ -0,0 +1,23 @@
+package main
+
+import (
+	"get.porter.sh/mixin/arm/pkg/arm"
+	"github.com/spf13/cobra"
+)
+
+func buildDriftCommand(m *arm.Mixin) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "drift",
+		Short: "Compare the deployed resources with the template and report drift",
+		Long: `Compare the resources in the resource group with the template of the step and report drift, without deploying anything.
+
+Resources of the deployment that were deleted, or that the template no longer declares, and properties that were changed outside of Porter are reported.`,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return m.LoadConfigFromEnvironment()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return m.Drift(cmd.Context())
+		},
+	}
+	return cmd
+}
@@ -70,7 +70,10 @@ func buildRootCommand(m *arm.Mixin, in io.Reader) *cobra.Command {
 	cmd.AddCommand(buildSchemaCommand(m))
 	cmd.AddCommand(buildBuildCommand(m))
 	cmd.AddCommand(buildInstallCommand(m))
+	cmd.AddCommand(buildUpgradeCommand(m))
 	cmd.AddCommand(buildUninstallCommand(m))
+	cmd.AddCommand(buildDriftCommand(m))
+	cmd.AddCommand(buildStatusCommand(m))
 
 	return cmd
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"get.porter.sh/mixin/arm/pkg/arm"
+	"github.com/spf13/cobra"
+)
+
+func buildStatusCommand(m *arm.Mixin) *cobra.Command {
+	opts := arm.StatusOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show the statuses reported to the status database",
+		Long: `Show the statuses of the steps reported to the status database in AZURE_STATUSDB_CONNECTION_STRING, newest first.
+
+Select the statuses of a correlation id, of an installation or of the deployments to a resource group, and bound the time they were reported.`,
+		Example: `  arm status --correlation-id 8f14e45f-ceea-467f-a0e6-a7e5b0f4d6a2
+  arm status --installation mysql --namespace dev --since 24h
+  arm status --subscription-id 00000000-0000-0000-0000-000000000001 --resource-group mysql-rg -o json
+  arm status --latest --since 2024-01-01`,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := opts.Validate(); err != nil {
+				return err
+			}
+			return m.LoadStatusConfigFromEnvironment()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return m.PrintStatus(opts)
+		},
+	}
+
+	f := cmd.Flags()
+	f.StringVar(&opts.CorrelationId, "correlation-id", "", "Show every status reported for the correlation id, oldest first")
+	f.StringVar(&opts.Installation, "installation", "", "Show the statuses of the installation")
+	f.StringVar(&opts.Namespace, "namespace", "", "Namespace of the installation")
+	f.StringVar(&opts.SubscriptionId, "subscription-id", "", "Show the statuses of the deployments to the subscription")
+	f.StringVar(&opts.ResourceGroup, "resource-group", "", "Show the statuses of the deployments to the resource group")
+	f.StringVar(&opts.Since, "since", "", "Show the statuses reported since a duration before now, like 24h, or a RFC 3339 time or date")
+	f.StringVar(&opts.Until, "until", "", "Show the statuses reported before a duration before now, like 1h, or a RFC 3339 time or date")
+	f.BoolVar(&opts.Latest, "latest", false, "Show only the newest status of each installation")
+	f.Int64Var(&opts.Skip, "skip", 0, "Number of statuses to skip")
+	f.Int64Var(&opts.Limit, "limit", 50, "Maximum number of statuses to show, 0 shows every status")
+	f.StringVar(&opts.Database, "database", "porter", "Status database, as set in the databaseName setting of the steps")
+	f.StringVar(&opts.Collection, "collection", "status", "Status collection, as set in the collectionName setting of the steps")
+	f.StringVarP(&opts.RawFormat, "output", "o", "plaintext",
+		"Specify an output format.  Allowed values: plaintext, json, yaml")
+
+	cmd.AddCommand(buildStatusFlushCommand(m))
+
+	return cmd
+}
+
+func buildStatusFlushCommand(m *arm.Mixin) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "flush",
+		Short: "Deliver the statuses spooled when the status sink was unavailable",
+		Long: `Deliver the statuses spooled when the status sink was unavailable, in the order they were reported.
+
+Statuses are spooled to AZURE_STATUS_SPOOL_FILE, by default ~/.porter/mixins/arm/status-spool.jsonl, and are also delivered by the next run of the mixin.`,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return m.LoadStatusConfigFromEnvironment()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return m.FlushStatusSpool()
+		},
+	}
+	return cmd
+}
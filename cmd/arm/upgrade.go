@@ -0,0 +1,20 @@
+package main
+
+import (
+	"get.porter.sh/mixin/arm/pkg/arm"
+	"github.com/spf13/cobra"
+)
+
+func buildUpgradeCommand(m *arm.Mixin) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "upgrade",
+		Short: "Execute the upgrade functionality of this mixin",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return m.LoadConfigFromEnvironment()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return m.Upgrade(cmd.Context())
+		},
+	}
+	return cmd
+}
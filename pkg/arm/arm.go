@@ -3,12 +3,15 @@ package arm
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"time"
 
-	resourcesSDK "github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2017-05-10/resources"
+	resourcesSDK "github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+	"github.com/Azure/go-autorest/autorest"
 
 	"get.porter.sh/mixin/arm/pkg/arm/auth"
+	"get.porter.sh/mixin/arm/pkg/arm/db"
 	arm "get.porter.sh/mixin/arm/pkg/arm/templates"
 	"get.porter.sh/porter/pkg/runtime"
 
@@ -18,7 +21,25 @@ import (
 type Mixin struct {
 	runtime.RuntimeConfig
 	cfg Config
-	//also add the azure clients here
+	// deployers are the deployers built for each subscription and credential
+	deployers map[deployerKey]arm.Deployer
+	// statusSink overrides the configured status sink, for tests
+	statusSink db.StatusSink
+	// statusQuerier overrides the status database queried by the status
+	// command, for tests
+	statusQuerier statusQuerier
+	// leaseStore overrides the store of the installation leases, for tests
+	leaseStore db.LeaseStore
+	// armRequests sends the correlation id of the step with the requests of
+	// the deployers and reports their ARM request ids
+	armRequests arm.RequestTracker
+}
+
+// deployerKey identifies a cached deployer
+type deployerKey struct {
+	subscriptionID  string
+	credential      string
+	pollingDuration int
 }
 
 // New arm mixin client, initialized with useful defaults.
@@ -37,23 +58,140 @@ func (m *Mixin) LoadConfigFromEnvironment() error {
 	return nil
 }
 
+// LoadStatusConfigFromEnvironment loads the configuration of the status
+// commands, which read the status database and don't need a subscription
+func (m *Mixin) LoadStatusConfigFromEnvironment() error {
+	cfg, _, err := getConfigFromEnvironment(envconfigPrefix)
+	if err != nil {
+		return err
+	}
+	m.cfg = cfg.Config
+	return nil
+}
+
 func (m *Mixin) getPayloadData() ([]byte, error) {
 	reader := bufio.NewReader(m.In)
 	data, err := io.ReadAll(reader)
 	return data, errors.Wrap(err, "could not read the payload from STDIN")
 }
 
-func (m *Mixin) getARMDeployer(pollingDuration int) (arm.Deployer, error) {
-
+// getAzureConfig returns the configuration a step deploys with: the one of
+// its credential alias, or the default one, targeting the subscription of the
+// step when it sets one
+func (m *Mixin) getAzureConfig(subscriptionID string, credential string) (Config, error) {
 	azureConfig := m.cfg
+	if credential != "" {
+		var err error
+		azureConfig, err = GetCredentialConfigFromEnvironment(credential, m.cfg)
+		if err != nil {
+			return Config{}, err
+		}
+	}
+	if subscriptionID != "" {
+		azureConfig.SubscriptionID = subscriptionID
+	}
+	if azureConfig.SubscriptionID == "" {
+		return Config{}, errors.Errorf("no subscription is set for credential %s", credential)
+	}
+	return azureConfig, nil
+}
+
+// trackARMRequests sends the correlation id with the ARM requests of the
+// deployers, and reports the requests and the ids ARM gave them to
+// onResponse
+func (m *Mixin) trackARMRequests(correlationId string, onResponse func(request arm.ARMRequest)) {
+	m.armRequests.CorrelationID = correlationId
+	m.armRequests.OnResponse = onResponse
+}
+
+// printARMRequest prints the ARM request id of the requests submitted to ARM
+// and of the failed requests. The polling of deployments isn't printed.
+func (m *Mixin) printARMRequest(correlationId string, request arm.ARMRequest) {
+	if !request.IsWrite() && request.StatusCode < 400 {
+		return
+	}
+	fmt.Fprintf(
+		m.Out,
+		"[correlationId: %s] ARM request %s %s returned %d, x-ms-request-id: %s\n",
+		correlationId,
+		request.Method,
+		request.URL,
+		request.StatusCode,
+		request.RequestID,
+	)
+}
+
+// logARMRequests logs the HTTP traffic of the client in debug mode, with its
+// credentials and secrets redacted. It must be called before the client is
+// tracked, so that the correlation id of the requests is logged.
+func (m *Mixin) logARMRequests(client *autorest.Client) {
+	if !m.DebugMode {
+		return
+	}
+	logger := &arm.RequestLogger{Out: m.Err}
+	logger.Log(client)
+}
+
+// getARMDeployer returns the deployer for the subscription and credential of
+// the configuration. Deployers are built once and reused.
+func (m *Mixin) getARMDeployer(azureConfig Config, credential string, pollingDuration int) (arm.Deployer, error) {
+	key := deployerKey{
+		subscriptionID:  azureConfig.SubscriptionID,
+		credential:      credential,
+		pollingDuration: pollingDuration,
+	}
+	if deployer, ok := m.deployers[key]; ok {
+		return deployer, nil
+	}
+
+	deployer, err := m.newARMDeployer(azureConfig, pollingDuration)
+	if err != nil {
+		return nil, err
+	}
+	if m.deployers == nil {
+		m.deployers = map[deployerKey]arm.Deployer{}
+	}
+	m.deployers[key] = deployer
+	return deployer, nil
+}
+
+func (m *Mixin) newARMDeployer(azureConfig Config, pollingDuration int) (arm.Deployer, error) {
 	azureSubscriptionID := azureConfig.SubscriptionID
 
+	usesAccessToken := azureConfig.AccessToken != "" ||
+		azureConfig.AccessTokenFile != "" ||
+		azureConfig.AccessTokenRefreshCommand != ""
+	if usesAccessToken && azureConfig.SkipAccessTokenVerification {
+		fmt.Fprintln(m.Err, "WARNING: the signature of the access token is not verified, "+
+			"AZURE_SKIP_ACCESS_TOKEN_VERIFICATION is set")
+	}
+	if err := m.checkAccessTokenLifetime(azureConfig, pollingDuration); err != nil {
+		return nil, err
+	}
+	apiVersionProfile, err := arm.GetAPIVersionProfile(azureConfig.APIVersionProfile)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't build ARM deployer")
+	}
 	authorizer, err := auth.GetBearerTokenAuthorizer(
-		azureConfig.Environment,
-		azureConfig.TenantID,
-		azureConfig.ClientID,
-		azureConfig.ClientSecret,
-		azureConfig.AccessToken,
+		auth.ServicePrincipalTokenParameters{
+			AzureEnvironment:            azureConfig.Environment,
+			TenantID:                    azureConfig.TenantID,
+			ClientID:                    azureConfig.ClientID,
+			ClientSecret:                azureConfig.ClientSecret,
+			AccessToken:                 azureConfig.AccessToken,
+			UseManagedIdentity:          azureConfig.UseManagedIdentity,
+			IdentityResourceID:          azureConfig.ManagedIdentityResourceID,
+			ManagedIdentityEndpoint:     azureConfig.ManagedIdentityEndpoint,
+			FederatedTokenFile:          azureConfig.FederatedTokenFile,
+			ClientCertificatePath:       azureConfig.ClientCertificatePath,
+			ClientCertificate:           azureConfig.ClientCertificate,
+			ClientCertificatePassword:   azureConfig.ClientCertificatePassword,
+			AccessTokenKeysURL:          azureConfig.AccessTokenKeysURL,
+			AccessTokenKeysFile:         azureConfig.AccessTokenKeysFile,
+			SkipAccessTokenVerification: azureConfig.SkipAccessTokenVerification,
+			AccessTokenFile:             azureConfig.AccessTokenFile,
+			AccessTokenRefreshCommand:   azureConfig.AccessTokenRefreshCommand,
+		},
 	)
 	if err != nil {
 		return nil, errors.Wrap(err, "couldn't build ARM deployer")
@@ -64,6 +202,8 @@ func (m *Mixin) getARMDeployer(pollingDuration int) (arm.Deployer, error) {
 		azureSubscriptionID,
 	)
 	resourceDeploymentsClient.Authorizer = authorizer
+	m.logARMRequests(&resourceDeploymentsClient.Client)
+	m.armRequests.Track(&resourceDeploymentsClient.Client)
 	// Sets polling duration of the deployment client as per the configuration.
 	resourceDeploymentsClient.PollingDuration = time.Duration(pollingDuration) * time.Minute
 
@@ -72,12 +212,57 @@ func (m *Mixin) getARMDeployer(pollingDuration int) (arm.Deployer, error) {
 		azureSubscriptionID,
 	)
 	resourceGroupsClient.Authorizer = authorizer
+	m.logARMRequests(&resourceGroupsClient.Client)
+	m.armRequests.Track(&resourceGroupsClient.Client)
 
 	armDeployer := arm.NewDeployer(
 		m.Context,
 		resourceGroupsClient,
 		resourceDeploymentsClient,
+		apiVersionProfile,
 	)
 
 	return armDeployer, nil
 }
+
+// checkAccessTokenLifetime makes sure that an access token that can't be
+// refreshed outlives the polling timeout, rather than letting the deployment
+// fail halfway through once the token expires. It warns or fails depending
+// on AZURE_ACCESS_TOKEN_EXPIRY_CHECK.
+func (m *Mixin) checkAccessTokenLifetime(azureConfig Config, pollingDuration int) error {
+	if azureConfig.AccessToken == "" ||
+		azureConfig.AccessTokenFile != "" ||
+		azureConfig.AccessTokenRefreshCommand != "" {
+		return nil
+	}
+
+	expiresOn, err := auth.AccessTokenExpiresOn(azureConfig.AccessToken)
+	if err != nil {
+		return errors.Wrap(err, "couldn't check the access token expiry")
+	}
+	pollingTimeout := time.Now().Add(time.Duration(pollingDuration) * time.Minute)
+	if !expiresOn.Before(pollingTimeout) {
+		return nil
+	}
+
+	message := fmt.Sprintf(
+		"the access token expires at %s, before the polling timeout of %d minutes. "+
+			"Set AZURE_ACCESS_TOKEN_FILE or AZURE_ACCESS_TOKEN_REFRESH_COMMAND so that it can be refreshed",
+		expiresOn.UTC().Format(time.RFC3339),
+		pollingDuration,
+	)
+	switch azureConfig.AccessTokenExpiryCheck {
+	case accessTokenExpiryCheckWarn, "":
+		fmt.Fprintf(m.Err, "WARNING: %s\n", message)
+		return nil
+	case accessTokenExpiryCheckFail:
+		return errors.New(message)
+	default:
+		return errors.Errorf(
+			"invalid AZURE_ACCESS_TOKEN_EXPIRY_CHECK %q, expected %s or %s",
+			azureConfig.AccessTokenExpiryCheck,
+			accessTokenExpiryCheckFail,
+			accessTokenExpiryCheckWarn,
+		)
+	}
+}
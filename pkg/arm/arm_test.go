@@ -0,0 +1,132 @@
+package arm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAccessToken(t *testing.T, expiresIn time.Duration) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiresIn)),
+	})
+	signed, err := token.SignedString([]byte("test"))
+	require.NoError(t, err)
+	return signed
+}
+
+func TestMixin_CheckAccessTokenLifetime(t *testing.T) {
+	testcases := []struct {
+		name        string
+		cfg         Config
+		wantErr     string
+		wantWarning bool
+	}{
+		{"no access token", Config{}, "", false},
+		{"outlives the deployment", Config{
+			AccessToken: newTestAccessToken(t, time.Hour),
+		}, "", false},
+		{"expires during the deployment", Config{
+			AccessToken:            newTestAccessToken(t, 10*time.Minute),
+			AccessTokenExpiryCheck: accessTokenExpiryCheckWarn,
+		}, "", true},
+		{"fail when it expires during the deployment", Config{
+			AccessToken:            newTestAccessToken(t, 10*time.Minute),
+			AccessTokenExpiryCheck: accessTokenExpiryCheckFail,
+		}, "before the polling timeout of 30 minutes", false},
+		{"refreshable", Config{
+			AccessToken:               newTestAccessToken(t, 10*time.Minute),
+			AccessTokenExpiryCheck:    accessTokenExpiryCheckFail,
+			AccessTokenRefreshCommand: "az account get-access-token --query accessToken -o tsv",
+		}, "", false},
+		{"invalid check", Config{
+			AccessToken:            newTestAccessToken(t, 10*time.Minute),
+			AccessTokenExpiryCheck: "ignore",
+		}, "invalid AZURE_ACCESS_TOKEN_EXPIRY_CHECK", false},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewTestMixin(t)
+
+			err := m.checkAccessTokenLifetime(tc.cfg, 30)
+			if tc.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+			if tc.wantWarning {
+				assert.Contains(t, m.TestContext.GetError(), "WARNING: the access token expires")
+			} else {
+				assert.NotContains(t, m.TestContext.GetError(), "WARNING")
+			}
+		})
+	}
+}
+
+func TestMixin_GetARMDeployer_Cached(t *testing.T) {
+	m := NewTestMixin(t)
+	m.cfg = Config{
+		Environment:    azure.PublicCloud,
+		SubscriptionID: "00000000-0000-0000-0000-000000000001",
+		TenantID:       "tenant",
+		ClientID:       "client",
+		ClientSecret:   "secret",
+	}
+
+	defaultConfig, err := m.getAzureConfig("", "")
+	require.NoError(t, err)
+	deployer, err := m.getARMDeployer(defaultConfig, "", 30)
+	require.NoError(t, err)
+	cached, err := m.getARMDeployer(defaultConfig, "", 30)
+	require.NoError(t, err)
+	assert.Same(t, deployer, cached, "the deployer should be reused for the same subscription and credential")
+
+	stepConfig, err := m.getAzureConfig("00000000-0000-0000-0000-000000000002", "")
+	require.NoError(t, err)
+	assert.Equal(t, "00000000-0000-0000-0000-000000000002", stepConfig.SubscriptionID)
+	other, err := m.getARMDeployer(stepConfig, "", 30)
+	require.NoError(t, err)
+	assert.NotSame(t, deployer, other, "another subscription needs its own deployer")
+	assert.Len(t, m.deployers, 2)
+}
+
+func TestMixin_LogARMRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// Requests are only logged in debug mode
+	m := NewTestMixin(t)
+	client := autorest.NewClientWithUserAgent("test")
+	sender := client.Sender
+	m.logARMRequests(&client)
+	assert.Equal(t, sender, client.Sender, "the client should be left as is")
+
+	m.DebugMode = true
+	m.trackARMRequests("00000000-0000-0000-0000-0000000000c0", nil)
+	m.logARMRequests(&client)
+	m.armRequests.Track(&client)
+
+	req, err := autorest.Prepare(&http.Request{},
+		autorest.AsGet(),
+		autorest.WithBaseURL(server.URL),
+		autorest.WithHeader("Authorization", "Bearer secret-token"),
+	)
+	require.NoError(t, err)
+	resp, err := client.Send(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	logs := m.TestContext.GetError()
+	assert.Contains(t, logs, "[correlationId: 00000000-0000-0000-0000-0000000000c0] DEBUG ARM request GET "+server.URL)
+	assert.Contains(t, logs, "[correlationId: 00000000-0000-0000-0000-0000000000c0] DEBUG ARM response GET "+server.URL+" returned 200 in ")
+	assert.Contains(t, logs, "Authorization: REDACTED")
+	assert.NotContains(t, logs, "secret-token")
+}
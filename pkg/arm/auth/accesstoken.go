@@ -0,0 +1,255 @@
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+const (
+	// signingKeysPath is the path of the JWKS published by the Microsoft Entra
+	// ID endpoint of every cloud
+	signingKeysPath = "common/discovery/v2.0/keys"
+	// signingKeysCacheDuration is how long fetched signing keys are reused.
+	// Microsoft Entra ID rotates its keys every few weeks and an unknown key
+	// id forces a new fetch anyway.
+	signingKeysCacheDuration = 24 * time.Hour
+	// accessTokenLeeway allows for clock skew when validating the expiry
+	accessTokenLeeway = time.Minute
+	// adfsTenantID is the tenant of the clouds authenticating with AD FS,
+	// such as Azure Stack Hub disconnected from Microsoft Entra ID. adal uses
+	// the AD FS endpoints for it.
+	adfsTenantID = "adfs"
+	// adfsSigningKeysPath is the path of the JWKS published by AD FS
+	adfsSigningKeysPath = "discovery/keys"
+)
+
+// stsHosts are the hosts of the v1 token issuer of each cloud. v2 tokens are
+// issued by the Microsoft Entra ID endpoint of the environment.
+var stsHosts = map[string]string{
+	azure.PublicCloud.Name:       "sts.windows.net",
+	azure.USGovernmentCloud.Name: "sts.windows.net",
+	azure.ChinaCloud.Name:        "sts.chinacloudapi.cn",
+	azure.GermanCloud.Name:       "sts.microsoftonline.de",
+}
+
+type cachedSigningKeys struct {
+	keys      jwk.Set
+	fetchedAt time.Time
+}
+
+// signingKeyCache holds the signing keys by their URL or file, so that they
+// are fetched once per process rather than for every deployer
+type signingKeyCache struct {
+	mu   sync.Mutex
+	sets map[string]cachedSigningKeys
+}
+
+var signingKeys = &signingKeyCache{sets: map[string]cachedSigningKeys{}}
+
+// get returns the cached keys of the source, loading them when they aren't
+// cached, are stale or refresh is set
+func (c *signingKeyCache) get(source string, refresh bool, load func() (jwk.Set, error)) (jwk.Set, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.sets[source]
+	if ok && !refresh && time.Since(cached.fetchedAt) < signingKeysCacheDuration {
+		return cached.keys, nil
+	}
+	keys, err := load()
+	if err != nil {
+		return nil, err
+	}
+	c.sets[source] = cachedSigningKeys{keys: keys, fetchedAt: time.Now()}
+	return keys, nil
+}
+
+// getSigningKeysURL returns the JWKS URL of the Microsoft Entra ID or AD FS
+// endpoint of the environment
+func getSigningKeysURL(env azure.Environment) string {
+	if isADFS(env) {
+		return strings.TrimSuffix(env.ActiveDirectoryEndpoint, "/") + "/" + adfsSigningKeysPath
+	}
+	return strings.TrimSuffix(env.ActiveDirectoryEndpoint, "/") + "/" + signingKeysPath
+}
+
+// isADFS reports whether the environment authenticates with AD FS rather
+// than Microsoft Entra ID, as Azure Stack Hub does when it is disconnected.
+// Its active directory endpoint is then the AD FS endpoint, ending in /adfs.
+func isADFS(env azure.Environment) bool {
+	return strings.HasSuffix(strings.ToLower(strings.TrimSuffix(env.ActiveDirectoryEndpoint, "/")), "/adfs")
+}
+
+// getSigningKeys returns the keys used to verify access tokens, read from the
+// local JWKS file when one is set, otherwise fetched from the override URL or
+// from the environment
+func getSigningKeys(sptParameters ServicePrincipalTokenParameters, refresh bool) (jwk.Set, error) {
+	if sptParameters.AccessTokenKeysFile != "" {
+		return signingKeys.get("file:"+sptParameters.AccessTokenKeysFile, refresh, func() (jwk.Set, error) {
+			keys, err := jwk.ReadFile(sptParameters.AccessTokenKeysFile)
+			if err != nil {
+				return nil, fmt.Errorf("error reading signing keys from %s: %s", sptParameters.AccessTokenKeysFile, err)
+			}
+			return keys, nil
+		})
+	}
+
+	keysURL := sptParameters.AccessTokenKeysURL
+	if keysURL == "" {
+		keysURL = getSigningKeysURL(sptParameters.AzureEnvironment)
+	}
+	return signingKeys.get(keysURL, refresh, func() (jwk.Set, error) {
+		keys, err := jwk.Fetch(context.Background(), keysURL)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching signing keys from %s: %s", keysURL, err)
+		}
+		return keys, nil
+	})
+}
+
+// verifyAccessToken verifies the signature of the access token against the
+// signing keys, unless verification is skipped, and validates its expiry,
+// issuer and audience against the environment
+func verifyAccessToken(sptParameters ServicePrincipalTokenParameters) (*AccessTokenAzureClaims, error) {
+	claims := &AccessTokenAzureClaims{}
+	if sptParameters.SkipAccessTokenVerification {
+		_, _, err := jwt.NewParser().ParseUnverified(sptParameters.AccessToken, claims)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing the access token: %s", err)
+		}
+	} else {
+		token, err := jwt.ParseWithClaims(
+			sptParameters.AccessToken,
+			claims,
+			func(token *jwt.Token) (interface{}, error) {
+				return lookupSigningKey(sptParameters, token)
+			},
+			jwt.WithValidMethods([]string{jwa.RS256.String()}),
+			jwt.WithoutClaimsValidation(),
+		)
+		if err != nil {
+			return nil, err
+		} else if !token.Valid {
+			return nil, fmt.Errorf("the access token provided is invalid")
+		}
+	}
+
+	if err := validateClaim(claims.AppID, "AppID"); err != nil {
+		return nil, err
+	}
+	// AD FS tokens have no tenant
+	if isADFS(sptParameters.AzureEnvironment) && claims.TenantID == "" {
+		claims.TenantID = adfsTenantID
+	}
+	if err := validateClaim(claims.TenantID, "TenantID"); err != nil {
+		return nil, err
+	}
+	if err := validateAccessTokenClaims(claims, sptParameters.AzureEnvironment); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// lookupSigningKey returns the public key matching the key id of the token.
+// The keys are fetched again once when the key id is unknown, in case they
+// were rotated since they were cached.
+func lookupSigningKey(sptParameters ServicePrincipalTokenParameters, token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		return nil, fmt.Errorf("the header 'kid' is not found")
+	}
+
+	var key jwk.Key
+	for _, refresh := range []bool{false, true} {
+		keySet, err := getSigningKeys(sptParameters, refresh)
+		if err != nil {
+			return nil, err
+		}
+		if key, ok = keySet.LookupKeyID(kid); ok {
+			break
+		}
+	}
+	if key == nil {
+		return nil, fmt.Errorf("the key '%v' not found", kid)
+	}
+
+	publickey := &rsa.PublicKey{}
+	if err := key.Raw(publickey); err != nil {
+		return nil, fmt.Errorf("unable to parse the public key")
+	}
+	return publickey, nil
+}
+
+// validateAccessTokenClaims checks that the token hasn't expired and that it
+// was issued by and for the Azure environment
+func validateAccessTokenClaims(claims *AccessTokenAzureClaims, env azure.Environment) error {
+	validator := jwt.NewValidator(jwt.WithExpirationRequired(), jwt.WithLeeway(accessTokenLeeway))
+	if err := validator.Validate(claims); err != nil {
+		return fmt.Errorf("the access token is not valid: %s", err)
+	}
+
+	if !isValidIssuer(claims.Issuer, claims.TenantID, env) {
+		return fmt.Errorf("the access token was issued by %s, which is not the tenant %s in %s", claims.Issuer, claims.TenantID, env.Name)
+	}
+
+	for _, audience := range claims.Audience {
+		if isValidAudience(audience, env) {
+			return nil
+		}
+	}
+	return fmt.Errorf(
+		"the access token audience %s doesn't match the resource manager %s",
+		strings.Join(claims.Audience, ", "),
+		env.ResourceManagerEndpoint,
+	)
+}
+
+// isValidIssuer reports whether the issuer is the v1 or v2 token issuer of
+// the tenant in the environment, or its AD FS
+func isValidIssuer(issuer string, tenantID string, env azure.Environment) bool {
+	if isADFS(env) {
+		return strings.EqualFold(strings.TrimSuffix(issuer, "/"), strings.TrimSuffix(env.ActiveDirectoryEndpoint, "/"))
+	}
+	issuers := []string{
+		strings.TrimSuffix(env.ActiveDirectoryEndpoint, "/") + "/" + tenantID + "/",
+		strings.TrimSuffix(env.ActiveDirectoryEndpoint, "/") + "/" + tenantID + "/v2.0",
+	}
+	if host, ok := stsHosts[env.Name]; ok {
+		issuers = append(issuers, (&url.URL{Scheme: "https", Host: host, Path: "/" + tenantID + "/"}).String())
+	}
+	for _, valid := range issuers {
+		if strings.EqualFold(strings.TrimSuffix(issuer, "/"), strings.TrimSuffix(valid, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// isValidAudience reports whether the audience is the resource manager of
+// the environment
+func isValidAudience(audience string, env azure.Environment) bool {
+	for _, valid := range []string{env.ResourceManagerEndpoint, env.TokenAudience} {
+		if valid != "" && strings.EqualFold(strings.TrimSuffix(audience, "/"), strings.TrimSuffix(valid, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateClaim(claim, name string) error {
+	if len(strings.TrimSpace(claim)) == 0 {
+		return fmt.Errorf("the claim '%s' is not found in the access token", name)
+	}
+
+	return nil
+}
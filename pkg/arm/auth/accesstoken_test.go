@@ -0,0 +1,204 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testTenantID = "11111111-1111-1111-1111-111111111111"
+
+// newSigningKey generates a signing key and the JWKS that publishes it
+func newSigningKey(t *testing.T, kid string) (*rsa.PrivateKey, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	publicKey, err := jwk.New(&key.PublicKey)
+	require.NoError(t, err)
+	require.NoError(t, publicKey.Set(jwk.KeyIDKey, kid))
+	keySet := jwk.NewSet()
+	keySet.Add(publicKey)
+	data, err := json.Marshal(keySet)
+	require.NoError(t, err)
+	return key, data
+}
+
+func newAccessToken(t *testing.T, key *rsa.PrivateKey, kid string, update func(*AccessTokenAzureClaims)) string {
+	claims := &AccessTokenAzureClaims{
+		AppID:    "00000000-0000-0000-0000-000000000001",
+		TenantID: testTenantID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "https://sts.windows.net/" + testTenantID + "/",
+			Audience:  jwt.ClaimStrings{azure.PublicCloud.ResourceManagerEndpoint},
+			NotBefore: jwt.NewNumericDate(time.Now().Add(-time.Minute)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+	if update != nil {
+		update(claims)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+	return signed
+}
+
+func TestGetSigningKeysURL(t *testing.T) {
+	assert.Equal(t, MicrosoftEntraIDCommonPublicKeysEndpoint, getSigningKeysURL(azure.PublicCloud))
+	assert.Equal(t, "https://login.chinacloudapi.cn/common/discovery/v2.0/keys", getSigningKeysURL(azure.ChinaCloud))
+}
+
+func TestGetBearerTokenAuthorizer_AccessTokenKeysFile(t *testing.T) {
+	key, keySet := newSigningKey(t, "file-key")
+	keysFile := filepath.Join(t.TempDir(), "keys.json")
+	require.NoError(t, os.WriteFile(keysFile, keySet, 0600))
+	accessToken := newAccessToken(t, key, "file-key", nil)
+
+	authorizer, err := GetBearerTokenAuthorizer(ServicePrincipalTokenParameters{
+		AzureEnvironment:    azure.PublicCloud,
+		AccessToken:         accessToken,
+		AccessTokenKeysFile: keysFile,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer "+accessToken, authorize(t, authorizer))
+}
+
+func TestVerifyAccessToken_CachesKeys(t *testing.T) {
+	key, keySet := newSigningKey(t, "url-key")
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(keySet)
+	}))
+	defer server.Close()
+
+	sptParameters := ServicePrincipalTokenParameters{
+		AzureEnvironment:   azure.PublicCloud,
+		AccessToken:        newAccessToken(t, key, "url-key", nil),
+		AccessTokenKeysURL: server.URL,
+	}
+	for i := 0; i < 2; i++ {
+		_, err := verifyAccessToken(sptParameters)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 1, fetches, "the signing keys should be fetched once")
+
+	// An unknown key id fetches the keys again in case they were rotated
+	sptParameters.AccessToken = newAccessToken(t, key, "rotated-key", nil)
+	_, err := verifyAccessToken(sptParameters)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "the key 'rotated-key' not found")
+	assert.Equal(t, 2, fetches)
+}
+
+func TestVerifyAccessToken_Invalid(t *testing.T) {
+	key, keySet := newSigningKey(t, "invalid-key")
+	keysFile := filepath.Join(t.TempDir(), "keys.json")
+	require.NoError(t, os.WriteFile(keysFile, keySet, 0600))
+	otherKey, _ := newSigningKey(t, "invalid-key")
+
+	testcases := []struct {
+		name        string
+		accessToken string
+		env         azure.Environment
+		wantErr     string
+	}{
+		{"expired", newAccessToken(t, key, "invalid-key", func(c *AccessTokenAzureClaims) {
+			c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+		}), azure.PublicCloud, "token is expired"},
+		{"no expiry", newAccessToken(t, key, "invalid-key", func(c *AccessTokenAzureClaims) {
+			c.ExpiresAt = nil
+		}), azure.PublicCloud, "exp claim is required"},
+		{"other tenant issuer", newAccessToken(t, key, "invalid-key", func(c *AccessTokenAzureClaims) {
+			c.Issuer = "https://sts.windows.net/22222222-2222-2222-2222-222222222222/"
+		}), azure.PublicCloud, "which is not the tenant"},
+		{"other cloud", newAccessToken(t, key, "invalid-key", nil), azure.ChinaCloud, "which is not the tenant"},
+		{"other audience", newAccessToken(t, key, "invalid-key", func(c *AccessTokenAzureClaims) {
+			c.Audience = jwt.ClaimStrings{"https://graph.microsoft.com"}
+		}), azure.PublicCloud, "doesn't match the resource manager"},
+		{"bad signature", newAccessToken(t, otherKey, "invalid-key", nil), azure.PublicCloud, "signature is invalid"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := verifyAccessToken(ServicePrincipalTokenParameters{
+				AzureEnvironment:    tc.env,
+				AccessToken:         tc.accessToken,
+				AccessTokenKeysFile: keysFile,
+			})
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.wantErr)
+		})
+	}
+}
+
+func TestVerifyAccessToken_SkipVerification(t *testing.T) {
+	key, _ := newSigningKey(t, "broker-key")
+	sptParameters := ServicePrincipalTokenParameters{
+		AzureEnvironment:            azure.PublicCloud,
+		AccessToken:                 newAccessToken(t, key, "broker-key", nil),
+		AccessTokenKeysURL:          "http://127.0.0.1:0/unreachable",
+		SkipAccessTokenVerification: true,
+	}
+	claims, err := verifyAccessToken(sptParameters)
+	require.NoError(t, err)
+	assert.Equal(t, testTenantID, claims.TenantID)
+
+	// The claims are still validated
+	sptParameters.AccessToken = newAccessToken(t, key, "broker-key", func(c *AccessTokenAzureClaims) {
+		c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+	})
+	_, err = verifyAccessToken(sptParameters)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "token is expired")
+}
+
+func TestVerifyAccessToken_ADFS(t *testing.T) {
+	env := azure.Environment{
+		Name:                    "AzureStackCloud",
+		ActiveDirectoryEndpoint: "https://adfs.local.azurestack.external/adfs/",
+		ResourceManagerEndpoint: "https://management.local.azurestack.external/",
+		TokenAudience:           "https://management.adfs.azurestack.local/00000000-0000-0000-0000-000000000002",
+	}
+	assert.Equal(t, "https://adfs.local.azurestack.external/adfs/discovery/keys", getSigningKeysURL(env))
+
+	key, keySet := newSigningKey(t, "adfs-key")
+	keysFile := filepath.Join(t.TempDir(), "keys.json")
+	require.NoError(t, os.WriteFile(keysFile, keySet, 0600))
+	adfsToken := func(issuer string) string {
+		return newAccessToken(t, key, "adfs-key", func(c *AccessTokenAzureClaims) {
+			c.TenantID = ""
+			c.Issuer = issuer
+			c.Audience = jwt.ClaimStrings{env.TokenAudience}
+		})
+	}
+
+	// AD FS tokens are issued by AD FS itself, without a tenant
+	claims, err := verifyAccessToken(ServicePrincipalTokenParameters{
+		AzureEnvironment:    env,
+		AccessToken:         adfsToken("https://adfs.local.azurestack.external/adfs"),
+		AccessTokenKeysFile: keysFile,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "adfs", claims.TenantID)
+
+	_, err = verifyAccessToken(ServicePrincipalTokenParameters{
+		AzureEnvironment:    env,
+		AccessToken:         adfsToken("https://adfs.other.external/adfs"),
+		AccessTokenKeysFile: keysFile,
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "the access token was issued by https://adfs.other.external/adfs")
+}
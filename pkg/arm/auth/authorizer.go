@@ -2,20 +2,21 @@ package auth
 
 import (
 	"context"
-	"crypto/rsa"
 	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/Azure/go-autorest/autorest"
 	"github.com/Azure/go-autorest/autorest/adal"
 	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/lestrrat-go/jwx/jwa"
-	"github.com/lestrrat-go/jwx/jwk"
 )
 
 const (
+	// MicrosoftEntraIDCommonPublicKeysEndpoint is the JWKS of the public
+	// cloud. Access tokens are verified against the JWKS of the selected
+	// environment.
 	MicrosoftEntraIDCommonPublicKeysEndpoint = "https://login.microsoftonline.com/common/discovery/v2.0/keys"
 	TokenType                                = "Bearer"
 )
@@ -25,6 +26,9 @@ type OAuthTokenGrantFlow int
 const (
 	ClientCredentials OAuthTokenGrantFlow = iota
 	Undefined
+	ManagedIdentity
+	WorkloadIdentity
+	ClientCertificate
 )
 
 type ServicePrincipalTokenParameters struct {
@@ -32,8 +36,36 @@ type ServicePrincipalTokenParameters struct {
 	TenantID         string
 	ClientID         string
 	ClientSecret     string
-	Resource         string
-	Token            adal.Token
+	AccessToken      string
+	// UseManagedIdentity selects the managed identity flow. A user-assigned
+	// identity is selected by ClientID or by IdentityResourceID, otherwise the
+	// system-assigned identity is used.
+	UseManagedIdentity bool
+	IdentityResourceID string
+	// ManagedIdentityEndpoint overrides the IMDS or App Service endpoint
+	ManagedIdentityEndpoint string
+	// FederatedTokenFile selects workload identity federation. The file holds
+	// the assertion exchanged for an ARM token.
+	FederatedTokenFile string
+	// ClientCertificatePath or ClientCertificate, a base64 encoded PEM or PFX
+	// certificate, select the client certificate flow
+	ClientCertificatePath     string
+	ClientCertificate         string
+	ClientCertificatePassword string
+	// AccessTokenKeysURL and AccessTokenKeysFile override the JWKS used to
+	// verify AccessToken, which defaults to the keys of the environment
+	AccessTokenKeysURL  string
+	AccessTokenKeysFile string
+	// SkipAccessTokenVerification trusts the signature of AccessToken, for
+	// tokens handed over by a trusted broker. Its claims are still validated.
+	SkipAccessTokenVerification bool
+	// AccessTokenFile and AccessTokenRefreshCommand supply a new access token
+	// when AccessToken is about to expire, so that long deployments don't fail.
+	// The file is read again, or the command is run and its output used.
+	AccessTokenFile           string
+	AccessTokenRefreshCommand string
+	Resource                  string
+	Token                     adal.Token
 }
 
 type AccessTokenAzureClaims struct {
@@ -44,35 +76,37 @@ type AccessTokenAzureClaims struct {
 
 // Get the bearer token authorizer for the respective oauth token grant flow.
 func GetBearerTokenAuthorizer(
-	azureEnvironment azure.Environment,
-	tenantID string,
-	clientID string,
-	clientSecret string,
-	accessToken string,
+	sptParameters ServicePrincipalTokenParameters,
 ) (*autorest.BearerAuthorizer, error) {
-	sptParameters := &ServicePrincipalTokenParameters{
-		AzureEnvironment: azureEnvironment,
-		TenantID:         tenantID,
-		ClientID:         clientID,
-		ClientSecret:     clientSecret,
-	}
-
-	grantFlow := ClientCredentials
-
-	if len(strings.TrimSpace(accessToken)) != 0 {
-		claims, err := verifyAccessToken(accessToken)
+	grantFlow := getGrantFlow(sptParameters)
+
+	if grantFlow == Undefined {
+		if sptParameters.AccessToken == "" {
+			accessToken, err := readAccessToken(context.Background(), sptParameters)
+			if err != nil {
+				return nil, err
+			}
+			sptParameters.AccessToken = accessToken
+		}
+		accessToken := sptParameters.AccessToken
+		claims, err := verifyAccessToken(sptParameters)
 		if err != nil {
 			return nil, err
 		}
+		if canRefreshAccessToken(sptParameters) {
+			return autorest.NewBearerAuthorizer(newRefreshableAccessToken(sptParameters, claims)), nil
+		}
 
-		grantFlow = Undefined
 		sptParameters.ClientID = claims.AppID
 		sptParameters.TenantID = claims.TenantID
 		if len(claims.RegisteredClaims.Audience) != 0 {
 			sptParameters.Resource = claims.RegisteredClaims.Audience[0]
 		}
 
-		notBefore := claims.RegisteredClaims.NotBefore.Unix()
+		notBefore := time.Now().Unix()
+		if claims.RegisteredClaims.NotBefore != nil {
+			notBefore = claims.RegisteredClaims.NotBefore.Unix()
+		}
 		expiresOn := claims.RegisteredClaims.ExpiresAt.Unix()
 		oauthToken := adal.Token{
 			AccessToken: accessToken,
@@ -86,7 +120,7 @@ func GetBearerTokenAuthorizer(
 		sptParameters.Token = oauthToken
 	}
 
-	spt, err := newServicePrincipalToken(sptParameters, grantFlow)
+	spt, err := newServicePrincipalToken(&sptParameters, grantFlow)
 	if err != nil {
 		return nil, fmt.Errorf("error getting service principal token: %s", err)
 	}
@@ -94,10 +128,35 @@ func GetBearerTokenAuthorizer(
 	return autorest.NewBearerAuthorizer(spt), nil
 }
 
+// getGrantFlow selects the grant flow from the supplied parameters. A
+// pre-fetched access token, or a way to get one, wins over everything else.
+func getGrantFlow(sptParameters ServicePrincipalTokenParameters) OAuthTokenGrantFlow {
+	switch {
+	case len(strings.TrimSpace(sptParameters.AccessToken)) != 0,
+		canRefreshAccessToken(sptParameters):
+		return Undefined
+	case sptParameters.UseManagedIdentity:
+		return ManagedIdentity
+	case len(strings.TrimSpace(sptParameters.FederatedTokenFile)) != 0:
+		return WorkloadIdentity
+	case len(strings.TrimSpace(sptParameters.ClientCertificatePath)) != 0,
+		len(strings.TrimSpace(sptParameters.ClientCertificate)) != 0:
+		return ClientCertificate
+	default:
+		return ClientCredentials
+	}
+}
+
 func newServicePrincipalToken(
 	sptParameters *ServicePrincipalTokenParameters,
 	tokenGrantFlow OAuthTokenGrantFlow,
 ) (*adal.ServicePrincipalToken, error) {
+	// Managed identities get their token from the local identity endpoint
+	// rather than from Microsoft Entra ID
+	if tokenGrantFlow == ManagedIdentity {
+		return newManagedIdentityToken(sptParameters)
+	}
+
 	// Get a token used for authorizing requests to Azure
 	oauthConfig, err := adal.NewOAuthConfig(
 		sptParameters.AzureEnvironment.ActiveDirectoryEndpoint,
@@ -113,8 +172,12 @@ func newServicePrincipalToken(
 			*oauthConfig,
 			sptParameters.ClientID,
 			sptParameters.ClientSecret,
-			sptParameters.AzureEnvironment.ResourceManagerEndpoint,
+			getTokenResource(sptParameters.AzureEnvironment),
 		)
+	case WorkloadIdentity:
+		return newFederatedToken(*oauthConfig, sptParameters)
+	case ClientCertificate:
+		return newCertificateToken(*oauthConfig, sptParameters)
 	default:
 		return adal.NewServicePrincipalTokenFromManualToken(
 			*oauthConfig,
@@ -125,56 +188,12 @@ func newServicePrincipalToken(
 	}
 }
 
-func verifyAccessToken(accessToken string) (*AccessTokenAzureClaims, error) {
-	keySet, err := jwk.Fetch(context.Background(), MicrosoftEntraIDCommonPublicKeysEndpoint)
-
-	token, err := jwt.ParseWithClaims(accessToken, &AccessTokenAzureClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if token.Method.Alg() != jwa.RS256.String() {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		kid, ok := token.Header["kid"].(string)
-		if !ok {
-			return nil, fmt.Errorf("the header 'kid' is not found")
-		}
-
-		keys, ok := keySet.LookupKeyID(kid)
-		if !ok {
-			return nil, fmt.Errorf("the key '%v' not found", kid)
-		}
-
-		publickey := &rsa.PublicKey{}
-		err = keys.Raw(publickey)
-		if err != nil {
-			return nil, fmt.Errorf("unable to parse the public key")
-		}
-
-		return publickey, nil
-	})
-
-	if err != nil {
-		return nil, err
-	} else if !token.Valid {
-		return nil, fmt.Errorf("the access token provided is invalid")
-	}
-
-	if claims, ok := token.Claims.(*AccessTokenAzureClaims); ok {
-		if err := validateClaim(claims.AppID, "AppID"); err != nil {
-			return nil, err
-		}
-		if err := validateClaim(claims.TenantID, "TenantID"); err != nil {
-			return nil, err
-		}
-
-		return claims, nil
-	} else {
-		return nil, fmt.Errorf("unknown claims type")
-	}
-}
-
-func validateClaim(claim, name string) error {
-	if len(strings.TrimSpace(claim)) == 0 {
-		return fmt.Errorf("the claim '%s' is not found in the access token", name)
+// getTokenResource returns the resource tokens are requested for, which is
+// the token audience of the environment. Custom clouds loaded from a file may
+// only set the resource manager endpoint.
+func getTokenResource(env azure.Environment) string {
+	if env.TokenAudience != "" {
+		return env.TokenAudience
 	}
-
-	return nil
+	return env.ResourceManagerEndpoint
 }
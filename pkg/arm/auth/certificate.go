@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/youmark/pkcs8"
+)
+
+// newCertificateToken returns a token that authenticates the service
+// principal with a client assertion signed by its certificate. It is
+// refreshed automatically before it expires.
+func newCertificateToken(
+	oauthConfig adal.OAuthConfig,
+	sptParameters *ServicePrincipalTokenParameters,
+) (*adal.ServicePrincipalToken, error) {
+	if sptParameters.ClientID == "" || sptParameters.TenantID == "" {
+		return nil, errors.New(
+			"a client ID and a tenant ID are required with a client certificate",
+		)
+	}
+	certificateData, err := readClientCertificate(sptParameters)
+	if err != nil {
+		return nil, err
+	}
+	certificate, privateKey, err := decodeClientCertificate(
+		certificateData,
+		sptParameters.ClientCertificatePassword,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return adal.NewServicePrincipalTokenFromCertificate(
+		oauthConfig,
+		sptParameters.ClientID,
+		certificate,
+		privateKey,
+		getTokenResource(sptParameters.AzureEnvironment),
+	)
+}
+
+// readClientCertificate reads the certificate from its file, or decodes it
+// from base64 when it was passed inline
+func readClientCertificate(sptParameters *ServicePrincipalTokenParameters) ([]byte, error) {
+	if sptParameters.ClientCertificatePath != "" {
+		data, err := os.ReadFile(sptParameters.ClientCertificatePath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading client certificate: %s", err)
+		}
+		return data, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(sptParameters.ClientCertificate))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding base64 client certificate: %s", err)
+	}
+	return data, nil
+}
+
+// decodeClientCertificate returns the certificate and RSA private key from
+// PEM or PFX (PKCS#12) data. PEM data must hold both the certificate and the
+// key, which may be encrypted with the password.
+func decodeClientCertificate(data []byte, password string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		certificate, privateKey, err := adal.DecodePfxCertificateData(data, password)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error decoding PFX client certificate: %s", err)
+		}
+		return certificate, privateKey, nil
+	}
+
+	var certificate *x509.Certificate
+	var privateKey *rsa.PrivateKey
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		switch {
+		case block.Type == "CERTIFICATE" && certificate == nil:
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, fmt.Errorf("error parsing client certificate: %s", err)
+			}
+			certificate = cert
+		case strings.HasSuffix(block.Type, "PRIVATE KEY") && privateKey == nil:
+			key, err := parsePrivateKey(block, password)
+			if err != nil {
+				return nil, nil, err
+			}
+			privateKey = key
+		}
+	}
+	if certificate == nil {
+		return nil, nil, errors.New("no certificate found in the PEM client certificate")
+	}
+	if privateKey == nil {
+		return nil, nil, errors.New("no private key found in the PEM client certificate")
+	}
+	return certificate, privateKey, nil
+}
+
+// parsePrivateKey parses a PKCS#1 or PKCS#8 RSA private key, decrypting it
+// first when the PEM block is encrypted. Both the legacy PEM encryption and
+// encrypted PKCS#8, which openssl 3 writes by default, are supported.
+func parsePrivateKey(block *pem.Block, password string) (*rsa.PrivateKey, error) {
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		if password == "" {
+			return nil, errors.New("the client certificate private key is encrypted but no password was given")
+		}
+		key, err := pkcs8.ParsePKCS8PrivateKeyRSA(block.Bytes, []byte(password))
+		if err != nil {
+			return nil, fmt.Errorf("error decrypting client certificate private key: %s", err)
+		}
+		return key, nil
+	}
+
+	der := block.Bytes
+	//nolint:staticcheck // legacy PEM encryption is what openssl writes for -des3 keys
+	if x509.IsEncryptedPEMBlock(block) {
+		if password == "" {
+			return nil, errors.New("the client certificate private key is encrypted but no password was given")
+		}
+		var err error
+		//nolint:staticcheck
+		der, err = x509.DecryptPEMBlock(block, []byte(password))
+		if err != nil {
+			return nil, fmt.Errorf("error decrypting client certificate private key: %s", err)
+		}
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing client certificate private key: %s", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("the client certificate private key must be an RSA key")
+	}
+	return rsaKey, nil
+}
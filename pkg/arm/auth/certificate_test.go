@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCertificate generates a self-signed certificate and its key
+func newTestCertificate(t *testing.T) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "porter-arm-mixin-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return certificate, key
+}
+
+func encodePEM(certificate *x509.Certificate, keyBlock *pem.Block) []byte {
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw})
+	return append(data, pem.EncodeToMemory(keyBlock)...)
+}
+
+// newFakeCertificateTokenEndpoint starts a local stand-in for the Microsoft
+// Entra ID token endpoint that only issues tokens for client assertions
+// signed by the certificate
+func newFakeCertificateTokenEndpoint(t *testing.T, certificate *x509.Certificate) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, clientAssertionType, r.PostForm.Get("client_assertion_type"))
+		assertion, err := jwt.Parse(r.PostForm.Get("client_assertion"), func(token *jwt.Token) (interface{}, error) {
+			return certificate.PublicKey, nil
+		})
+		if err != nil || !assertion.Valid || assertion.Header["x5t"] == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		expiresOn := time.Now().Add(time.Hour).Unix()
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "arm-token",
+			"expires_in":   "3600",
+			"expires_on":   fmt.Sprint(expiresOn),
+			"not_before":   fmt.Sprint(expiresOn - 3600),
+			"resource":     r.PostForm.Get("resource"),
+			"token_type":   "Bearer",
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestGetBearerTokenAuthorizer_ClientCertificate(t *testing.T) {
+	certificate, key := newTestCertificate(t)
+	server := newFakeCertificateTokenEndpoint(t, certificate)
+	env := azure.PublicCloud
+	env.ActiveDirectoryEndpoint = server.URL + "/"
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	pemData := encodePEM(certificate, &pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})
+	//nolint:staticcheck
+	encryptedKey, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key), []byte("secret"), x509.PEMCipherAES256)
+	require.NoError(t, err)
+	certificatePath := filepath.Join(t.TempDir(), "client.pem")
+	require.NoError(t, os.WriteFile(certificatePath, pemData, 0600))
+
+	testcases := []struct {
+		name       string
+		parameters ServicePrincipalTokenParameters
+	}{
+		{"pem file", ServicePrincipalTokenParameters{
+			ClientCertificatePath: certificatePath,
+		}},
+		{"base64 pem", ServicePrincipalTokenParameters{
+			ClientCertificate: base64.StdEncoding.EncodeToString(pemData),
+		}},
+		{"encrypted pem", ServicePrincipalTokenParameters{
+			ClientCertificate:         base64.StdEncoding.EncodeToString(encodePEM(certificate, encryptedKey)),
+			ClientCertificatePassword: "secret",
+		}},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.parameters.AzureEnvironment = env
+			tc.parameters.TenantID = "tenant"
+			tc.parameters.ClientID = "00000000-0000-0000-0000-000000000001"
+			require.Equal(t, ClientCertificate, getGrantFlow(tc.parameters))
+
+			authorizer, err := GetBearerTokenAuthorizer(tc.parameters)
+			require.NoError(t, err)
+			assert.Equal(t, "Bearer arm-token", authorize(t, authorizer))
+		})
+	}
+}
+
+func TestDecodeClientCertificate_Errors(t *testing.T) {
+	certificate, key := newTestCertificate(t)
+	//nolint:staticcheck
+	encryptedKey, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key), []byte("secret"), x509.PEMCipherAES256)
+	require.NoError(t, err)
+
+	testcases := []struct {
+		name     string
+		data     []byte
+		password string
+		wantErr  string
+	}{
+		{"missing key", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}), "", "no private key found"},
+		{"missing password", encodePEM(certificate, encryptedKey), "", "no password was given"},
+		{"wrong password", encodePEM(certificate, encryptedKey), "wrong", "client certificate private key"},
+		{"invalid pfx", []byte("not a certificate"), "", "error decoding PFX"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := decodeClientCertificate(tc.data, tc.password)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.wantErr)
+		})
+	}
+}
+
+func TestDecodeClientCertificate_EncryptedPKCS8(t *testing.T) {
+	// Generated by openssl 3, which encrypts keys with PKCS#8 by default:
+	// openssl req -x509 -newkey rsa:2048 -passout pass:secret ...
+	data, err := os.ReadFile("testdata/client-encrypted-pkcs8.pem")
+	require.NoError(t, err)
+
+	certificate, key, err := decodeClientCertificate(data, "secret")
+	require.NoError(t, err)
+	assert.Equal(t, "porter-arm-mixin-test", certificate.Subject.CommonName)
+	assert.True(t, key.PublicKey.Equal(certificate.PublicKey), "the key should match the certificate")
+
+	_, _, err = decodeClientCertificate(data, "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no password was given")
+
+	_, _, err = decodeClientCertificate(data, "wrong")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "error decrypting client certificate private key")
+}
@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"fmt"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+)
+
+// newManagedIdentityToken returns a token for the managed identity of the
+// host. The endpoint is detected from the environment: App Service and
+// Functions expose MSI_ENDPOINT and MSI_SECRET, while VMs, VM scale sets and
+// AKS nodes use IMDS. ManagedIdentityEndpoint overrides the detected endpoint.
+// The IDENTITY_ENDPOINT and IDENTITY_HEADER variables of the 2019-08-01
+// App Service API aren't supported, App Service sets the MSI ones as well.
+func newManagedIdentityToken(
+	sptParameters *ServicePrincipalTokenParameters,
+) (*adal.ServicePrincipalToken, error) {
+	msiEndpoint := sptParameters.ManagedIdentityEndpoint
+	resource := getTokenResource(sptParameters.AzureEnvironment)
+
+	switch {
+	case sptParameters.ClientID != "" && sptParameters.IdentityResourceID != "":
+		return nil, fmt.Errorf(
+			"a user-assigned managed identity is selected by either a client ID " +
+				"or a resource ID, not both",
+		)
+	case sptParameters.ClientID != "":
+		return adal.NewServicePrincipalTokenFromMSIWithUserAssignedID(
+			msiEndpoint,
+			resource,
+			sptParameters.ClientID,
+		)
+	case sptParameters.IdentityResourceID != "":
+		return adal.NewServicePrincipalTokenFromMSIWithIdentityResourceID(
+			msiEndpoint,
+			resource,
+			sptParameters.IdentityResourceID,
+		)
+	default:
+		return adal.NewServicePrincipalTokenFromMSI(msiEndpoint, resource)
+	}
+}
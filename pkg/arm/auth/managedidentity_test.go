@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFakeIMDS starts a local stand-in for the IMDS identity endpoint that
+// records the query of each token request
+func newFakeIMDS(t *testing.T, requests *[]url.Values) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		*requests = append(*requests, r.URL.Query())
+		expiresOn := time.Now().Add(time.Hour).Unix()
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "imds-token",
+			"expires_in":   "3599",
+			"expires_on":   fmt.Sprint(expiresOn),
+			"not_before":   fmt.Sprint(expiresOn - 3599),
+			"resource":     r.URL.Query().Get("resource"),
+			"token_type":   "Bearer",
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func authorize(t *testing.T, authorizer *autorest.BearerAuthorizer) string {
+	req, err := autorest.Prepare(
+		&http.Request{},
+		autorest.WithBaseURL("https://management.azure.com"),
+		authorizer.WithAuthorization(),
+	)
+	require.NoError(t, err)
+	return req.Header.Get("Authorization")
+}
+
+func TestGetBearerTokenAuthorizer_ManagedIdentity(t *testing.T) {
+	testcases := []struct {
+		name       string
+		clientID   string
+		resourceID string
+		wantQuery  url.Values
+	}{
+		{
+			name:      "system-assigned",
+			wantQuery: url.Values{},
+		},
+		{
+			name:      "user-assigned by client id",
+			clientID:  "00000000-0000-0000-0000-000000000001",
+			wantQuery: url.Values{"client_id": {"00000000-0000-0000-0000-000000000001"}},
+		},
+		{
+			name:       "user-assigned by resource id",
+			resourceID: "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/porter",
+			wantQuery:  url.Values{"mi_res_id": {"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/porter"}},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var requests []url.Values
+			server := newFakeIMDS(t, &requests)
+
+			authorizer, err := GetBearerTokenAuthorizer(ServicePrincipalTokenParameters{
+				AzureEnvironment:        azure.PublicCloud,
+				ClientID:                tc.clientID,
+				UseManagedIdentity:      true,
+				IdentityResourceID:      tc.resourceID,
+				ManagedIdentityEndpoint: server.URL,
+			})
+			require.NoError(t, err)
+
+			assert.Equal(t, "Bearer imds-token", authorize(t, authorizer))
+			require.Len(t, requests, 1)
+			assert.Equal(t, azure.PublicCloud.ResourceManagerEndpoint, requests[0].Get("resource"))
+			for _, key := range []string{"client_id", "mi_res_id"} {
+				assert.Equal(t, tc.wantQuery.Get(key), requests[0].Get(key))
+			}
+		})
+	}
+}
+
+func TestGetBearerTokenAuthorizer_ManagedIdentityAppService(t *testing.T) {
+	var requests []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("secret") != "app-service-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		requests = append(requests, r.URL.Query())
+		// App Service returns expires_on as a date
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "app-service-token",
+			"expires_on":   time.Now().Add(time.Hour).UTC().Format("1/2/2006 15:04:05 +00:00"),
+			"resource":     r.URL.Query().Get("resource"),
+			"token_type":   "Bearer",
+		})
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("MSI_ENDPOINT", server.URL)
+	t.Setenv("MSI_SECRET", "app-service-secret")
+
+	authorizer, err := GetBearerTokenAuthorizer(ServicePrincipalTokenParameters{
+		AzureEnvironment:   azure.PublicCloud,
+		ClientID:           "00000000-0000-0000-0000-000000000001",
+		UseManagedIdentity: true,
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "Bearer app-service-token", authorize(t, authorizer))
+	require.Len(t, requests, 1)
+	assert.Equal(t, "2017-09-01", requests[0].Get("api-version"))
+	assert.Equal(t, azure.PublicCloud.ResourceManagerEndpoint, requests[0].Get("resource"))
+	assert.Equal(t, "00000000-0000-0000-0000-000000000001", requests[0].Get("clientid"), "App Service names the client id clientid")
+}
+
+func TestGetBearerTokenAuthorizer_ManagedIdentityConflict(t *testing.T) {
+	_, err := GetBearerTokenAuthorizer(ServicePrincipalTokenParameters{
+		AzureEnvironment:   azure.PublicCloud,
+		ClientID:           "00000000-0000-0000-0000-000000000001",
+		UseManagedIdentity: true,
+		IdentityResourceID: "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/porter",
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not both")
+}
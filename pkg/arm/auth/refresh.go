@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// accessTokenRefreshWindow is how long before it expires a refreshable
+// access token is replaced, matching the window adal uses for its tokens
+const accessTokenRefreshWindow = 5 * time.Minute
+
+// AccessTokenExpiresOn returns the expiry of the access token without
+// verifying it
+func AccessTokenExpiresOn(accessToken string) (time.Time, error) {
+	claims := &jwt.RegisteredClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(accessToken, claims); err != nil {
+		return time.Time{}, fmt.Errorf("error parsing the access token: %s", err)
+	}
+	if claims.ExpiresAt == nil {
+		return time.Time{}, fmt.Errorf("the access token has no expiry")
+	}
+	return claims.ExpiresAt.Time, nil
+}
+
+// canRefreshAccessToken reports whether a new access token can be obtained
+// once the supplied one expires
+func canRefreshAccessToken(sptParameters ServicePrincipalTokenParameters) bool {
+	return sptParameters.AccessTokenFile != "" || sptParameters.AccessTokenRefreshCommand != ""
+}
+
+// readAccessToken gets a new access token by running the refresh command, or
+// else by reading the access token file again
+func readAccessToken(ctx context.Context, sptParameters ServicePrincipalTokenParameters) (string, error) {
+	var accessToken []byte
+	if sptParameters.AccessTokenRefreshCommand != "" {
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, "sh", "-c", sptParameters.AccessTokenRefreshCommand)
+		cmd.Stderr = &stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("error running the access token refresh command: %s: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		accessToken = output
+	} else {
+		data, err := os.ReadFile(sptParameters.AccessTokenFile)
+		if err != nil {
+			return "", fmt.Errorf("error reading access token file: %s", err)
+		}
+		accessToken = data
+	}
+	if len(bytes.TrimSpace(accessToken)) == 0 {
+		return "", fmt.Errorf("no access token was returned by the refresh command or the access token file")
+	}
+	return string(bytes.TrimSpace(accessToken)), nil
+}
+
+// refreshableAccessToken is an access token supplied by the caller that is
+// replaced by running the refresh command or by reading the token file again
+// shortly before it expires. Every new token is verified like the first one.
+type refreshableAccessToken struct {
+	mu            sync.Mutex
+	sptParameters ServicePrincipalTokenParameters
+	accessToken   string
+	expiresOn     time.Time
+}
+
+func newRefreshableAccessToken(
+	sptParameters ServicePrincipalTokenParameters,
+	claims *AccessTokenAzureClaims,
+) *refreshableAccessToken {
+	return &refreshableAccessToken{
+		sptParameters: sptParameters,
+		accessToken:   sptParameters.AccessToken,
+		expiresOn:     claims.ExpiresAt.Time,
+	}
+}
+
+// OAuthToken implements adal.OAuthTokenProvider
+func (t *refreshableAccessToken) OAuthToken() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.accessToken
+}
+
+// EnsureFreshWithContext implements adal.RefresherWithContext. It gets a
+// new token when the current one is about to expire.
+func (t *refreshableAccessToken) EnsureFreshWithContext(ctx context.Context) error {
+	t.mu.Lock()
+	fresh := time.Until(t.expiresOn) > accessTokenRefreshWindow
+	t.mu.Unlock()
+	if fresh {
+		return nil
+	}
+	return t.RefreshWithContext(ctx)
+}
+
+// RefreshWithContext implements adal.RefresherWithContext
+func (t *refreshableAccessToken) RefreshWithContext(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	accessToken, err := readAccessToken(ctx, t.sptParameters)
+	if err != nil {
+		return err
+	}
+	sptParameters := t.sptParameters
+	sptParameters.AccessToken = accessToken
+	claims, err := verifyAccessToken(sptParameters)
+	if err != nil {
+		return fmt.Errorf("the refreshed access token is invalid: %s", err)
+	}
+	t.accessToken = accessToken
+	t.expiresOn = claims.ExpiresAt.Time
+	return nil
+}
+
+// RefreshExchangeWithContext implements adal.RefresherWithContext. The
+// resource can't be changed, so it is the same as RefreshWithContext.
+func (t *refreshableAccessToken) RefreshExchangeWithContext(ctx context.Context, resource string) error {
+	return t.RefreshWithContext(ctx)
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetBearerTokenAuthorizer_RefreshAccessToken(t *testing.T) {
+	key, keySet := newSigningKey(t, "refresh-key")
+	dir := t.TempDir()
+	keysFile := filepath.Join(dir, "keys.json")
+	require.NoError(t, os.WriteFile(keysFile, keySet, 0600))
+	tokenFile := filepath.Join(dir, "access-token")
+
+	// The first token is within the refresh window, so it is replaced by the
+	// next request
+	expiring := newAccessToken(t, key, "refresh-key", func(c *AccessTokenAzureClaims) {
+		c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(2 * time.Minute))
+	})
+	refreshed := newAccessToken(t, key, "refresh-key", nil)
+
+	testcases := []struct {
+		name          string
+		sptParameters ServicePrincipalTokenParameters
+	}{
+		{"token file", ServicePrincipalTokenParameters{
+			AccessTokenFile: tokenFile,
+		}},
+		{"refresh command", ServicePrincipalTokenParameters{
+			AccessTokenRefreshCommand: "cat " + tokenFile,
+		}},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.NoError(t, os.WriteFile(tokenFile, []byte(expiring+"\n"), 0600))
+			tc.sptParameters.AzureEnvironment = azure.PublicCloud
+			tc.sptParameters.AccessTokenKeysFile = keysFile
+			require.Equal(t, Undefined, getGrantFlow(tc.sptParameters))
+
+			authorizer, err := GetBearerTokenAuthorizer(tc.sptParameters)
+			require.NoError(t, err)
+
+			require.NoError(t, os.WriteFile(tokenFile, []byte(refreshed+"\n"), 0600))
+			assert.Equal(t, "Bearer "+refreshed, authorize(t, authorizer))
+		})
+	}
+}
+
+func TestReadAccessToken_Errors(t *testing.T) {
+	testcases := []struct {
+		name          string
+		sptParameters ServicePrincipalTokenParameters
+		wantErr       string
+	}{
+		{"failed command", ServicePrincipalTokenParameters{
+			AccessTokenRefreshCommand: "echo 'not logged in' >&2; exit 1",
+		}, "not logged in"},
+		{"empty output", ServicePrincipalTokenParameters{
+			AccessTokenRefreshCommand: "true",
+		}, "no access token was returned"},
+		{"missing file", ServicePrincipalTokenParameters{
+			AccessTokenFile: filepath.Join(t.TempDir(), "missing"),
+		}, "error reading access token file"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := GetBearerTokenAuthorizer(tc.sptParameters)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.wantErr)
+		})
+	}
+}
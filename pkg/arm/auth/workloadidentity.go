@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+)
+
+const clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// ServicePrincipalFederatedTokenSecret authenticates with a federated
+// credential, such as the OIDC token that GitHub Actions or AKS workload
+// identity write to a file. The file is read again on every token refresh,
+// so that an assertion rotated by the platform is picked up during long
+// deployments.
+type ServicePrincipalFederatedTokenSecret struct {
+	TokenFilePath string
+}
+
+// SetAuthenticationValues is a method of the interface ServicePrincipalSecret.
+// It sets the client assertion read from the token file.
+func (secret *ServicePrincipalFederatedTokenSecret) SetAuthenticationValues(
+	spt *adal.ServicePrincipalToken,
+	v *url.Values,
+) error {
+	assertion, err := os.ReadFile(secret.TokenFilePath)
+	if err != nil {
+		return fmt.Errorf("error reading federated token file: %s", err)
+	}
+	if len(strings.TrimSpace(string(assertion))) == 0 {
+		return fmt.Errorf("the federated token file %s is empty", secret.TokenFilePath)
+	}
+	v.Set("client_assertion", strings.TrimSpace(string(assertion)))
+	v.Set("client_assertion_type", clientAssertionType)
+	return nil
+}
+
+// newFederatedToken returns a token that exchanges the federated assertion
+// for an ARM token. It is refreshed automatically before it expires.
+func newFederatedToken(
+	oauthConfig adal.OAuthConfig,
+	sptParameters *ServicePrincipalTokenParameters,
+) (*adal.ServicePrincipalToken, error) {
+	if sptParameters.ClientID == "" || sptParameters.TenantID == "" {
+		return nil, errors.New(
+			"a client ID and a tenant ID are required with a federated token file",
+		)
+	}
+	return adal.NewServicePrincipalTokenWithSecret(
+		oauthConfig,
+		sptParameters.ClientID,
+		getTokenResource(sptParameters.AzureEnvironment),
+		&ServicePrincipalFederatedTokenSecret{
+			TokenFilePath: sptParameters.FederatedTokenFile,
+		},
+	)
+}
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFakeTokenEndpoint starts a local stand-in for the Microsoft Entra ID
+// token endpoint. It records the client assertion of each request and issues
+// tokens that are about to expire, so that every request refreshes them.
+func newFakeTokenEndpoint(t *testing.T, assertions *[]string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		if r.PostForm.Get("client_assertion_type") != clientAssertionType {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		*assertions = append(*assertions, r.PostForm.Get("client_assertion"))
+		expiresOn := time.Now().Add(time.Minute).Unix()
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": fmt.Sprintf("arm-token-%d", len(*assertions)),
+			"expires_in":   "60",
+			"expires_on":   fmt.Sprint(expiresOn),
+			"not_before":   fmt.Sprint(expiresOn - 60),
+			"resource":     r.PostForm.Get("resource"),
+			"token_type":   "Bearer",
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestGetBearerTokenAuthorizer_WorkloadIdentity(t *testing.T) {
+	var assertions []string
+	server := newFakeTokenEndpoint(t, &assertions)
+	env := azure.PublicCloud
+	env.ActiveDirectoryEndpoint = server.URL + "/"
+
+	tokenFile := filepath.Join(t.TempDir(), "azure-identity-token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("assertion-1\n"), 0600))
+
+	authorizer, err := GetBearerTokenAuthorizer(ServicePrincipalTokenParameters{
+		AzureEnvironment:   env,
+		TenantID:           "tenant",
+		ClientID:           "00000000-0000-0000-0000-000000000001",
+		FederatedTokenFile: tokenFile,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer arm-token-1", authorize(t, authorizer))
+
+	// The platform rotates the assertion, the next refresh must use it
+	require.NoError(t, os.WriteFile(tokenFile, []byte("assertion-2\n"), 0600))
+	assert.Equal(t, "Bearer arm-token-2", authorize(t, authorizer))
+
+	assert.Equal(t, []string{"assertion-1", "assertion-2"}, assertions)
+}
+
+func TestGetBearerTokenAuthorizer_WorkloadIdentityRequiresClient(t *testing.T) {
+	_, err := GetBearerTokenAuthorizer(ServicePrincipalTokenParameters{
+		AzureEnvironment:   azure.PublicCloud,
+		FederatedTokenFile: "/var/run/secrets/azure/tokens/azure-identity-token",
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "a client ID and a tenant ID are required")
+}
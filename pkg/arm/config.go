@@ -1,27 +1,87 @@
 package arm
 
 import (
+	"strings"
+	"time"
+
 	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/kelseyhightower/envconfig"
+	"github.com/pkg/errors"
 )
 
 const envconfigPrefix = "AZURE"
 
+// What to do when an access token that can't be refreshed expires before the
+// polling timeout of a deployment
+const (
+	accessTokenExpiryCheckFail = "fail"
+	accessTokenExpiryCheckWarn = "warn"
+)
+
 // Config represents details necessary for the broker to interact with
 // an Azure subscription
 type Config struct {
 	Environment                        azure.Environment
-	SubscriptionID                     string `envconfig:"SUBSCRIPTION_ID" required:"true"`
+	SubscriptionID                     string `envconfig:"SUBSCRIPTION_ID" required:"false"`
 	TenantID                           string `envconfig:"TENANT_ID" required:"false"`
 	ClientID                           string `envconfig:"CLIENT_ID" required:"false"`
 	ClientSecret                       string `envconfig:"CLIENT_SECRET" required:"false"`
 	AccessToken                        string `envconfig:"ACCESS_TOKEN" required:"false"`
-	Microsoft_StatusDBConnectionString string `envconfig:"AZURE_STATUSDB_CONNECTION_STRING" required:"false"`
+	UseManagedIdentity                 bool   `envconfig:"USE_MANAGED_IDENTITY" default:"false"`
+	ManagedIdentityResourceID          string `envconfig:"MANAGED_IDENTITY_RESOURCE_ID" required:"false"`
+	ManagedIdentityEndpoint            string `envconfig:"MANAGED_IDENTITY_ENDPOINT" required:"false"`
+	FederatedTokenFile                 string `envconfig:"FEDERATED_TOKEN_FILE" required:"false"`
+	ClientCertificatePath              string `envconfig:"CLIENT_CERTIFICATE_PATH" required:"false"`
+	ClientCertificate                  string `envconfig:"CLIENT_CERTIFICATE" required:"false"`
+	ClientCertificatePassword          string `envconfig:"CLIENT_CERTIFICATE_PASSWORD" required:"false"`
+	AccessTokenKeysURL                 string `envconfig:"ACCESS_TOKEN_KEYS_URL" required:"false"`
+	AccessTokenKeysFile                string `envconfig:"ACCESS_TOKEN_KEYS_FILE" required:"false"`
+	SkipAccessTokenVerification        bool   `envconfig:"SKIP_ACCESS_TOKEN_VERIFICATION" default:"false"`
+	AccessTokenFile                    string `envconfig:"ACCESS_TOKEN_FILE" required:"false"`
+	AccessTokenRefreshCommand          string `envconfig:"ACCESS_TOKEN_REFRESH_COMMAND" required:"false"`
+	AccessTokenExpiryCheck             string `envconfig:"ACCESS_TOKEN_EXPIRY_CHECK" default:"warn"`
+	Microsoft_StatusDBConnectionString string `envconfig:"STATUSDB_CONNECTION_STRING" required:"false"`
+	// CorrelationID is the correlation id of the steps that don't set one
+	// with the correlationId parameter or setting
+	CorrelationID string `envconfig:"CORRELATION_ID" required:"false"`
+	// StatusSink selects where step statuses are reported: mongo, file,
+	// webhook or none. It defaults to mongo when a connection string is set.
+	StatusSink           string            `envconfig:"STATUS_SINK" required:"false"`
+	StatusFile           string            `envconfig:"STATUS_FILE" required:"false"`
+	StatusWebhookURL     string            `envconfig:"STATUS_WEBHOOK_URL" required:"false"`
+	StatusWebhookHeaders map[string]string `envconfig:"STATUS_WEBHOOK_HEADERS" required:"false"`
+	// StatusSpoolFile keeps the statuses that couldn't be delivered until
+	// they are replayed
+	StatusSpoolFile string `envconfig:"STATUS_SPOOL_FILE" required:"false"`
+	// StatusHistoryTTL expires the statuses in the mongo history after the
+	// duration, e.g. 2160h. The history is kept forever by default.
+	StatusHistoryTTL time.Duration `envconfig:"STATUS_HISTORY_TTL" required:"false"`
+	// StatusEncryptionKey is the base64 AES key encrypting the sensitive
+	// fields of the statuses, identified by StatusEncryptionKeyID. The key
+	// file holds the keys of earlier IDs, so that they can be decrypted
+	// after the key is rotated.
+	StatusEncryptionKey     string `envconfig:"STATUS_ENCRYPTION_KEY" required:"false"`
+	StatusEncryptionKeyID   string `envconfig:"STATUS_ENCRYPTION_KEY_ID" required:"false"`
+	StatusEncryptionKeyFile string `envconfig:"STATUS_ENCRYPTION_KEY_FILE" required:"false"`
+	// InstallationLease locks the installation in the status database while
+	// a step deploys it, so that concurrent runs of the same installation
+	// fail. The lease expires after InstallationLeaseTTL, 2m by default,
+	// unless the run renews it.
+	InstallationLease    bool          `envconfig:"INSTALLATION_LEASE" default:"false"`
+	InstallationLeaseTTL time.Duration `envconfig:"INSTALLATION_LEASE_TTL" required:"false"`
+	// APIVersionProfile pins the api-version of the resource management API,
+	// e.g. 2020-09-01-hybrid for Azure Stack Hub
+	APIVersionProfile string `envconfig:"API_VERSION_PROFILE" required:"false"`
 }
 
 type tempConfig struct {
 	Config
 	EnvironmentStr string `envconfig:"ENVIRONMENT" default:"AzurePublicCloud"`
+	// EnvironmentFilePath is a JSON file with the endpoints of a custom cloud
+	EnvironmentFilePath string `envconfig:"ENVIRONMENT_FILEPATH" required:"false"`
+	// MetadataEndpoint is the resource manager endpoint of a custom cloud,
+	// such as Azure Stack Hub, that publishes the other endpoints
+	MetadataEndpoint string `envconfig:"METADATA_ENDPOINT" required:"false"`
 }
 
 // NewConfigWithDefaults returns a Config object with default values already
@@ -32,15 +92,127 @@ func NewConfigWithDefaults() Config {
 }
 
 // GetConfigFromEnvironment returns Azure-related configuration derived from
-// environment variables
+// environment variables, the credentials file and the Azure SDK auth file
 func GetConfigFromEnvironment() (Config, error) {
+	c, sources, err := getConfigFromEnvironment(envconfigPrefix)
+	if err != nil {
+		return c.Config, err
+	}
+	if c.SubscriptionID == "" {
+		return c.Config, sources.missing("SUBSCRIPTION_ID", "the subscription ID")
+	}
+	return c.Config, nil
+}
+
+// GetCredentialConfigFromEnvironment returns the configuration of a named
+// credential, derived from the AZURE_<ALIAS>_* environment variables, e.g.
+// AZURE_HUB_CLIENT_ID for the alias hub. Bundles set them from credential
+// sets. The alias must set its credential. The subscription, the cloud and
+// the API version profile default to those of defaultConfig when the alias
+// doesn't set them.
+func GetCredentialConfigFromEnvironment(alias string, defaultConfig Config) (Config, error) {
+	prefix := getCredentialPrefix(alias)
+	c, sources, err := getConfigFromEnvironment(prefix)
+	if err != nil {
+		return c.Config, errors.Wrapf(err, "couldn't load credential %s", alias)
+	}
+	if !c.setsCredential() {
+		var keys []string
+		for _, key := range credentialKeys {
+			keys = append(keys, sources.envKey(key))
+		}
+		return c.Config, errors.Errorf(
+			"couldn't load credential %s: it sets no credential, set one of %s",
+			alias,
+			strings.Join(keys, ", "),
+		)
+	}
+	if c.SubscriptionID == "" {
+		c.SubscriptionID = defaultConfig.SubscriptionID
+	}
+	if !c.setsEnvironment(sources) {
+		c.Environment = defaultConfig.Environment
+	}
+	if c.APIVersionProfile == "" {
+		c.APIVersionProfile = defaultConfig.APIVersionProfile
+	}
+	return c.Config, nil
+}
+
+// credentialKeys are the keys of the credentials the configuration can
+// authenticate with
+var credentialKeys = []string{
+	"CLIENT_SECRET",
+	"CLIENT_CERTIFICATE",
+	"CLIENT_CERTIFICATE_PATH",
+	"FEDERATED_TOKEN_FILE",
+	"USE_MANAGED_IDENTITY",
+	"ACCESS_TOKEN",
+	"ACCESS_TOKEN_FILE",
+	"ACCESS_TOKEN_REFRESH_COMMAND",
+}
+
+// setsCredential reports whether the configuration sets a credential to
+// authenticate with
+func (c Config) setsCredential() bool {
+	return c.ClientSecret != "" ||
+		c.ClientCertificate != "" ||
+		c.ClientCertificatePath != "" ||
+		c.FederatedTokenFile != "" ||
+		c.UseManagedIdentity ||
+		c.AccessToken != "" ||
+		c.AccessTokenFile != "" ||
+		c.AccessTokenRefreshCommand != ""
+}
+
+// getCredentialPrefix returns the prefix of the environment variables of a
+// credential alias
+func getCredentialPrefix(alias string) string {
+	return envconfigPrefix + "_" + strings.ToUpper(strings.ReplaceAll(alias, "-", "_"))
+}
+
+// getConfigFromEnvironment reads the configuration of the prefix from the
+// environment variables, falling back to the files they select
+func getConfigFromEnvironment(prefix string) (tempConfig, configSources, error) {
 	c := tempConfig{
 		Config: NewConfigWithDefaults(),
 	}
-	err := envconfig.Process(envconfigPrefix, &c)
+	err := envconfig.Process(prefix, &c)
 	if err != nil {
-		return c.Config, err
+		return c, configSources{}, err
+	}
+	sources, err := loadConfigSources(prefix)
+	if err != nil {
+		return c, sources, err
+	}
+	if err = sources.apply(&c); err != nil {
+		return c, sources, err
+	}
+	if err = sources.validate(c.Config); err != nil {
+		return c, sources, err
+	}
+	c.Environment, err = c.getEnvironment()
+	return c, sources, err
+}
+
+// setsEnvironment reports whether the cloud is selected by a variable or a
+// file of the sources
+func (c tempConfig) setsEnvironment(sources configSources) bool {
+	return sources.origin("ENVIRONMENT") != "" || c.EnvironmentFilePath != "" || c.MetadataEndpoint != ""
+}
+
+// getEnvironment loads the endpoints of a custom cloud from the environment
+// file or from the metadata endpoint, and otherwise resolves a built-in cloud
+// by name
+func (c tempConfig) getEnvironment() (azure.Environment, error) {
+	switch {
+	case c.EnvironmentFilePath != "":
+		env, err := azure.EnvironmentFromFile(c.EnvironmentFilePath)
+		return env, errors.Wrapf(err, "couldn't load the Azure environment from %s", c.EnvironmentFilePath)
+	case c.MetadataEndpoint != "":
+		env, err := azure.EnvironmentFromURL(c.MetadataEndpoint)
+		return env, errors.Wrapf(err, "couldn't load the Azure environment from %s", c.MetadataEndpoint)
+	default:
+		return azure.EnvironmentFromName(c.EnvironmentStr)
 	}
-	c.Environment, err = azure.EnvironmentFromName(c.EnvironmentStr)
-	return c.Config, err
 }
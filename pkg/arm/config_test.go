@@ -0,0 +1,258 @@
+package arm
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetEnvironment_Name(t *testing.T) {
+	c := tempConfig{EnvironmentStr: "AzureChinaCloud"}
+	env, err := c.getEnvironment()
+	require.NoError(t, err)
+	assert.Equal(t, azure.ChinaCloud, env)
+}
+
+func TestGetEnvironment_File(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), "azurestack.json")
+	require.NoError(t, os.WriteFile(envFile, []byte(`{
+		"name": "AzureStackCloud",
+		"resourceManagerEndpoint": "https://management.local.azurestack.external/",
+		"activeDirectoryEndpoint": "https://login.microsoftonline.com/",
+		"tokenAudience": "https://management.azurestack.onmicrosoft.com/00000000-0000-0000-0000-000000000001"
+	}`), 0600))
+
+	c := tempConfig{EnvironmentStr: "AzurePublicCloud", EnvironmentFilePath: envFile}
+	env, err := c.getEnvironment()
+	require.NoError(t, err)
+	assert.Equal(t, "AzureStackCloud", env.Name)
+	assert.Equal(t, "https://management.local.azurestack.external/", env.ResourceManagerEndpoint)
+
+	c.EnvironmentFilePath = filepath.Join(t.TempDir(), "missing.json")
+	_, err = c.getEnvironment()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "couldn't load the Azure environment")
+}
+
+func TestGetEnvironment_MetadataEndpoint(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/metadata/endpoints", r.URL.Path)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"galleryEndpoint": "https://portal.local.azurestack.external:30015/",
+			"graphEndpoint":   "https://graph.windows.net/",
+			"authentication": map[string]interface{}{
+				"loginEndpoint": "https://login.microsoftonline.com/",
+				"audiences":     []string{"https://management.azurestack.onmicrosoft.com/00000000-0000-0000-0000-000000000001"},
+			},
+		})
+	}))
+	defer server.Close()
+
+	c := tempConfig{EnvironmentStr: "AzurePublicCloud", MetadataEndpoint: server.URL + "/"}
+	env, err := c.getEnvironment()
+	require.NoError(t, err)
+	assert.Equal(t, server.URL+"/", env.ResourceManagerEndpoint)
+	assert.Equal(t, "https://login.microsoftonline.com/", env.ActiveDirectoryEndpoint)
+	assert.Equal(t, "https://management.azurestack.onmicrosoft.com/00000000-0000-0000-0000-000000000001", env.TokenAudience)
+}
+
+func TestGetCredentialConfigFromEnvironment(t *testing.T) {
+	defaultConfig := Config{
+		Environment:       azure.ChinaCloud,
+		SubscriptionID:    "00000000-0000-0000-0000-000000000001",
+		ClientID:          "default-client",
+		APIVersionProfile: "latest",
+	}
+	t.Setenv("AZURE_LANDING_ZONE_CLIENT_ID", "landing-zone-client")
+	t.Setenv("AZURE_LANDING_ZONE_CLIENT_SECRET", "landing-zone-secret")
+	t.Setenv("AZURE_LANDING_ZONE_TENANT_ID", "landing-zone-tenant")
+
+	cfg, err := GetCredentialConfigFromEnvironment("landing-zone", defaultConfig)
+	require.NoError(t, err)
+	assert.Equal(t, "landing-zone-client", cfg.ClientID)
+	assert.Equal(t, "landing-zone-secret", cfg.ClientSecret)
+	assert.Equal(t, "landing-zone-tenant", cfg.TenantID)
+	// The subscription and the cloud default to those of the default config
+	assert.Equal(t, defaultConfig.SubscriptionID, cfg.SubscriptionID)
+	assert.Equal(t, azure.ChinaCloud, cfg.Environment)
+	assert.Equal(t, "latest", cfg.APIVersionProfile)
+
+	t.Setenv("AZURE_LANDING_ZONE_SUBSCRIPTION_ID", "00000000-0000-0000-0000-000000000002")
+	t.Setenv("AZURE_LANDING_ZONE_ENVIRONMENT", "AzurePublicCloud")
+	cfg, err = GetCredentialConfigFromEnvironment("landing-zone", defaultConfig)
+	require.NoError(t, err)
+	assert.Equal(t, "00000000-0000-0000-0000-000000000002", cfg.SubscriptionID)
+	assert.Equal(t, azure.PublicCloud, cfg.Environment)
+}
+
+func TestGetCredentialConfigFromEnvironment_IgnoresUnprefixedVariables(t *testing.T) {
+	clearAzureEnv(t)
+	t.Setenv("CLIENT_ID", "unprefixed-client")
+	t.Setenv("CLIENT_SECRET", "unprefixed-secret")
+	t.Setenv("TENANT_ID", "unprefixed-tenant")
+	t.Setenv("ACCESS_TOKEN_EXPIRY_CHECK", "fail")
+
+	_, err := GetCredentialConfigFromEnvironment("hub", Config{})
+	assert.EqualError(t, err, "couldn't load credential hub: it sets no credential, set one of "+
+		"AZURE_HUB_CLIENT_SECRET, AZURE_HUB_CLIENT_CERTIFICATE, AZURE_HUB_CLIENT_CERTIFICATE_PATH, "+
+		"AZURE_HUB_FEDERATED_TOKEN_FILE, AZURE_HUB_USE_MANAGED_IDENTITY, AZURE_HUB_ACCESS_TOKEN, "+
+		"AZURE_HUB_ACCESS_TOKEN_FILE, AZURE_HUB_ACCESS_TOKEN_REFRESH_COMMAND")
+
+	t.Setenv("AZURE_HUB_CLIENT_SECRET", "hub-secret")
+	t.Setenv("AZURE_HUB_TENANT_ID", "hub-tenant")
+	_, err = GetCredentialConfigFromEnvironment("hub", Config{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "the client ID is missing, set it in the environment variable AZURE_HUB_CLIENT_ID")
+
+	t.Setenv("AZURE_HUB_CLIENT_ID", "hub-client")
+	cfg, err := GetCredentialConfigFromEnvironment("hub", Config{})
+	require.NoError(t, err)
+	assert.Equal(t, "hub-client", cfg.ClientID)
+	assert.Equal(t, "warn", cfg.AccessTokenExpiryCheck, "the default applies rather than the unprefixed variable")
+
+	// The default configuration still reads the unprefixed variables
+	t.Setenv("AZURE_SUBSCRIPTION_ID", "sub")
+	cfg, err = GetConfigFromEnvironment()
+	require.NoError(t, err)
+	assert.Equal(t, "unprefixed-client", cfg.ClientID)
+}
+
+func TestGetConfigFromEnvironment_StatusDBConnectionString(t *testing.T) {
+	clearAzureEnv(t)
+	t.Setenv("AZURE_SUBSCRIPTION_ID", "sub")
+	t.Setenv("AZURE_STATUSDB_CONNECTION_STRING", "mongodb://localhost:27017")
+
+	cfg, err := GetConfigFromEnvironment()
+	require.NoError(t, err)
+	assert.Equal(t, "mongodb://localhost:27017", cfg.Microsoft_StatusDBConnectionString)
+}
+
+// clearAzureEnv unsets the AZURE_* variables for the duration of the test
+func clearAzureEnv(t *testing.T) {
+	for _, kv := range os.Environ() {
+		key := strings.SplitN(kv, "=", 2)[0]
+		if strings.HasPrefix(key, envconfigPrefix+"_") {
+			t.Setenv(key, "")
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func writeConfigFile(t *testing.T, name string, contents []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, contents, 0600))
+	return path
+}
+
+const testSDKAuthFile = `{
+  "clientId": "auth-file-client",
+  "clientSecret": "auth-file-secret",
+  "subscriptionId": "00000000-0000-0000-0000-000000000001",
+  "tenantId": "auth-file-tenant",
+  "activeDirectoryEndpointUrl": "https://login.chinacloudapi.cn",
+  "resourceManagerEndpointUrl": "https://management.chinacloudapi.cn/"
+}`
+
+func TestGetConfigFromEnvironment_AuthFile(t *testing.T) {
+	clearAzureEnv(t)
+	t.Setenv("AZURE_AUTH_LOCATION", writeConfigFile(t, "auth.json", []byte(testSDKAuthFile)))
+	t.Setenv("AZURE_CLIENT_SECRET", "env-secret")
+
+	cfg, err := GetConfigFromEnvironment()
+	require.NoError(t, err)
+	assert.Equal(t, "auth-file-client", cfg.ClientID)
+	assert.Equal(t, "env-secret", cfg.ClientSecret, "the environment variables take precedence")
+	assert.Equal(t, "00000000-0000-0000-0000-000000000001", cfg.SubscriptionID)
+	assert.Equal(t, "auth-file-tenant", cfg.TenantID)
+	assert.Equal(t, azure.ChinaCloud, cfg.Environment)
+}
+
+func TestGetConfigFromEnvironment_AuthFileUTF16(t *testing.T) {
+	clearAzureEnv(t)
+	// The Azure CLI writes the file as UTF-16 on Windows
+	data := []byte{0xFF, 0xFE}
+	for _, unit := range utf16.Encode([]rune(testSDKAuthFile)) {
+		data = append(data, byte(unit), byte(unit>>8))
+	}
+	t.Setenv("AZURE_AUTH_LOCATION", writeConfigFile(t, "auth.json", data))
+
+	cfg, err := GetConfigFromEnvironment()
+	require.NoError(t, err)
+	assert.Equal(t, "auth-file-client", cfg.ClientID)
+}
+
+func TestGetConfigFromEnvironment_CredentialsFile(t *testing.T) {
+	clearAzureEnv(t)
+	t.Setenv("AZURE_AUTH_LOCATION", writeConfigFile(t, "auth.json", []byte(testSDKAuthFile)))
+	t.Setenv("AZURE_CREDENTIALS_FILE", writeConfigFile(t, "credentials.yaml", []byte(`
+AZURE_CLIENT_ID: credentials-file-client
+subscriptionId: 00000000-0000-0000-0000-000000000002
+use_managed_identity: true
+api_version_profile: 2020-09-01-hybrid
+status_history_ttl: 2160h
+`)))
+
+	cfg, err := GetConfigFromEnvironment()
+	require.NoError(t, err)
+	assert.Equal(t, "credentials-file-client", cfg.ClientID, "the credentials file takes precedence over the auth file")
+	assert.Equal(t, "00000000-0000-0000-0000-000000000002", cfg.SubscriptionID)
+	assert.Equal(t, "auth-file-secret", cfg.ClientSecret)
+	assert.True(t, cfg.UseManagedIdentity)
+	assert.Equal(t, "2020-09-01-hybrid", cfg.APIVersionProfile)
+	assert.Equal(t, 90*24*time.Hour, cfg.StatusHistoryTTL)
+	assert.Equal(t, "warn", cfg.AccessTokenExpiryCheck, "the defaults still apply")
+}
+
+func TestGetConfigFromEnvironment_Errors(t *testing.T) {
+	testcases := []struct {
+		name        string
+		credentials string
+		wantErr     string
+	}{
+		{"missing subscription", `clientId: client`,
+			"the subscription ID is missing, set it in the environment variable AZURE_SUBSCRIPTION_ID or SUBSCRIPTION_ID in the credentials file"},
+		{"missing tenant", "subscriptionId: sub\nclientId: client\nclientSecret: secret",
+			"the tenant ID is missing, set it in the environment variable AZURE_TENANT_ID or TENANT_ID in the credentials file"},
+		{"invalid value", "subscriptionId: sub\nuseManagedIdentity: maybe",
+			"invalid USE_MANAGED_IDENTITY in the credentials file"},
+		{"not an object", `- clientId`, "the file must be a JSON or YAML object"},
+		{"invalid expiry check", "subscriptionId: sub\naccessTokenExpiryCheck: ignore",
+			`invalid ACCESS_TOKEN_EXPIRY_CHECK "ignore" in the credentials file`},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			clearAzureEnv(t)
+			t.Setenv("AZURE_CREDENTIALS_FILE", writeConfigFile(t, "credentials.yaml", []byte(tc.credentials)))
+
+			_, err := GetConfigFromEnvironment()
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.wantErr)
+		})
+	}
+}
+
+func TestGetConfigFromEnvironment_AccessTokenExpiryCheck(t *testing.T) {
+	// An invalid value is reported even when no access token is used
+	clearAzureEnv(t)
+	t.Setenv("AZURE_SUBSCRIPTION_ID", "sub")
+	t.Setenv("AZURE_ACCESS_TOKEN_EXPIRY_CHECK", "fial")
+
+	_, err := GetConfigFromEnvironment()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid ACCESS_TOKEN_EXPIRY_CHECK "fial" in the environment variable AZURE_ACCESS_TOKEN_EXPIRY_CHECK`)
+
+	t.Setenv("AZURE_ACCESS_TOKEN_EXPIRY_CHECK", "fail")
+	cfg, err := GetConfigFromEnvironment()
+	require.NoError(t, err)
+	assert.Equal(t, "fail", cfg.AccessTokenExpiryCheck)
+}
@@ -0,0 +1,354 @@
+package arm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf16"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Configuration can also be read from files, so that it can be stored as a
+// single Porter credential. The precedence is:
+//  1. the AZURE_* environment variables
+//  2. the credentials file in AZURE_CREDENTIALS_FILE
+//  3. the Azure SDK auth file in AZURE_AUTH_LOCATION, as written by
+//     az ad sp create-for-rbac --sdk-auth
+//  4. the defaults
+const (
+	envCredentialsFile = "CREDENTIALS_FILE"
+	envAuthLocation    = "AUTH_LOCATION"
+)
+
+// sdkAuthFile is the Azure SDK auth file
+type sdkAuthFile struct {
+	ClientID                   string `json:"clientId"`
+	ClientSecret               string `json:"clientSecret"`
+	SubscriptionID             string `json:"subscriptionId"`
+	TenantID                   string `json:"tenantId"`
+	ResourceManagerEndpointURL string `json:"resourceManagerEndpointUrl"`
+}
+
+// configSource is a file the configuration is read from
+type configSource struct {
+	// description says where the values come from in errors
+	description string
+	values      map[string]string
+}
+
+// configSources are the files the configuration of a prefix is read from, in
+// order of precedence
+type configSources struct {
+	prefix string
+	// unprefixed reads the variables without the prefix, e.g. CLIENT_ID,
+	// when the prefixed one isn't set, as envconfig does. Only the default
+	// configuration does, so that a credential alias doesn't pick up the
+	// values of another configuration.
+	unprefixed bool
+	files      []configSource
+	// origins records where each set value came from
+	origins map[string]string
+}
+
+// loadConfigSources reads the credentials and auth files selected by the
+// environment variables with the prefix
+func loadConfigSources(prefix string) (configSources, error) {
+	sources := configSources{
+		prefix:     prefix,
+		unprefixed: prefix == envconfigPrefix,
+		origins:    map[string]string{},
+	}
+
+	if path := os.Getenv(prefix + "_" + envCredentialsFile); path != "" {
+		values, err := readCredentialsFile(path)
+		if err != nil {
+			return sources, errors.Wrapf(err, "couldn't read the credentials file %s set in %s_%s", path, prefix, envCredentialsFile)
+		}
+		sources.files = append(sources.files, configSource{
+			description: fmt.Sprintf("the credentials file %s", path),
+			values:      values,
+		})
+	}
+	if path := os.Getenv(prefix + "_" + envAuthLocation); path != "" {
+		values, err := readSDKAuthFile(path)
+		if err != nil {
+			return sources, errors.Wrapf(err, "couldn't read the auth file %s set in %s_%s", path, prefix, envAuthLocation)
+		}
+		sources.files = append(sources.files, configSource{
+			description: fmt.Sprintf("the auth file %s", path),
+			values:      values,
+		})
+	}
+	return sources, nil
+}
+
+// readCredentialsFile reads a flat JSON or YAML file of configuration values.
+// The keys are the names of the environment variables, with or without the
+// AZURE_ prefix, in any case and with or without underscores, so
+// AZURE_CLIENT_ID, CLIENT_ID and clientId are the same key.
+func readCredentialsFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// YAML is a superset of JSON, so this reads both
+	var contents map[string]interface{}
+	if err := yaml.Unmarshal(data, &contents); err != nil {
+		return nil, errors.Wrap(err, "the file must be a JSON or YAML object")
+	}
+	values := map[string]string{}
+	for key, value := range contents {
+		switch value.(type) {
+		case string, bool, int, float64:
+			values[normalizeConfigKey(key)] = fmt.Sprint(value)
+		case nil:
+		default:
+			return nil, errors.Errorf("the value of %s must be a string", key)
+		}
+	}
+	return values, nil
+}
+
+// readSDKAuthFile reads the Azure SDK auth file, which the Azure CLI writes
+// as UTF-16 on Windows
+func readSDKAuthFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err = decodeUTF16(data)
+	if err != nil {
+		return nil, err
+	}
+	var authFile sdkAuthFile
+	if err := json.Unmarshal(data, &authFile); err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{
+		normalizeConfigKey("CLIENT_ID"):       authFile.ClientID,
+		normalizeConfigKey("CLIENT_SECRET"):   authFile.ClientSecret,
+		normalizeConfigKey("SUBSCRIPTION_ID"): authFile.SubscriptionID,
+		normalizeConfigKey("TENANT_ID"):       authFile.TenantID,
+	}
+	if endpoint := authFile.ResourceManagerEndpointURL; endpoint != "" {
+		// Select the built-in cloud with the endpoint, otherwise load the
+		// endpoints of the custom cloud from its metadata
+		values[normalizeConfigKey("METADATA_ENDPOINT")] = endpoint
+		for _, env := range []azure.Environment{azure.PublicCloud, azure.USGovernmentCloud, azure.ChinaCloud, azure.GermanCloud} {
+			if strings.EqualFold(strings.TrimSuffix(env.ResourceManagerEndpoint, "/"), strings.TrimSuffix(endpoint, "/")) {
+				delete(values, normalizeConfigKey("METADATA_ENDPOINT"))
+				values[normalizeConfigKey("ENVIRONMENT")] = env.Name
+			}
+		}
+	}
+	for key, value := range values {
+		if value == "" {
+			delete(values, key)
+		}
+	}
+	return values, nil
+}
+
+// decodeUTF16 converts UTF-16 data with a byte order mark to UTF-8
+func decodeUTF16(data []byte) ([]byte, error) {
+	var order binary.ByteOrder
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		order = binary.LittleEndian
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		order = binary.BigEndian
+	default:
+		return bytes.TrimPrefix(data, []byte{0xEF, 0xBB, 0xBF}), nil
+	}
+	data = data[2:]
+	if len(data)%2 != 0 {
+		return nil, errors.New("invalid UTF-16 data")
+	}
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		units[i] = order.Uint16(data[2*i:])
+	}
+	return []byte(string(utf16.Decode(units))), nil
+}
+
+// normalizeConfigKey returns the key without the AZURE prefix, upper case
+// and without separators
+func normalizeConfigKey(key string) string {
+	normalized := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToUpper(r)
+		}
+		return -1
+	}, key)
+	return strings.TrimPrefix(normalized, envconfigPrefix)
+}
+
+// apply sets the fields of the config that aren't set by an environment
+// variable from the files, and records where every set field came from
+func (s configSources) apply(c *tempConfig) error {
+	return s.applyToStruct(reflect.ValueOf(c).Elem())
+}
+
+func (s configSources) applyToStruct(v reflect.Value) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		fieldType := v.Type().Field(i)
+		if fieldType.Anonymous && field.Kind() == reflect.Struct {
+			if err := s.applyToStruct(field); err != nil {
+				return err
+			}
+			continue
+		}
+		key := fieldType.Tag.Get("envconfig")
+		if key == "" {
+			continue
+		}
+
+		envKey := s.envKey(key)
+		if _, ok := os.LookupEnv(envKey); ok {
+			s.origins[key] = fmt.Sprintf("the environment variable %s", envKey)
+			continue
+		}
+		if _, ok := os.LookupEnv(key); ok {
+			if s.unprefixed {
+				s.origins[key] = fmt.Sprintf("the environment variable %s", key)
+				continue
+			}
+			// envconfig read the variable without the prefix, which isn't
+			// one of the configuration
+			if err := resetConfigField(field, fieldType.Tag.Get("default")); err != nil {
+				return errors.Wrapf(err, "invalid default of %s", key)
+			}
+		}
+		for _, file := range s.files {
+			value, ok := file.values[normalizeConfigKey(key)]
+			if !ok {
+				continue
+			}
+			if err := setConfigField(field, value); err != nil {
+				return errors.Wrapf(err, "invalid %s in %s", key, file.description)
+			}
+			s.origins[key] = file.description
+			break
+		}
+	}
+	return nil
+}
+
+// envKey returns the environment variable of the key
+func (s configSources) envKey(key string) string {
+	return s.prefix + "_" + key
+}
+
+// resetConfigField sets the field back to its default value
+func resetConfigField(field reflect.Value, defaultValue string) error {
+	field.Set(reflect.Zero(field.Type()))
+	if defaultValue == "" {
+		return nil
+	}
+	return setConfigField(field, defaultValue)
+}
+
+func setConfigField(field reflect.Value, value string) error {
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Map:
+		// Maps use the key1:value1,key2:value2 format of envconfig
+		values := map[string]string{}
+		for _, pair := range strings.Split(value, ",") {
+			kv := strings.SplitN(pair, ":", 2)
+			if len(kv) != 2 {
+				return errors.Errorf("invalid map item %q", pair)
+			}
+			values[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+		field.Set(reflect.ValueOf(values))
+	default:
+		return errors.Errorf("unsupported type %s", field.Kind())
+	}
+	return nil
+}
+
+// origin returns where the value of the key came from
+func (s configSources) origin(key string) string {
+	return s.origins[key]
+}
+
+// missing returns an error for a required value, listing every source it
+// was expected from
+func (s configSources) missing(key string, name string) error {
+	expected := []string{fmt.Sprintf("the environment variable %s", s.envKey(key))}
+	for _, file := range s.files {
+		expected = append(expected, fmt.Sprintf("%s in %s", key, file.description))
+	}
+	return errors.Errorf("%s is missing, set it in %s", name, strings.Join(expected, " or "))
+}
+
+// validate checks that the values needed together are set, naming the
+// sources they were expected from
+func (s configSources) validate(c Config) error {
+	if c.ClientSecret != "" || c.ClientCertificate != "" || c.ClientCertificatePath != "" {
+		credential := "the client secret"
+		origin := s.origin("CLIENT_SECRET")
+		if c.ClientSecret == "" {
+			credential = "the client certificate"
+			origin = s.origin("CLIENT_CERTIFICATE")
+			if origin == "" {
+				origin = s.origin("CLIENT_CERTIFICATE_PATH")
+			}
+		}
+		required := []struct{ key, name, value string }{
+			{"CLIENT_ID", "the client ID", c.ClientID},
+			{"TENANT_ID", "the tenant ID", c.TenantID},
+		}
+		for _, r := range required {
+			if r.value == "" {
+				return errors.Wrapf(s.missing(r.key, r.name), "%s is set in %s", credential, origin)
+			}
+		}
+	}
+	switch c.AccessTokenExpiryCheck {
+	case accessTokenExpiryCheckFail, accessTokenExpiryCheckWarn, "":
+	default:
+		// Checked here, rather than when the token is found to expire, so that
+		// a typo doesn't go unnoticed
+		origin := s.origin("ACCESS_TOKEN_EXPIRY_CHECK")
+		if origin == "" {
+			origin = fmt.Sprintf("the environment variable %s", s.envKey("ACCESS_TOKEN_EXPIRY_CHECK"))
+		}
+		return errors.Errorf(
+			"invalid ACCESS_TOKEN_EXPIRY_CHECK %q in %s, expected %s or %s",
+			c.AccessTokenExpiryCheck,
+			origin,
+			accessTokenExpiryCheckFail,
+			accessTokenExpiryCheckWarn,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// FileStatusSink appends every status as a line of JSON to a file, so that
+// the history of a bundle can be kept without a database
+type FileStatusSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileStatusSink opens the file for appending, creating it when needed.
+// Statuses hold the outputs of deployments, such as connection strings, so
+// only the owner can read a created file.
+func NewFileStatusSink(path string) (*FileStatusSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening status file: %s", err)
+	}
+	return &FileStatusSink{file: file}, nil
+}
+
+// RecordStatus appends the status as a single line
+func (sink *FileStatusSink) RecordStatus(status Status) error {
+	line, err := json.Marshal(status)
+	if err != nil {
+		return fmt.Errorf("error encoding status: %s", err)
+	}
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	// A single write keeps the line whole when several processes append
+	if _, err = sink.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("error writing status: %s", err)
+	}
+	return nil
+}
+
+// Close closes the file
+func (sink *FileStatusSink) Close() error {
+	return sink.file.Close()
+}
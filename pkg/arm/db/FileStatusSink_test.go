@@ -0,0 +1,48 @@
+package db
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStatusSink_RecordStatus(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "status.jsonl")
+
+	// Statuses are appended across runs of the mixin
+	for _, executionStatus := range []string{"Failed", "Succeeded"} {
+		sink, err := NewFileStatusSink(path)
+		require.NoError(t, err)
+		require.NoError(t, sink.RecordStatus(Status{
+			SubscriptionId:    "00000000-0000-0000-0000-000000000001",
+			ResourceGroupName: "test-rg",
+			ExecutionStatus:   executionStatus,
+			StatusReportedOn:  time.Now(),
+		}))
+		require.NoError(t, sink.Close())
+	}
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "statuses should only be readable by the owner")
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	var statuses []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var status map[string]interface{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &status))
+		assert.Equal(t, "test-rg", status["resourceGroupName"])
+		assert.NotContains(t, status, "id", "an unset id should be left out")
+		statuses = append(statuses, status["executionStatus"].(string))
+	}
+	assert.Equal(t, []string{"Failed", "Succeeded"}, statuses)
+}
@@ -0,0 +1,63 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrLeaseLost is returned when a lease is renewed or released after it
+// expired and another run acquired it
+var ErrLeaseLost = errors.New("the lease expired and was acquired by another run")
+
+// InstallationLease is held by the run deploying an installation, so that a
+// concurrent run of the same installation fails instead of racing it. The
+// holder renews the lease before it expires, and a lease that isn't renewed
+// can be acquired by another run.
+type InstallationLease struct {
+	// Key identifies the installation
+	Key string `bson:"_id" json:"key"`
+	// Holder identifies the process holding the lease
+	Holder        string    `bson:"holder" json:"holder"`
+	CorrelationId string    `bson:"correlationId" json:"correlationId"`
+	Action        string    `bson:"action,omitempty" json:"action,omitempty"`
+	AcquiredOn    time.Time `bson:"acquiredOn" json:"acquiredOn"`
+	ExpiresOn     time.Time `bson:"expiresOn" json:"expiresOn"`
+}
+
+// LeaseHeldError is returned when a lease is held by another run
+type LeaseHeldError struct {
+	Lease InstallationLease
+}
+
+func (e LeaseHeldError) Error() string {
+	action := e.Lease.Action
+	if action == "" {
+		action = "a step"
+	}
+	return fmt.Sprintf(
+		"%s is locked by %s, running %s with the correlation id %s since %s. The lock expires at %s unless it is renewed",
+		e.Lease.Key,
+		e.Lease.Holder,
+		action,
+		e.Lease.CorrelationId,
+		e.Lease.AcquiredOn.UTC().Format(time.RFC3339),
+		e.Lease.ExpiresOn.UTC().Format(time.RFC3339),
+	)
+}
+
+// LeaseStore keeps the leases of the installations
+type LeaseStore interface {
+	// AcquireLease records the lease when its key isn't leased, the lease
+	// expired or it is held by the same holder, and otherwise returns a
+	// LeaseHeldError naming the current holder
+	AcquireLease(lease InstallationLease) error
+	// RenewLease extends the lease held by the holder until expiresOn, or
+	// returns ErrLeaseLost
+	RenewLease(key string, holder string, expiresOn time.Time) error
+	// ReleaseLease removes the lease held by the holder, or returns
+	// ErrLeaseLost
+	ReleaseLease(key string, holder string) error
+	// Close releases the connections held by the store
+	Close() error
+}
@@ -0,0 +1,67 @@
+package db
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryLeaseStore keeps the leases in memory, for unit tests
+type MemoryLeaseStore struct {
+	mu     sync.Mutex
+	leases map[string]InstallationLease
+	now    func() time.Time
+}
+
+// NewMemoryLeaseStore creates a new instance of MemoryLeaseStore
+func NewMemoryLeaseStore() *MemoryLeaseStore {
+	return &MemoryLeaseStore{leases: map[string]InstallationLease{}, now: time.Now}
+}
+
+// AcquireLease records the lease unless another holder's lease is current
+func (store *MemoryLeaseStore) AcquireLease(lease InstallationLease) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if current, ok := store.leases[lease.Key]; ok && current.Holder != lease.Holder && current.ExpiresOn.After(store.now()) {
+		return LeaseHeldError{Lease: current}
+	}
+	store.leases[lease.Key] = lease
+	return nil
+}
+
+// RenewLease extends the lease of the holder
+func (store *MemoryLeaseStore) RenewLease(key string, holder string, expiresOn time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	lease, ok := store.leases[key]
+	if !ok || lease.Holder != holder {
+		return ErrLeaseLost
+	}
+	lease.ExpiresOn = expiresOn
+	store.leases[key] = lease
+	return nil
+}
+
+// ReleaseLease removes the lease of the holder
+func (store *MemoryLeaseStore) ReleaseLease(key string, holder string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	lease, ok := store.leases[key]
+	if !ok || lease.Holder != holder {
+		return ErrLeaseLost
+	}
+	delete(store.leases, key)
+	return nil
+}
+
+// Close does nothing
+func (store *MemoryLeaseStore) Close() error {
+	return nil
+}
+
+// Lease returns the lease of the key
+func (store *MemoryLeaseStore) Lease(key string) (InstallationLease, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	lease, ok := store.leases[key]
+	return lease, ok
+}
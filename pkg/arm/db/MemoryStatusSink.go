@@ -0,0 +1,45 @@
+package db
+
+import "sync"
+
+// MemoryStatusSink keeps the recorded statuses in memory, for unit tests
+type MemoryStatusSink struct {
+	mu       sync.Mutex
+	statuses []Status
+	closed   bool
+}
+
+// NewMemoryStatusSink creates a new instance of MemoryStatusSink
+func NewMemoryStatusSink() *MemoryStatusSink {
+	return &MemoryStatusSink{}
+}
+
+// RecordStatus appends the status
+func (sink *MemoryStatusSink) RecordStatus(status Status) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	sink.statuses = append(sink.statuses, status)
+	return nil
+}
+
+// Close marks the sink as closed
+func (sink *MemoryStatusSink) Close() error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	sink.closed = true
+	return nil
+}
+
+// Statuses returns the recorded statuses, oldest first
+func (sink *MemoryStatusSink) Statuses() []Status {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	return append([]Status(nil), sink.statuses...)
+}
+
+// Closed reports whether the sink was closed
+func (sink *MemoryStatusSink) Closed() bool {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	return sink.closed
+}
@@ -0,0 +1,127 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoLeaseStore keeps the leases in a MongoDB collection named after the
+// status collection with a _leases suffix. The expiry is compared with the
+// clock of the mixin, so the TTL of the leases must be much longer than the
+// clock skew between the machines running Porter.
+type MongoLeaseStore struct {
+	clientHelper *MongoClientHelper
+	collection   *mongo.Collection
+	// indexed makes sure the expired leases are removed by a TTL index
+	indexed  sync.Once
+	indexErr error
+}
+
+// NewMongoLeaseStore connects to the MongoDB server and returns a store
+// keeping the leases next to the status collection
+func NewMongoLeaseStore(connectionString string, databaseName string, collectionName string) (*MongoLeaseStore, error) {
+	clientHelper, err := NewMongoClientHelper(connectionString)
+	if err != nil {
+		return nil, err
+	}
+	return &MongoLeaseStore{
+		clientHelper: clientHelper,
+		collection:   clientHelper.MongoClient.Database(databaseName).Collection(collectionName + "_leases"),
+	}, nil
+}
+
+// ensureIndex creates the index removing the expired leases, once per store
+func (store *MongoLeaseStore) ensureIndex(ctx context.Context) error {
+	store.indexed.Do(func() {
+		_, err := store.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: "expiresOn", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		})
+		if err != nil {
+			store.indexErr = fmt.Errorf("error creating lease index: %s", err)
+		}
+	})
+	return store.indexErr
+}
+
+// AcquireLease upserts the lease when it is free, expired or held by the
+// same holder. The upsert of a lease held by another run conflicts with its
+// _id, which is reported as a LeaseHeldError.
+func (store *MongoLeaseStore) AcquireLease(lease InstallationLease) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := store.ensureIndex(ctx); err != nil {
+		return err
+	}
+
+	filter := bson.M{
+		"_id": lease.Key,
+		"$or": bson.A{
+			bson.M{"expiresOn": bson.M{"$lte": time.Now()}},
+			bson.M{"holder": lease.Holder},
+		},
+	}
+	// Retry when the lease is released between the upsert and the read
+	for attempt := 0; ; attempt++ {
+		_, err := store.collection.ReplaceOne(ctx, filter, lease, options.Replace().SetUpsert(true))
+		if !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+
+		var current InstallationLease
+		err = store.collection.FindOne(ctx, bson.M{"_id": lease.Key}).Decode(&current)
+		if errors.Is(err, mongo.ErrNoDocuments) && attempt < 2 {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error reading the lease of %s: %s", lease.Key, err)
+		}
+		return LeaseHeldError{Lease: current}
+	}
+}
+
+// RenewLease extends the lease of the holder
+func (store *MongoLeaseStore) RenewLease(key string, holder string, expiresOn time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := store.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": key, "holder": holder},
+		bson.M{"$set": bson.M{"expiresOn": expiresOn}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// ReleaseLease removes the lease of the holder
+func (store *MongoLeaseStore) ReleaseLease(key string, holder string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := store.collection.DeleteOne(ctx, bson.M{"_id": key, "holder": holder})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// Close disconnects from the MongoDB server
+func (store *MongoLeaseStore) Close() error {
+	return store.clientHelper.DisconnectMongoClient()
+}
@@ -0,0 +1,311 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// StatusSchemaVersion is the version of the status documents written by the
+// mixin. Version 1 documents have no schemaVersion field and their field
+// names are the lowercased names of the Status fields.
+const StatusSchemaVersion = 2
+
+// historyTTLIndexName is the name of the index expiring the history
+const historyTTLIndexName = "statusReportedOn_ttl"
+
+// Codes of the MongoDB errors returned when an index exists with other
+// options, and when the index or its collection doesn't exist
+const (
+	mongoIndexOptionsConflict  = 85
+	mongoIndexKeySpecsConflict = 86
+	mongoNamespaceNotFound     = 26
+	mongoIndexNotFound         = 27
+)
+
+// collectionPreparation is the preparation of a status collection by the
+// process
+type collectionPreparation struct {
+	once sync.Once
+	err  error
+}
+
+// preparedCollections are the preparations of the status collections by
+// database and collection name. A process opens a repository for each
+// status it replays from the spool and for its step, and prepares each
+// collection once.
+var preparedCollections sync.Map
+
+// prepare upgrades the documents written by earlier versions and creates the
+// indexes of the collections, once per process. It is called before the
+// collections are first written, reads don't change the collections and
+// accept the documents of version 1 in the status collection.
+func (statusRepository *StatusRepository) prepare() error {
+	key := statusRepository.StatusCollection.Database().Name() + "/" + statusRepository.StatusCollection.Name()
+	value, _ := preparedCollections.LoadOrStore(key, &collectionPreparation{})
+	preparation := value.(*collectionPreparation)
+	preparation.once.Do(func() {
+		if _, err := statusRepository.UpgradeSchema(); err != nil {
+			preparation.err = fmt.Errorf("error upgrading status documents: %s", err)
+			return
+		}
+		if err := statusRepository.ensureIndexes(); err != nil {
+			preparation.err = fmt.Errorf("error creating status indexes: %s", err)
+		}
+	})
+	return preparation.err
+}
+
+// UpgradeSchema renames the fields of the documents written before schema
+// versions were recorded to the names of the current version, and returns
+// the number of documents upgraded. Only the status collection holds such
+// documents, the history was added with the schema version.
+func (statusRepository *StatusRepository) UpgradeSchema() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	filter := bson.M{"schemaVersion": bson.M{"$exists": false}}
+	update := bson.M{
+		"$rename": schemaV1FieldRenames(),
+		"$set":    bson.M{"schemaVersion": StatusSchemaVersion},
+	}
+	result, err := statusRepository.StatusCollection.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// schemaV1FieldRenames maps the field names of version 1 documents, the
+// lowercased names of the fields, to the current names
+func schemaV1FieldRenames() bson.M {
+	renames := bson.M{}
+	addFieldRenames(renames, "", reflect.TypeOf(Status{}))
+	addFieldRenames(renames, "error.", reflect.TypeOf(StatusError{}))
+	return renames
+}
+
+// schemaV1Filter returns the filter matching the documents of the current
+// version, or the documents of version 1 not upgraded yet with the fields of
+// the filter renamed to their version 1 names. Only the status collection
+// holds documents of version 1.
+func schemaV1Filter(filter bson.M) bson.M {
+	if len(filter) == 0 {
+		return filter
+	}
+
+	v1Names := map[string]string{}
+	for v1Name, name := range schemaV1FieldRenames() {
+		v1Names[name.(string)] = v1Name
+	}
+	v1Filter := bson.M{"schemaVersion": bson.M{"$exists": false}}
+	for name, value := range filter {
+		if v1Name, ok := v1Names[name]; ok {
+			name = v1Name
+		}
+		v1Filter[name] = value
+	}
+	return bson.M{"$or": []bson.M{filter, v1Filter}}
+}
+
+// decodeStatuses decodes the documents of the cursor, renaming the fields of
+// the documents of version 1 not upgraded yet
+func decodeStatuses(ctx context.Context, cursor *mongo.Cursor) ([]Status, error) {
+	defer cursor.Close(ctx)
+
+	var results []Status
+	for cursor.Next(ctx) {
+		document := cursor.Current
+		if _, err := document.LookupErr("schemaVersion"); err != nil {
+			if document, err = upgradeSchemaV1Document(document); err != nil {
+				return nil, err
+			}
+		}
+		var status Status
+		if err := bson.Unmarshal(document, &status); err != nil {
+			return nil, err
+		}
+		results = append(results, status)
+	}
+	return results, cursor.Err()
+}
+
+// upgradeSchemaV1Document renames the fields of a version 1 document to the
+// names of the current version, as UpgradeSchema does in the database
+func upgradeSchemaV1Document(document bson.Raw) (bson.Raw, error) {
+	var fields bson.M
+	if err := bson.Unmarshal(document, &fields); err != nil {
+		return nil, err
+	}
+	renameFields(fields, "", schemaV1FieldRenames())
+	return bson.Marshal(fields)
+}
+
+// renameFields renames the fields of the document, and of its embedded
+// documents, whose path is in the renames
+func renameFields(fields bson.M, prefix string, renames bson.M) {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		value := fields[name]
+		if embedded, ok := value.(bson.M); ok {
+			renameFields(embedded, prefix+name+".", renames)
+		}
+		if newPath, ok := renames[prefix+name]; ok {
+			delete(fields, name)
+			fields[strings.TrimPrefix(newPath.(string), prefix)] = value
+		}
+	}
+}
+
+func addFieldRenames(renames bson.M, prefix string, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("bson"), ",")
+		if name == "" || name == "_id" {
+			continue
+		}
+		if v1Name := strings.ToLower(field.Name); v1Name != name {
+			renames[prefix+v1Name] = prefix + name
+		}
+	}
+}
+
+// statusIndexes are the indexes of the collection of current statuses: the
+// filter replacing the active status of a deployment, and GetStatus
+func statusIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{Keys: bson.D{
+			{Key: "subscriptionId", Value: 1},
+			{Key: "resourceGroupName", Value: 1},
+			{Key: "correlationId", Value: 1},
+			{Key: "mixinName", Value: 1},
+			{Key: "isActive", Value: 1},
+		}},
+		{Keys: bson.D{
+			{Key: "subscriptionId", Value: 1},
+			{Key: "resourceGroupName", Value: 1},
+			{Key: "resourceName", Value: 1},
+		}},
+	}
+}
+
+// historyIndexes are the indexes of the history: the filter replacing a
+// status recorded again, and the queries
+func historyIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "statusId", Value: 1}},
+			// The statuses recorded by earlier versions have no id
+			Options: options.Index().
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"statusId": bson.M{"$exists": true}}),
+		},
+		{Keys: bson.D{
+			{Key: "correlationId", Value: 1},
+			{Key: "statusReportedOn", Value: 1},
+		}},
+		{Keys: bson.D{
+			{Key: "installationNamespace", Value: 1},
+			{Key: "installationName", Value: 1},
+			{Key: "statusReportedOn", Value: -1},
+		}},
+		{Keys: bson.D{
+			{Key: "subscriptionId", Value: 1},
+			{Key: "resourceGroupName", Value: 1},
+			{Key: "statusReportedOn", Value: -1},
+		}},
+	}
+}
+
+// historyTTLIndex is the index expiring the statuses in the history after
+// the TTL
+func historyTTLIndex(ttl time.Duration) mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys: bson.D{{Key: "statusReportedOn", Value: 1}},
+		Options: options.Index().
+			SetName(historyTTLIndexName).
+			SetExpireAfterSeconds(int32(ttl.Seconds())),
+	}
+}
+
+// ensureIndexes creates the indexes missing from the collections, and
+// changes the TTL of the history when it was created with another one or
+// removes it when the history is kept forever
+func (statusRepository *StatusRepository) ensureIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	if _, err := statusRepository.StatusCollection.Indexes().CreateMany(ctx, statusIndexes()); err != nil {
+		return err
+	}
+	if _, err := statusRepository.HistoryCollection.Indexes().CreateMany(ctx, historyIndexes()); err != nil {
+		return err
+	}
+	if statusRepository.historyTTL <= 0 {
+		return statusRepository.dropHistoryTTLIndex(ctx)
+	}
+
+	ttlIndex := historyTTLIndex(statusRepository.historyTTL)
+	_, err := statusRepository.HistoryCollection.Indexes().CreateOne(ctx, ttlIndex)
+	var commandErr mongo.CommandError
+	if !errors.As(err, &commandErr) || (commandErr.Code != mongoIndexOptionsConflict && commandErr.Code != mongoIndexKeySpecsConflict) {
+		return err
+	}
+	// The index exists with another TTL
+	return statusRepository.HistoryCollection.Database().RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: statusRepository.HistoryCollection.Name()},
+		{Key: "index", Value: bson.D{
+			{Key: "name", Value: historyTTLIndexName},
+			{Key: "expireAfterSeconds", Value: *ttlIndex.Options.ExpireAfterSeconds},
+		}},
+	}).Err()
+}
+
+// dropHistoryTTLIndex drops the index expiring the history, when the history
+// was created with a TTL
+func (statusRepository *StatusRepository) dropHistoryTTLIndex(ctx context.Context) error {
+	indexes, err := statusRepository.HistoryCollection.Indexes().ListSpecifications(ctx)
+	if isIndexNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !hasIndex(indexes, historyTTLIndexName) {
+		return nil
+	}
+	// Another run may drop it first
+	_, err = statusRepository.HistoryCollection.Indexes().DropOne(ctx, historyTTLIndexName)
+	if isIndexNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// hasIndex reports whether the index with the name is one of the indexes
+func hasIndex(indexes []*mongo.IndexSpecification, name string) bool {
+	for _, index := range indexes {
+		if index.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isIndexNotFound reports whether the error is raised because the index or
+// its collection doesn't exist
+func isIndexNotFound(err error) bool {
+	var commandErr mongo.CommandError
+	return errors.As(err, &commandErr) && (commandErr.Code == mongoIndexNotFound || commandErr.Code == mongoNamespaceNotFound)
+}
@@ -0,0 +1,136 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestSchemaV1FieldRenames(t *testing.T) {
+	renames := schemaV1FieldRenames()
+
+	// Version 1 documents used the lowercased field names
+	assert.Equal(t, "correlationId", renames["correlationid"])
+	assert.Equal(t, "subscriptionId", renames["subscriptionid"])
+	assert.Equal(t, "mixinName", renames["mixinname"])
+	assert.Equal(t, "installationNamespace", renames["installationnamespace"])
+	assert.Equal(t, "statusReportedOn", renames["statusreportedon"])
+	assert.Equal(t, "error.requestId", renames["error.requestid"])
+	assert.NotContains(t, renames, "output", "fields with the same name aren't renamed")
+	assert.NotContains(t, renames, "id")
+	assert.NotContains(t, renames, "error.code")
+}
+
+func TestSchemaV1Filter(t *testing.T) {
+	assert.Equal(t, bson.M{}, schemaV1Filter(bson.M{}))
+
+	filter := bson.M{"correlationId": "abc-123", "isActive": true, "output": "out"}
+	assert.Equal(t, bson.M{"$or": []bson.M{
+		filter,
+		{
+			"schemaVersion": bson.M{"$exists": false},
+			"correlationid": "abc-123",
+			"isactive":      true,
+			"output":        "out",
+		},
+	}}, schemaV1Filter(filter))
+}
+
+func TestDecodeStatuses(t *testing.T) {
+	reportedOn := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	v1 := bson.M{
+		"correlationid":    "abc-123",
+		"executionstatus":  StatusFailed,
+		"statusreportedon": reportedOn,
+		"output":           "v1",
+		"error":            bson.M{"message": "deployment has failed", "requestid": "request-id"},
+	}
+	v2 := Status{
+		SchemaVersion:    StatusSchemaVersion,
+		CorrelationId:    "abc-123",
+		ExecutionStatus:  StatusSucceeded,
+		StatusReportedOn: reportedOn.Add(time.Minute),
+		Output:           "v2",
+	}
+	cursor, err := mongo.NewCursorFromDocuments([]interface{}{v1, v2}, nil, nil)
+	require.NoError(t, err)
+
+	statuses, err := decodeStatuses(context.Background(), cursor)
+	require.NoError(t, err)
+	require.Len(t, statuses, 2)
+
+	// The documents of version 1 are read as if they were upgraded
+	assert.Equal(t, "abc-123", statuses[0].CorrelationId)
+	assert.Equal(t, StatusFailed, statuses[0].ExecutionStatus)
+	assert.Equal(t, reportedOn, statuses[0].StatusReportedOn.UTC())
+	assert.Equal(t, "v1", statuses[0].Output)
+	require.NotNil(t, statuses[0].Error)
+	assert.Equal(t, "deployment has failed", statuses[0].Error.Message)
+	assert.Equal(t, "request-id", statuses[0].Error.RequestId)
+
+	assert.Equal(t, "abc-123", statuses[1].CorrelationId)
+	assert.Equal(t, StatusSucceeded, statuses[1].ExecutionStatus)
+	assert.Equal(t, "v2", statuses[1].Output)
+}
+
+func TestStatus_BSONFieldNames(t *testing.T) {
+	completedOn := time.Now()
+	data, err := bson.Marshal(Status{
+		SchemaVersion:   StatusSchemaVersion,
+		CorrelationId:   "abc-123",
+		ExecutionStatus: StatusFailed,
+		CompletedOn:     &completedOn,
+		Error:           &StatusError{Message: "deployment has failed", RequestId: "request-id"},
+	})
+	require.NoError(t, err)
+
+	var doc bson.M
+	require.NoError(t, bson.Unmarshal(data, &doc))
+	assert.NotContains(t, doc, "_id", "the id is generated by the database")
+	assert.Equal(t, int32(StatusSchemaVersion), doc["schemaVersion"])
+	assert.Equal(t, "abc-123", doc["correlationId"])
+	assert.Equal(t, StatusFailed, doc["executionStatus"])
+	assert.Contains(t, doc, "completedOn")
+	assert.Equal(t, "request-id", doc["error"].(bson.M)["requestId"])
+}
+
+func TestHistoryTTLIndex(t *testing.T) {
+	index := historyTTLIndex(90 * 24 * time.Hour)
+	assert.Equal(t, bson.D{{Key: "statusReportedOn", Value: 1}}, index.Keys)
+	assert.Equal(t, historyTTLIndexName, *index.Options.Name)
+	assert.Equal(t, int32(90*24*60*60), *index.Options.ExpireAfterSeconds)
+}
+
+func TestStatusIndexes(t *testing.T) {
+	// The replace filter of RecordStatus must be indexed
+	keys := statusIndexes()[0].Keys.(bson.D)
+	var names []string
+	for _, key := range keys {
+		names = append(names, key.Key)
+	}
+	assert.Equal(t, []string{"subscriptionId", "resourceGroupName", "correlationId", "mixinName", "isActive"}, names)
+	assert.Len(t, historyIndexes(), 4)
+
+	// A status recorded again replaces the status with the same id
+	index := historyIndexes()[0]
+	assert.Equal(t, bson.D{{Key: "statusId", Value: 1}}, index.Keys)
+	assert.True(t, *index.Options.Unique)
+}
+
+func TestHasIndex(t *testing.T) {
+	indexes := []*mongo.IndexSpecification{{Name: "_id_"}, {Name: historyTTLIndexName}}
+	assert.True(t, hasIndex(indexes, historyTTLIndexName))
+	assert.False(t, hasIndex(indexes[:1], historyTTLIndexName), "the index is only dropped when it exists")
+}
+
+func TestIsIndexNotFound(t *testing.T) {
+	assert.True(t, isIndexNotFound(mongo.CommandError{Code: mongoIndexNotFound}))
+	assert.True(t, isIndexNotFound(mongo.CommandError{Code: mongoNamespaceNotFound}))
+	assert.False(t, isIndexNotFound(mongo.CommandError{Code: mongoIndexOptionsConflict}))
+	assert.False(t, isIndexNotFound(nil))
+}
@@ -0,0 +1,46 @@
+package db
+
+import "time"
+
+// MongoStatusSink records statuses in a MongoDB collection, replacing the
+// active status of the deployment, and appends them to its history
+type MongoStatusSink struct {
+	clientHelper *MongoClientHelper
+	repository   *StatusRepository
+}
+
+// NewMongoStatusSink connects to the MongoDB server and returns a sink that
+// records statuses in the collection. Statuses expire from the history after
+// the TTL, unless it is zero.
+func NewMongoStatusSink(connectionString string, databaseName string, collectionName string, historyTTL time.Duration) (*MongoStatusSink, error) {
+	clientHelper, err := NewMongoClientHelper(connectionString)
+	if err != nil {
+		return nil, err
+	}
+
+	configuration := MongoConfiguration{
+		MongoClient:    clientHelper.MongoClient,
+		DatabaseName:   databaseName,
+		CollectionName: collectionName,
+		HistoryTTL:     historyTTL,
+	}
+	return &MongoStatusSink{
+		clientHelper: clientHelper,
+		repository:   NewStatusRepository(configuration),
+	}, nil
+}
+
+// RecordStatus appends the status to the history and upserts the current
+// status
+func (sink *MongoStatusSink) RecordStatus(status Status) error {
+	if _, err := sink.repository.RecordHistory(status); err != nil {
+		return err
+	}
+	_, err := sink.repository.RecordStatus(status)
+	return err
+}
+
+// Close disconnects from the MongoDB server
+func (sink *MongoStatusSink) Close() error {
+	return sink.clientHelper.DisconnectMongoClient()
+}
@@ -4,89 +4,233 @@ import (
 	"context"
 	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
-	"gopkg.in/mgo.v2/bson"
 )
 
 type MongoConfiguration struct {
 	MongoClient    *mongo.Client
 	DatabaseName   string
 	CollectionName string
+	// HistoryTTL expires the statuses in the history after the duration. The
+	// history is kept forever when it is zero, and the statuses stop expiring
+	// when it is set back to zero.
+	HistoryTTL time.Duration
 }
 
-// Package represents a document in the collection
+// Package represents a document in the collection. The bson field names are
+// those of version StatusSchemaVersion of the documents. The fields tagged
+// sensitive are encrypted by a StatusCipher when a key is configured.
 type Status struct {
-	Id                    bson.ObjectId `bson:"_id,omitempty"`
-	SubscriptionId        string
-	ResourceGroupName     string
-	ResourceName          string
-	ItemName              string
-	ItemType              string
-	MixInName             string
-	IsActive              bool
-	ExecutionStatus       string
-	StatusReportedOn      time.Time
-	InstallationName      string
-	InstallationNameSpace string
-	CorrelationId         string
-	PorterCorrelationId   string
-	CnabRevision          string
-	Output                string
+	Id                    primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	SchemaVersion         int                `bson:"schemaVersion" json:"schemaVersion"`
+	SubscriptionId        string             `bson:"subscriptionId" json:"subscriptionId"`
+	ResourceGroupName     string             `bson:"resourceGroupName" json:"resourceGroupName"`
+	ResourceName          string             `bson:"resourceName,omitempty" json:"resourceName,omitempty"`
+	ItemName              string             `bson:"itemName" json:"itemName"`
+	ItemType              string             `bson:"itemType" json:"itemType"`
+	MixInName             string             `bson:"mixinName" json:"mixinName"`
+	IsActive              bool               `bson:"isActive" json:"isActive"`
+	ExecutionStatus       string             `bson:"executionStatus" json:"executionStatus"`
+	StatusReportedOn      time.Time          `bson:"statusReportedOn" json:"statusReportedOn"`
+	InstallationName      string             `bson:"installationName" json:"installationName"`
+	InstallationNameSpace string             `bson:"installationNamespace,omitempty" json:"installationNamespace,omitempty"`
+	CorrelationId         string             `bson:"correlationId" json:"correlationId"`
+	PorterCorrelationId   string             `bson:"porterCorrelationId" json:"porterCorrelationId"`
+	CnabRevision          string             `bson:"cnabRevision,omitempty" json:"cnabRevision,omitempty"`
+	Action                string             `bson:"action,omitempty" json:"action,omitempty"`
+	BundleReference       string             `bson:"bundleReference,omitempty" json:"bundleReference,omitempty"`
+	Template              string             `bson:"template,omitempty" json:"template,omitempty"`
+	DeploymentName        string             `bson:"deploymentName,omitempty" json:"deploymentName,omitempty"`
+	DeploymentId          string             `bson:"deploymentId,omitempty" json:"deploymentId,omitempty"`
+	RequestIds            []string           `bson:"requestIds,omitempty" json:"requestIds,omitempty"`
+	Output                string             `bson:"output" json:"output" sensitive:"true"`
+	StartedOn             time.Time          `bson:"startedOn" json:"startedOn"`
+	CompletedOn           *time.Time         `bson:"completedOn,omitempty" json:"completedOn,omitempty"`
+	DurationSeconds       float64            `bson:"durationSeconds,omitempty" json:"durationSeconds,omitempty"`
+	Error                 *StatusError       `bson:"error,omitempty" json:"error,omitempty"`
+
+	// StatusId identifies the status reported, so that a status delivered
+	// again from the spool replaces the one recorded in the history
+	StatusId string `bson:"statusId,omitempty" json:"statusId,omitempty"`
+	// DeployedTemplate and DeployedParameters are the template and the
+	// parameters, as JSON, of a Succeeded deployment, without the secure
+	// parameters. A failed upgrade is rolled back to them.
+	DeployedTemplate   string `bson:"deployedTemplate,omitempty" json:"deployedTemplate,omitempty"`
+	DeployedParameters string `bson:"deployedParameters,omitempty" json:"deployedParameters,omitempty" sensitive:"true"`
 }
 
+// StatusError describes why a step failed, so that failures can be grouped
+// by cause
+type StatusError struct {
+	// Code, Message, Target and Details are the error returned by ARM. The
+	// message is the error of the mixin when ARM didn't return one.
+	Code    string              `bson:"code,omitempty" json:"code,omitempty"`
+	Message string              `bson:"message" json:"message"`
+	Target  string              `bson:"target,omitempty" json:"target,omitempty"`
+	Details []StatusErrorDetail `bson:"details,omitempty" json:"details,omitempty"`
+	// Step is the step that failed
+	Step string `bson:"step,omitempty" json:"step,omitempty"`
+	// Phase is the phase of the step that failed: auth, validate, deploy,
+	// poll or outputs
+	Phase string `bson:"phase,omitempty" json:"phase,omitempty"`
+	// RequestId and CorrelationId identify the failed ARM request
+	RequestId     string `bson:"requestId,omitempty" json:"requestId,omitempty"`
+	CorrelationId string `bson:"correlationId,omitempty" json:"correlationId,omitempty"`
+}
+
+// StatusErrorDetail is an error returned by ARM, with the errors that caused
+// it
+type StatusErrorDetail struct {
+	Code    string              `bson:"code,omitempty" json:"code,omitempty"`
+	Message string              `bson:"message,omitempty" json:"message,omitempty"`
+	Target  string              `bson:"target,omitempty" json:"target,omitempty"`
+	Details []StatusErrorDetail `bson:"details,omitempty" json:"details,omitempty"`
+}
+
+// The execution statuses of a step
+const (
+	StatusRunning     = "Running"
+	StatusRetrying    = "Retrying"
+	StatusRollingBack = "RollingBack"
+	StatusSucceeded   = "Succeeded"
+	StatusFailed      = "Failed"
+)
+
+// IsTerminalStatus reports whether the execution status ends the step
+func IsTerminalStatus(executionStatus string) bool {
+	return executionStatus == StatusSucceeded || executionStatus == StatusFailed
+}
+
+const (
+	// statusWriteTimeout bounds how long recording a status can delay the
+	// deployment
+	statusWriteTimeout = 30 * time.Second
+	// statusReadTimeout bounds the queries of the statuses
+	statusReadTimeout = 60 * time.Second
+)
+
 type StatusRepository struct {
+	historyTTL time.Duration
+
+	// StatusCollection holds the current status of each deployment
 	StatusCollection *mongo.Collection
+	// HistoryCollection holds every status reported, in an append-only
+	// collection named after the status collection with a _history suffix
+	HistoryCollection *mongo.Collection
 }
 
 // // NewStatusRepository creates a new instance of StatusRepository
 func NewStatusRepository(configuration MongoConfiguration) *StatusRepository {
 
-	var mongoCollection = configuration.MongoClient.Database(configuration.DatabaseName).Collection(configuration.CollectionName)
+	var database = configuration.MongoClient.Database(configuration.DatabaseName)
 
-	return &StatusRepository{StatusCollection: mongoCollection}
+	return &StatusRepository{
+		historyTTL:        configuration.HistoryTTL,
+		StatusCollection:  database.Collection(configuration.CollectionName),
+		HistoryCollection: database.Collection(configuration.CollectionName + "_history"),
+	}
 }
 
 // // RecordStatus records the status of a package
 func (statusRepository *StatusRepository) RecordStatus(status Status) (*mongo.UpdateResult, error) {
 
+	if err := statusRepository.prepare(); err != nil {
+		return nil, err
+	}
+
 	filter := bson.M{}
 
-	filter["subscriptionid"] = status.SubscriptionId
-	filter["resourcegroupname"] = status.ResourceGroupName
-	filter["CorrelationId"] = status.CorrelationId
-	filter["mixinname"] = status.MixInName
-	filter["isactive"] = true
+	filter["subscriptionId"] = status.SubscriptionId
+	filter["resourceGroupName"] = status.ResourceGroupName
+	filter["correlationId"] = status.CorrelationId
+	filter["mixinName"] = status.MixInName
+	filter["isActive"] = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), statusWriteTimeout)
+	defer cancel()
 
-	result, err := statusRepository.StatusCollection.ReplaceOne(context.Background(), filter, status, options.Replace().SetUpsert(true))
+	status.Id = primitive.NilObjectID
+	status.SchemaVersion = StatusSchemaVersion
+	result, err := statusRepository.StatusCollection.ReplaceOne(ctx, filter, status, options.Replace().SetUpsert(true))
 
 	return result, err
 }
 
-// Get status returns the status for the given subscriptionId, resourceGroupName and resourceName
-func (statusRepository *StatusRepository) GetStatus(subscriptionId string, resourceGroupName string, resourceName string) ([]Status, error) {
+// RecordHistory appends the status to the history. A status with an id
+// replaces the status recorded with the same id, so that recording it again
+// doesn't add it twice.
+func (statusRepository *StatusRepository) RecordHistory(status Status) (*mongo.UpdateResult, error) {
+
+	if err := statusRepository.prepare(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), statusWriteTimeout)
+	defer cancel()
+
+	status.Id = primitive.NilObjectID
+	status.SchemaVersion = StatusSchemaVersion
+	if status.StatusId == "" {
+		// Statuses spooled by earlier versions have no id
+		result, err := statusRepository.HistoryCollection.InsertOne(ctx, status)
+		if err != nil {
+			return nil, err
+		}
+		return &mongo.UpdateResult{UpsertedCount: 1, UpsertedID: result.InsertedID}, nil
+	}
+	filter := bson.M{"statusId": status.StatusId}
+	return statusRepository.HistoryCollection.ReplaceOne(ctx, filter, status, options.Replace().SetUpsert(true))
+}
+
+// GetHistory returns every status reported for the correlation id, oldest first
+func (statusRepository *StatusRepository) GetHistory(correlationId string) ([]Status, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), statusReadTimeout)
+	defer cancel()
 
 	filter := bson.M{}
 
-	filter["subscriptionid"] = subscriptionId
-	filter["resourcegroupname"] = resourceGroupName
-	filter["resourcename"] = resourceName
-	filter["isactive"] = true
+	filter["correlationId"] = correlationId
 
-	cursor, err := statusRepository.StatusCollection.Find(context.Background(), filter)
+	cursor, err := statusRepository.HistoryCollection.Find(
+		ctx,
+		filter,
+		options.Find().SetSort(bson.D{{Key: "statusReportedOn", Value: 1}}),
+	)
 
 	if err != nil {
 		return nil, err
 	}
 
 	var results []Status
+	err = cursor.All(ctx, &results)
+	return results, err
+}
 
-	if err = cursor.All(context.Background(), &results); err != nil {
+// Get status returns the status for the given subscriptionId, resourceGroupName and resourceName
+func (statusRepository *StatusRepository) GetStatus(subscriptionId string, resourceGroupName string, resourceName string) ([]Status, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), statusReadTimeout)
+	defer cancel()
+
+	filter := bson.M{}
+
+	filter["subscriptionId"] = subscriptionId
+	filter["resourceGroupName"] = resourceGroupName
+	filter["resourceName"] = resourceName
+	filter["isActive"] = true
+
+	cursor, err := statusRepository.StatusCollection.Find(ctx, schemaV1Filter(filter))
+
+	if err != nil {
 		return nil, err
 	}
 
-	return results, nil
+	return decodeStatuses(ctx, cursor)
 }
 
 // /helper helps in creating mongo client and provide function to disconnect
@@ -0,0 +1,61 @@
+package db
+
+import "fmt"
+
+// SpoolingStatusSink records statuses in a sink and spools those it can't
+// deliver, so that no status is lost when the sink is unavailable. Once a
+// status is spooled, the following statuses are spooled too so that they
+// are replayed in order.
+type SpoolingStatusSink struct {
+	sink        StatusSink
+	destination string
+	spool       *StatusSpool
+	spooling    bool
+}
+
+// NewSpoolingStatusSink returns a sink delivering to the sink of the
+// destination. The sink is nil when it couldn't be created, and spooling is
+// set when statuses are already waiting in the spool, so that every status
+// is spooled.
+func NewSpoolingStatusSink(sink StatusSink, destination string, spool *StatusSpool, spooling bool) *SpoolingStatusSink {
+	return &SpoolingStatusSink{
+		sink:        sink,
+		destination: destination,
+		spool:       spool,
+		spooling:    spooling || sink == nil,
+	}
+}
+
+// RecordStatus delivers the status, or spools it. The error of the first
+// failed delivery is returned once the status is spooled, to report that
+// statuses are delayed.
+func (sink *SpoolingStatusSink) RecordStatus(status Status) error {
+	var deliverErr error
+	if !sink.spooling {
+		if deliverErr = sink.sink.RecordStatus(status); deliverErr == nil {
+			return nil
+		}
+		sink.spooling = true
+	}
+
+	if err := sink.spool.Append(sink.destination, status); err != nil {
+		return fmt.Errorf("error spooling status, the status is lost: %s", err)
+	}
+	if deliverErr != nil {
+		return fmt.Errorf("the status is spooled to %s until it can be delivered: %s", sink.spool.Path(), deliverErr)
+	}
+	return nil
+}
+
+// Spooling reports whether statuses are spooled
+func (sink *SpoolingStatusSink) Spooling() bool {
+	return sink.spooling
+}
+
+// Close closes the sink
+func (sink *SpoolingStatusSink) Close() error {
+	if sink.sink == nil {
+		return nil
+	}
+	return sink.sink.Close()
+}
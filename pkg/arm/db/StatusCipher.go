@@ -0,0 +1,174 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// EncryptedPlaceholder replaces the sensitive fields that can't be
+// decrypted
+const EncryptedPlaceholder = "<encrypted>"
+
+// encryptedValuePrefix starts encrypted values, which are followed by the
+// key ID and the base64 encoded nonce and ciphertext:
+// enc:v1:<key ID>:<base64>
+const encryptedValuePrefix = "enc:v1:"
+
+// StatusCipher encrypts the sensitive fields of statuses, the string fields
+// tagged sensitive:"true", with AES-GCM. The ID of the key is stored with
+// each value, so that values encrypted with older keys can be decrypted
+// after the key is rotated.
+type StatusCipher struct {
+	keyId string
+	aeads map[string]cipher.AEAD
+}
+
+// NewStatusCipher returns a cipher encrypting with the key with the ID and
+// decrypting with any of the keys. The keys are AES keys of 16, 24 or 32
+// bytes.
+func NewStatusCipher(keyId string, keys map[string][]byte) (*StatusCipher, error) {
+	if _, ok := keys[keyId]; !ok {
+		return nil, fmt.Errorf("the encryption key %q is missing", keyId)
+	}
+	c := &StatusCipher{keyId: keyId, aeads: map[string]cipher.AEAD{}}
+	for id, key := range keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid encryption key ID %q, it must not be empty or contain ':'", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %q: %s", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %q: %s", id, err)
+		}
+		c.aeads[id] = aead
+	}
+	return c, nil
+}
+
+// Encrypt encrypts the value of the field. The field name is authenticated
+// with the value, so that encrypted values can't be swapped between fields.
+func (c *StatusCipher) Encrypt(field string, value string) (string, error) {
+	aead := c.aeads[c.keyId]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(field))
+	return encryptedValuePrefix + c.keyId + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypts the value of the field
+func (c *StatusCipher) Decrypt(field string, value string) (string, error) {
+	keyId, encoded, ok := strings.Cut(strings.TrimPrefix(value, encryptedValuePrefix), ":")
+	if !IsEncrypted(value) || !ok {
+		return "", errors.New("the value isn't encrypted")
+	}
+	aead, ok := c.aeads[keyId]
+	if !ok {
+		return "", fmt.Errorf("the encryption key %q is missing", keyId)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("the encrypted value is corrupt")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(field))
+	if err != nil {
+		return "", fmt.Errorf("error decrypting with key %q: %s", keyId, err)
+	}
+	return string(plaintext), nil
+}
+
+// IsEncrypted reports whether the value was encrypted by a StatusCipher
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedValuePrefix)
+}
+
+// EncryptStatus returns the status with its sensitive fields encrypted.
+// Empty fields are left empty.
+func (c *StatusCipher) EncryptStatus(status Status) (Status, error) {
+	err := forEachSensitiveField(&status, func(name string, field reflect.Value) error {
+		if field.String() == "" || IsEncrypted(field.String()) {
+			return nil
+		}
+		encrypted, err := c.Encrypt(name, field.String())
+		if err != nil {
+			return fmt.Errorf("error encrypting %s: %s", name, err)
+		}
+		field.SetString(encrypted)
+		return nil
+	})
+	return status, err
+}
+
+// DecryptStatus returns the status with its sensitive fields decrypted. The
+// fields that can't be decrypted, because the cipher is nil or doesn't have
+// their key, are replaced with EncryptedPlaceholder.
+func DecryptStatus(c *StatusCipher, status Status) Status {
+	forEachSensitiveField(&status, func(name string, field reflect.Value) error {
+		if !IsEncrypted(field.String()) {
+			return nil
+		}
+		value := EncryptedPlaceholder
+		if c != nil {
+			if decrypted, err := c.Decrypt(name, field.String()); err == nil {
+				value = decrypted
+			}
+		}
+		field.SetString(value)
+		return nil
+	})
+	return status
+}
+
+// forEachSensitiveField calls fn with the bson name and the value of the
+// string fields of the status tagged sensitive:"true"
+func forEachSensitiveField(status *Status, fn func(name string, field reflect.Value) error) error {
+	v := reflect.ValueOf(status).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		fieldType := v.Type().Field(i)
+		if fieldType.Tag.Get("sensitive") != "true" || fieldType.Type.Kind() != reflect.String {
+			continue
+		}
+		name, _, _ := strings.Cut(fieldType.Tag.Get("bson"), ",")
+		if err := fn(name, v.Field(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EncryptingStatusSink encrypts the sensitive fields of the statuses before
+// recording them in a sink
+type EncryptingStatusSink struct {
+	sink   StatusSink
+	cipher *StatusCipher
+}
+
+// NewEncryptingStatusSink returns a sink encrypting statuses with the cipher
+func NewEncryptingStatusSink(sink StatusSink, cipher *StatusCipher) *EncryptingStatusSink {
+	return &EncryptingStatusSink{sink: sink, cipher: cipher}
+}
+
+// RecordStatus encrypts the status and records it. A status that can't be
+// encrypted isn't recorded.
+func (sink *EncryptingStatusSink) RecordStatus(status Status) error {
+	encrypted, err := sink.cipher.EncryptStatus(status)
+	if err != nil {
+		return err
+	}
+	return sink.sink.RecordStatus(encrypted)
+}
+
+// Close closes the sink
+func (sink *EncryptingStatusSink) Close() error {
+	return sink.sink.Close()
+}
@@ -0,0 +1,106 @@
+package db
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testKeyOld = bytes.Repeat([]byte{1}, 32)
+	testKeyNew = bytes.Repeat([]byte{2}, 32)
+)
+
+func TestStatusCipher_EncryptStatus(t *testing.T) {
+	c, err := NewStatusCipher("new", map[string][]byte{"new": testKeyNew})
+	require.NoError(t, err)
+
+	status := Status{CorrelationId: "abc-123", Output: `{"CONNECTION_STRING":"Server=mysql;Password=secret"}`}
+	encrypted, err := c.EncryptStatus(status)
+	require.NoError(t, err)
+	assert.True(t, IsEncrypted(encrypted.Output))
+	assert.Contains(t, encrypted.Output, "enc:v1:new:", "the key ID is stored with the value")
+	assert.NotContains(t, encrypted.Output, "secret")
+	assert.Equal(t, "abc-123", encrypted.CorrelationId, "only sensitive fields are encrypted")
+
+	again, err := c.EncryptStatus(encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, encrypted.Output, again.Output, "encrypted values aren't encrypted twice")
+
+	assert.Equal(t, status, DecryptStatus(c, encrypted))
+
+	empty, err := c.EncryptStatus(Status{})
+	require.NoError(t, err)
+	assert.Empty(t, empty.Output)
+}
+
+func TestStatusCipher_Rotation(t *testing.T) {
+	oldCipher, err := NewStatusCipher("old", map[string][]byte{"old": testKeyOld})
+	require.NoError(t, err)
+	encrypted, err := oldCipher.EncryptStatus(Status{Output: "secret"})
+	require.NoError(t, err)
+
+	// After rotation the new key encrypts and the old key still decrypts
+	rotated, err := NewStatusCipher("new", map[string][]byte{"new": testKeyNew, "old": testKeyOld})
+	require.NoError(t, err)
+	assert.Equal(t, "secret", DecryptStatus(rotated, encrypted).Output)
+	reencrypted, err := rotated.EncryptStatus(Status{Output: "secret"})
+	require.NoError(t, err)
+	assert.Contains(t, reencrypted.Output, "enc:v1:new:")
+
+	// Readers without the key see a placeholder
+	newOnly, err := NewStatusCipher("new", map[string][]byte{"new": testKeyNew})
+	require.NoError(t, err)
+	assert.Equal(t, EncryptedPlaceholder, DecryptStatus(newOnly, encrypted).Output)
+	assert.Equal(t, EncryptedPlaceholder, DecryptStatus(nil, encrypted).Output)
+	assert.Equal(t, "not encrypted", DecryptStatus(nil, Status{Output: "not encrypted"}).Output)
+}
+
+func TestStatusCipher_Decrypt(t *testing.T) {
+	c, err := NewStatusCipher("new", map[string][]byte{"new": testKeyNew})
+	require.NoError(t, err)
+	encrypted, err := c.Encrypt("output", "secret")
+	require.NoError(t, err)
+
+	_, err = c.Decrypt("error", encrypted)
+	assert.Error(t, err, "values are bound to their field")
+
+	_, err = c.Decrypt("output", encrypted[:len(encrypted)-4]+"AAAA")
+	assert.Error(t, err, "tampered values are rejected")
+
+	_, err = c.Decrypt("output", "enc:v1:other:AAAA")
+	assert.EqualError(t, err, `the encryption key "other" is missing`)
+
+	_, err = c.Decrypt("output", "secret")
+	assert.EqualError(t, err, "the value isn't encrypted")
+}
+
+func TestNewStatusCipher_Errors(t *testing.T) {
+	_, err := NewStatusCipher("missing", map[string][]byte{"new": testKeyNew})
+	assert.EqualError(t, err, `the encryption key "missing" is missing`)
+
+	_, err = NewStatusCipher("short", map[string][]byte{"short": []byte("too short")})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid encryption key "short"`)
+
+	_, err = NewStatusCipher("a:b", map[string][]byte{"a:b": testKeyNew})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid encryption key ID "a:b"`)
+}
+
+func TestEncryptingStatusSink(t *testing.T) {
+	c, err := NewStatusCipher("new", map[string][]byte{"new": testKeyNew})
+	require.NoError(t, err)
+	inner := NewMemoryStatusSink()
+	sink := NewEncryptingStatusSink(inner, c)
+
+	require.NoError(t, sink.RecordStatus(Status{Output: "secret"}))
+	require.NoError(t, sink.Close())
+
+	statuses := inner.Statuses()
+	require.Len(t, statuses, 1)
+	assert.True(t, IsEncrypted(statuses[0].Output))
+	assert.True(t, inner.Closed())
+}
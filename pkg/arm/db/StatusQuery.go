@@ -0,0 +1,164 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// StatusQuery selects statuses from the history. Empty fields don't filter.
+type StatusQuery struct {
+	InstallationName      string
+	InstallationNamespace string
+	SubscriptionId        string
+	ResourceGroupName     string
+	// ReportedAfter and ReportedBefore bound the time the statuses were
+	// reported
+	ReportedAfter  time.Time
+	ReportedBefore time.Time
+	// Skip and Limit page through the statuses, newest first. A zero Limit
+	// returns every status.
+	Skip  int64
+	Limit int64
+}
+
+// filter returns the MongoDB filter of the query
+func (query StatusQuery) filter() bson.M {
+	filter := bson.M{}
+
+	if query.InstallationName != "" {
+		filter["installationName"] = query.InstallationName
+	}
+	if query.InstallationNamespace != "" {
+		filter["installationNamespace"] = query.InstallationNamespace
+	}
+	if query.SubscriptionId != "" {
+		filter["subscriptionId"] = query.SubscriptionId
+	}
+	if query.ResourceGroupName != "" {
+		filter["resourceGroupName"] = query.ResourceGroupName
+	}
+	reportedOn := bson.M{}
+	if !query.ReportedAfter.IsZero() {
+		reportedOn["$gte"] = query.ReportedAfter
+	}
+	if !query.ReportedBefore.IsZero() {
+		reportedOn["$lt"] = query.ReportedBefore
+	}
+	if len(reportedOn) > 0 {
+		filter["statusReportedOn"] = reportedOn
+	}
+	return filter
+}
+
+// newestFirst sorts the statuses newest first
+var newestFirst = bson.D{{Key: "statusReportedOn", Value: -1}}
+
+// latestPerInstallationPipeline returns the aggregation pipeline that keeps
+// the newest status of each installation matching the query
+func (query StatusQuery) latestPerInstallationPipeline() []bson.M {
+	pipeline := []bson.M{
+		{"$match": query.filter()},
+		{"$sort": newestFirst},
+		{"$group": bson.M{
+			"_id": bson.M{
+				"namespace":    "$installationNamespace",
+				"installation": "$installationName",
+			},
+			"latest": bson.M{"$first": "$$ROOT"},
+		}},
+		{"$replaceRoot": bson.M{"newRoot": "$latest"}},
+		{"$sort": newestFirst},
+	}
+	if query.Skip > 0 {
+		pipeline = append(pipeline, bson.M{"$skip": query.Skip})
+	}
+	if query.Limit > 0 {
+		pipeline = append(pipeline, bson.M{"$limit": query.Limit})
+	}
+	return pipeline
+}
+
+// QueryStatuses returns the statuses in the history matching the query,
+// newest first
+func (statusRepository *StatusRepository) QueryStatuses(query StatusQuery) ([]Status, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), statusReadTimeout)
+	defer cancel()
+
+	findOptions := options.Find().SetSort(newestFirst)
+	if query.Skip > 0 {
+		findOptions.SetSkip(query.Skip)
+	}
+	if query.Limit > 0 {
+		findOptions.SetLimit(query.Limit)
+	}
+
+	cursor, err := statusRepository.HistoryCollection.Find(ctx, query.filter(), findOptions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var results []Status
+	err = cursor.All(ctx, &results)
+	return results, err
+}
+
+// GetLatestStatusPerInstallation returns the newest status of each
+// installation matching the query, newest first
+func (statusRepository *StatusRepository) GetLatestStatusPerInstallation(query StatusQuery) ([]Status, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), statusReadTimeout)
+	defer cancel()
+
+	cursor, err := statusRepository.HistoryCollection.Aggregate(ctx, query.latestPerInstallationPipeline())
+
+	if err != nil {
+		return nil, err
+	}
+
+	var results []Status
+	err = cursor.All(ctx, &results)
+	return results, err
+}
+
+// lastSucceededDeploymentFilter returns the filter of the Succeeded statuses
+// of the deployment that recorded the deployed template
+func lastSucceededDeploymentFilter(subscriptionId string, resourceGroupName string, deploymentName string) bson.M {
+	return bson.M{
+		"subscriptionId":    subscriptionId,
+		"resourceGroupName": resourceGroupName,
+		"deploymentName":    deploymentName,
+		"executionStatus":   StatusSucceeded,
+		"deployedTemplate":  bson.M{"$exists": true},
+	}
+}
+
+// GetLastSucceededDeployment returns the newest Succeeded status in the
+// history of the deployment that recorded the deployed template, or nil when
+// there is none
+func (statusRepository *StatusRepository) GetLastSucceededDeployment(subscriptionId string, resourceGroupName string, deploymentName string) (*Status, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), statusReadTimeout)
+	defer cancel()
+
+	var status Status
+	err := statusRepository.HistoryCollection.FindOne(
+		ctx,
+		lastSucceededDeploymentFilter(subscriptionId, resourceGroupName, deploymentName),
+		options.FindOne().SetSort(bson.D{{Key: "statusReportedOn", Value: -1}}),
+	).Decode(&status)
+
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
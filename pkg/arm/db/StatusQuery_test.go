@@ -0,0 +1,58 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestStatusQuery_Filter(t *testing.T) {
+	assert.Equal(t, bson.M{}, StatusQuery{}.filter())
+
+	after := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	before := after.Add(24 * time.Hour)
+	query := StatusQuery{
+		InstallationName:      "mysql",
+		InstallationNamespace: "dev",
+		SubscriptionId:        "sub",
+		ResourceGroupName:     "test-rg",
+		ReportedAfter:         after,
+		ReportedBefore:        before,
+		Skip:                  10,
+		Limit:                 5,
+	}
+	assert.Equal(t, bson.M{
+		"installationName":      "mysql",
+		"installationNamespace": "dev",
+		"subscriptionId":        "sub",
+		"resourceGroupName":     "test-rg",
+		"statusReportedOn":      bson.M{"$gte": after, "$lt": before},
+	}, query.filter())
+}
+
+func TestStatusQuery_LatestPerInstallationPipeline(t *testing.T) {
+	query := StatusQuery{ResourceGroupName: "test-rg"}
+
+	pipeline := query.latestPerInstallationPipeline()
+	assert.Len(t, pipeline, 5, "without paging the pipeline doesn't skip or limit")
+	assert.Equal(t, bson.M{"$match": bson.M{"resourceGroupName": "test-rg"}}, pipeline[0], "the history has no documents of version 1")
+	assert.Equal(t, bson.M{"newRoot": "$latest"}, pipeline[3]["$replaceRoot"])
+
+	query.Skip = 20
+	query.Limit = 10
+	pipeline = query.latestPerInstallationPipeline()
+	assert.Equal(t, bson.M{"$skip": int64(20)}, pipeline[5])
+	assert.Equal(t, bson.M{"$limit": int64(10)}, pipeline[6])
+}
+
+func TestLastSucceededDeploymentFilter(t *testing.T) {
+	assert.Equal(t, bson.M{
+		"subscriptionId":    "sub",
+		"resourceGroupName": "test-rg",
+		"deploymentName":    "storage",
+		"executionStatus":   "Succeeded",
+		"deployedTemplate":  bson.M{"$exists": true},
+	}, lastSucceededDeploymentFilter("sub", "test-rg", "storage"))
+}
@@ -0,0 +1,25 @@
+package db
+
+// StatusSink records the status of the steps run by the mixin. The mixin
+// keeps deploying when a status can't be recorded, so implementations only
+// need to report the error.
+type StatusSink interface {
+	// RecordStatus records the status of a step
+	RecordStatus(status Status) error
+	// Close releases the connections held by the sink
+	Close() error
+}
+
+// NoopStatusSink discards every status. It is used when status reporting
+// isn't configured.
+type NoopStatusSink struct{}
+
+// RecordStatus discards the status
+func (NoopStatusSink) RecordStatus(status Status) error {
+	return nil
+}
+
+// Close does nothing
+func (NoopStatusSink) Close() error {
+	return nil
+}
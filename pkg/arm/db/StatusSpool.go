@@ -0,0 +1,197 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The lock of a spool is held while it is read or written. Locks older than
+// spoolLockStaleAfter are left by a mixin that was killed and are removed.
+const (
+	spoolLockTimeout    = 30 * time.Second
+	spoolLockRetry      = 100 * time.Millisecond
+	spoolLockStaleAfter = 10 * time.Minute
+)
+
+// SpooledStatus is a status that couldn't be delivered to its destination
+type SpooledStatus struct {
+	// Destination identifies the sink the status is delivered to. It must not
+	// hold secrets, the connection details are read again when replaying.
+	Destination string `json:"destination"`
+	Status      Status `json:"status"`
+}
+
+// StatusSpool is a file of JSON lines holding the statuses that couldn't be
+// delivered, oldest first, until they are replayed
+type StatusSpool struct {
+	path string
+}
+
+// NewStatusSpool returns the spool kept in the file
+func NewStatusSpool(path string) *StatusSpool {
+	return &StatusSpool{path: path}
+}
+
+// Path returns the file of the spool
+func (spool *StatusSpool) Path() string {
+	return spool.path
+}
+
+// Append adds the status to the end of the spool
+func (spool *StatusSpool) Append(destination string, status Status) error {
+	line, err := json.Marshal(SpooledStatus{Destination: destination, Status: status})
+	if err != nil {
+		return fmt.Errorf("error encoding status: %s", err)
+	}
+
+	unlock, err := spool.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	file, err := os.OpenFile(spool.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening status spool: %s", err)
+	}
+	defer file.Close()
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("error writing status spool: %s", err)
+	}
+	return nil
+}
+
+// Pending returns the number of statuses in the spool
+func (spool *StatusSpool) Pending() (int, error) {
+	unlock, err := spool.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	entries, err := spool.read()
+	return len(entries), err
+}
+
+// Flush delivers the spooled statuses in order and removes them from the
+// spool. It stops at the first status that can't be delivered, so that
+// statuses are never delivered out of order, and returns the number of
+// statuses delivered and left in the spool.
+func (spool *StatusSpool) Flush(deliver func(SpooledStatus) error) (int, int, error) {
+	unlock, err := spool.lock()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer unlock()
+
+	entries, err := spool.read()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	delivered := 0
+	var deliverErr error
+	for _, entry := range entries {
+		if deliverErr = deliver(entry); deliverErr != nil {
+			break
+		}
+		delivered++
+	}
+	remaining := entries[delivered:]
+	if delivered > 0 {
+		if err = spool.write(remaining); err != nil {
+			return delivered, len(remaining), err
+		}
+	}
+	return delivered, len(remaining), deliverErr
+}
+
+// read returns the statuses in the spool
+func (spool *StatusSpool) read() ([]SpooledStatus, error) {
+	data, err := os.ReadFile(spool.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading status spool: %s", err)
+	}
+
+	var entries []SpooledStatus
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry SpooledStatus
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("error decoding line %d of status spool %s: %s", line, spool.path, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// write replaces the statuses in the spool, removing the file when it is
+// empty
+func (spool *StatusSpool) write(entries []SpooledStatus) error {
+	if len(entries) == 0 {
+		if err := os.Remove(spool.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("error removing status spool: %s", err)
+		}
+		return nil
+	}
+
+	var data bytes.Buffer
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("error encoding status: %s", err)
+		}
+		data.Write(append(line, '\n'))
+	}
+	// Write a new file and rename it, so that a crash keeps the old spool
+	tmp := spool.path + ".tmp"
+	if err := os.WriteFile(tmp, data.Bytes(), 0600); err != nil {
+		return fmt.Errorf("error writing status spool: %s", err)
+	}
+	if err := os.Rename(tmp, spool.path); err != nil {
+		return fmt.Errorf("error writing status spool: %s", err)
+	}
+	return nil
+}
+
+// lock takes the lock of the spool, shared by every mixin on the machine,
+// and returns the function releasing it
+func (spool *StatusSpool) lock() (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(spool.path), 0700); err != nil {
+		return nil, fmt.Errorf("error creating status spool directory: %s", err)
+	}
+
+	lockPath := spool.path + ".lock"
+	deadline := time.Now().Add(spoolLockTimeout)
+	for {
+		file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			file.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("error locking status spool: %s", err)
+		}
+		if info, statErr := os.Stat(lockPath); statErr == nil && time.Since(info.ModTime()) > spoolLockStaleAfter {
+			os.Remove(lockPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("error locking status spool: %s is held by another process", lockPath)
+		}
+		time.Sleep(spoolLockRetry)
+	}
+}
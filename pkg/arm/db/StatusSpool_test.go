@@ -0,0 +1,126 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusSpool_Flush(t *testing.T) {
+	spool := NewStatusSpool(filepath.Join(t.TempDir(), "spool", "status-spool.jsonl"))
+
+	// An empty spool has nothing to deliver
+	delivered, pending, err := spool.Flush(func(SpooledStatus) error { return nil })
+	require.NoError(t, err)
+	assert.Equal(t, 0, delivered)
+	assert.Equal(t, 0, pending)
+
+	for _, executionStatus := range []string{"Running", "Retrying", "Succeeded"} {
+		require.NoError(t, spool.Append("mongo:porter/status", Status{ExecutionStatus: executionStatus}))
+	}
+	n, err := spool.Pending()
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	// Delivery stops at the first failure so that the order is kept
+	var statuses []string
+	delivered, pending, err = spool.Flush(func(entry SpooledStatus) error {
+		if entry.Status.ExecutionStatus == "Retrying" {
+			return errors.New("connection refused")
+		}
+		assert.Equal(t, "mongo:porter/status", entry.Destination)
+		statuses = append(statuses, entry.Status.ExecutionStatus)
+		return nil
+	})
+	require.EqualError(t, err, "connection refused")
+	assert.Equal(t, 1, delivered)
+	assert.Equal(t, 2, pending)
+	assert.Equal(t, []string{"Running"}, statuses)
+
+	delivered, pending, err = spool.Flush(func(entry SpooledStatus) error {
+		statuses = append(statuses, entry.Status.ExecutionStatus)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, delivered)
+	assert.Equal(t, 0, pending)
+	assert.Equal(t, []string{"Running", "Retrying", "Succeeded"}, statuses)
+	assert.NoFileExists(t, spool.Path(), "the empty spool should be removed")
+	assert.NoFileExists(t, spool.Path()+".lock", "the lock should be released")
+}
+
+func TestStatusSpool_StaleLock(t *testing.T) {
+	spool := NewStatusSpool(filepath.Join(t.TempDir(), "status-spool.jsonl"))
+	lockPath := spool.Path() + ".lock"
+	require.NoError(t, os.WriteFile(lockPath, nil, 0600))
+	stale := spoolLockStaleAfter * 2
+	staleTime := time.Now().Add(-stale)
+	require.NoError(t, os.Chtimes(lockPath, staleTime, staleTime))
+
+	require.NoError(t, spool.Append("file", Status{ExecutionStatus: "Running"}))
+	n, err := spool.Pending()
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+// failingStatusSink fails to record statuses until it is repaired
+type failingStatusSink struct {
+	MemoryStatusSink
+	failing bool
+}
+
+func (sink *failingStatusSink) RecordStatus(status Status) error {
+	if sink.failing {
+		return errors.New("connection refused")
+	}
+	return sink.MemoryStatusSink.RecordStatus(status)
+}
+
+func TestSpoolingStatusSink_RecordStatus(t *testing.T) {
+	spool := NewStatusSpool(filepath.Join(t.TempDir(), "status-spool.jsonl"))
+	inner := &failingStatusSink{}
+	sink := NewSpoolingStatusSink(inner, "webhook", spool, false)
+
+	require.NoError(t, sink.RecordStatus(Status{ExecutionStatus: "Running"}))
+	assert.False(t, sink.Spooling())
+
+	inner.failing = true
+	err := sink.RecordStatus(Status{ExecutionStatus: "Retrying"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "the status is spooled to "+spool.Path())
+	assert.True(t, sink.Spooling())
+
+	// Later statuses are spooled behind the failed one, even when the sink
+	// recovers
+	inner.failing = false
+	require.NoError(t, sink.RecordStatus(Status{ExecutionStatus: "Succeeded"}))
+	assert.Len(t, inner.Statuses(), 1)
+
+	var spooled []string
+	_, _, err = spool.Flush(func(entry SpooledStatus) error {
+		assert.Equal(t, "webhook", entry.Destination)
+		spooled = append(spooled, entry.Status.ExecutionStatus)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Retrying", "Succeeded"}, spooled)
+
+	require.NoError(t, sink.Close())
+	assert.True(t, inner.Closed())
+}
+
+func TestSpoolingStatusSink_Unavailable(t *testing.T) {
+	spool := NewStatusSpool(filepath.Join(t.TempDir(), "status-spool.jsonl"))
+	sink := NewSpoolingStatusSink(nil, "mongo:porter/status", spool, false)
+
+	require.NoError(t, sink.RecordStatus(Status{ExecutionStatus: "Running"}))
+	n, err := spool.Pending()
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.NoError(t, sink.Close())
+}
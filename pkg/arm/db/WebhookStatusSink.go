@@ -0,0 +1,101 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// cloudEventsContentType is the content type of a CloudEvent in the
+	// structured content mode
+	cloudEventsContentType = "application/cloudevents+json"
+	// StatusEventType is the CloudEvents type of a status event
+	StatusEventType = "sh.porter.mixin.arm.status"
+	// StatusEventSource is the CloudEvents source of a status event
+	StatusEventSource = "/porter/mixins/arm"
+	// webhookTimeout bounds how long a status can delay the deployment
+	webhookTimeout = 10 * time.Second
+)
+
+// CloudEvent is a CloudEvents 1.0 event in the structured JSON format
+type CloudEvent struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Subject         string    `json:"subject,omitempty"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	Data            Status    `json:"data"`
+}
+
+// WebhookStatusSink posts every status as a CloudEvent to an HTTP endpoint
+type WebhookStatusSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+// NewWebhookStatusSink returns a sink that posts statuses to the URL with the
+// headers, e.g. to authenticate with the endpoint
+func NewWebhookStatusSink(url string, headers map[string]string) *WebhookStatusSink {
+	return &WebhookStatusSink{
+		url:     url,
+		headers: headers,
+		client:  &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+// RecordStatus posts the status and fails unless the endpoint accepts it. The
+// id of the event is the id of the status, so that the endpoint can drop a
+// status delivered again from the spool.
+func (sink *WebhookStatusSink) RecordStatus(status Status) error {
+	eventID := status.StatusId
+	if eventID == "" {
+		eventID = uuid.NewString()
+	}
+	event := CloudEvent{
+		SpecVersion:     "1.0",
+		ID:              eventID,
+		Source:          StatusEventSource,
+		Type:            StatusEventType,
+		Subject:         status.ResourceGroupName,
+		Time:            status.StatusReportedOn.UTC(),
+		DataContentType: "application/json",
+		Data:            status,
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("error encoding status event: %s", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, sink.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating status webhook request: %s", err)
+	}
+	req.Header.Set("Content-Type", cloudEventsContentType)
+	for key, value := range sink.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := sink.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error posting status to webhook: %s", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Close does nothing, the sink holds no connection
+func (sink *WebhookStatusSink) Close() error {
+	return nil
+}
@@ -0,0 +1,73 @@
+package db
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookStatusSink_RecordStatus(t *testing.T) {
+	var events []CloudEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, cloudEventsContentType, r.Header.Get("Content-Type"))
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		var event CloudEvent
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+		events = append(events, event)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	sink := NewWebhookStatusSink(server.URL, map[string]string{"Authorization": "Bearer secret"})
+	reportedOn := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, sink.RecordStatus(Status{
+		ResourceGroupName: "test-rg",
+		ExecutionStatus:   "Succeeded",
+		StatusReportedOn:  reportedOn,
+	}))
+
+	require.Len(t, events, 1)
+	event := events[0]
+	assert.Equal(t, "1.0", event.SpecVersion)
+	assert.NotEmpty(t, event.ID)
+	assert.Equal(t, StatusEventSource, event.Source)
+	assert.Equal(t, StatusEventType, event.Type)
+	assert.Equal(t, "test-rg", event.Subject)
+	assert.Equal(t, reportedOn, event.Time)
+	assert.Equal(t, "Succeeded", event.Data.ExecutionStatus)
+}
+
+func TestWebhookStatusSink_RecordStatusWithId(t *testing.T) {
+	var eventIDs []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event CloudEvent
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+		eventIDs = append(eventIDs, event.ID)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	// A status delivered again from the spool is sent as the same event
+	sink := NewWebhookStatusSink(server.URL, nil)
+	status := Status{StatusId: "status-id", ExecutionStatus: "Running"}
+	require.NoError(t, sink.RecordStatus(status))
+	require.NoError(t, sink.RecordStatus(status))
+
+	assert.Equal(t, []string{"status-id", "status-id"}, eventIDs)
+}
+
+func TestWebhookStatusSink_RecordStatusRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	err := NewWebhookStatusSink(server.URL, nil).RecordStatus(Status{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "401 Unauthorized")
+}
@@ -0,0 +1,147 @@
+package arm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	arm "get.porter.sh/mixin/arm/pkg/arm/templates"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type DriftAction struct {
+	Steps []InstallStep `yaml:"drift"`
+}
+
+func parseDriftAction(payload []byte) (InstallArguments, error) {
+	var action DriftAction
+	err := yaml.Unmarshal(payload, &action)
+	if err != nil {
+		return InstallArguments{}, err
+	}
+	if len(action.Steps) != 1 {
+		return InstallArguments{}, errors.Errorf("expected a single step, but got %d", len(action.Steps))
+	}
+	step := action.Steps[0]
+	return step.InstallArguments, nil
+}
+
+// Drift compares the resources of an installed deployment with the template
+// and parameters of the step, using an ARM what-if. It prints the added,
+// changed and removed properties and returns an error when anything drifted,
+// so that the command exits with a non-zero code.
+func (m *Mixin) Drift(ctx context.Context) (err error) {
+	ctx, step := m.startPhase(ctx, "", "drift")
+	defer func() { step.end(err) }()
+
+	payload, err := m.getPayloadData()
+	if err != nil {
+		return err
+	}
+
+	driftArguments, err := parseDriftAction(payload)
+	if err != nil {
+		return err
+	}
+	err = validateInstallArguments(driftArguments)
+	if err != nil {
+		return err
+	}
+	pollingDuration := getPollingDuration(driftArguments)
+	correlationId := m.getCorrelationId(driftArguments)
+	step.correlationId = correlationId
+	step.log.SetAttributes(stepAttributes(driftArguments, m.getInstallationMetadata(), correlationId)...)
+	m.trackARMRequests(correlationId, func(request arm.ARMRequest) {
+		m.printARMRequest(correlationId, request)
+	})
+
+	_, phase := m.startPhase(ctx, correlationId, "config")
+	deployerConfig, err := m.getAzureConfig(driftArguments.SubscriptionID, driftArguments.Credential)
+	if phase.end(err) != nil {
+		return err
+	}
+	_, phase = m.startPhase(ctx, correlationId, "auth")
+	deployer, err := m.getARMDeployer(deployerConfig, driftArguments.Credential, pollingDuration)
+	if phase.end(err) != nil {
+		return err
+	}
+	_, phase = m.startPhase(ctx, correlationId, "template")
+	template, err := deployer.FindTemplate(driftArguments.Template)
+	if phase.end(err) != nil {
+		return err
+	}
+
+	fmt.Fprintf(m.Out, "[correlationId: %s] Checking deployment %s for drift...\n", correlationId, driftArguments.Name)
+	drift, err := deployer.DetectDrift(
+		ctx,
+		driftArguments.Name,
+		driftArguments.ResourceGroup,
+		driftArguments.Parameters["location"].(string),
+		template,
+		driftArguments.Parameters,
+	)
+	if err != nil {
+		return err
+	}
+	drift = ignoreInstallationTags(drift)
+
+	if len(drift) == 0 {
+		fmt.Fprintf(m.Out, "[correlationId: %s] No drift detected\n", correlationId)
+		return nil
+	}
+	printDrift(m, drift)
+	return errors.Errorf("drift detected in %d resources of deployment %s", len(drift), driftArguments.Name)
+}
+
+// ignoreInstallationTags drops the drift caused by the installation tags the
+// mixin stamps on resources, since they aren't part of the template and the
+// revision and correlation id change on every run
+func ignoreInstallationTags(drift []arm.ResourceDrift) []arm.ResourceDrift {
+	var filtered []arm.ResourceDrift
+	for _, resource := range drift {
+		if resource.Type != arm.DriftChanged {
+			filtered = append(filtered, resource)
+			continue
+		}
+		var properties []arm.PropertyDrift
+		for _, property := range resource.Properties {
+			if !strings.HasPrefix(property.Path, "tags."+installationTagPrefix) {
+				properties = append(properties, property)
+			}
+		}
+		if len(properties) != 0 {
+			resource.Properties = properties
+			filtered = append(filtered, resource)
+		}
+	}
+	return filtered
+}
+
+// printDrift prints each drifted resource followed by its drifted properties
+func printDrift(m *Mixin, drift []arm.ResourceDrift) {
+	for _, resource := range drift {
+		fmt.Fprintf(m.Out, "%s %s (%s)\n", driftSymbol(resource.Type), resource.ResourceID, resource.Type)
+		for _, property := range resource.Properties {
+			switch property.Type {
+			case arm.DriftAdded:
+				fmt.Fprintf(m.Out, "    %s %s: %v\n", driftSymbol(property.Type), property.Path, property.Actual)
+			case arm.DriftRemoved:
+				fmt.Fprintf(m.Out, "    %s %s: %v\n", driftSymbol(property.Type), property.Path, property.Expected)
+			default:
+				fmt.Fprintf(m.Out, "    %s %s: %v => %v\n", driftSymbol(property.Type), property.Path, property.Expected, property.Actual)
+			}
+		}
+	}
+}
+
+func driftSymbol(driftType arm.DriftType) string {
+	switch driftType {
+	case arm.DriftAdded:
+		return "+"
+	case arm.DriftRemoved:
+		return "-"
+	default:
+		return "~"
+	}
+}
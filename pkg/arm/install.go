@@ -3,14 +3,16 @@ package arm
 import (
 	"context"
 	"fmt"
+	"regexp"
 	"strings"
 
 	"encoding/json"
 
-	"time"
-
 	"get.porter.sh/mixin/arm/pkg/arm/db"
+	arm "get.porter.sh/mixin/arm/pkg/arm/templates"
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -18,6 +20,10 @@ type InstallAction struct {
 	Steps []InstallStep `yaml:"install"`
 }
 
+type UpgradeAction struct {
+	Steps []InstallStep `yaml:"upgrade"`
+}
+
 type InstallStep struct {
 	InstallArguments `yaml:"arm"`
 }
@@ -25,13 +31,22 @@ type InstallStep struct {
 type InstallArguments struct {
 	Step `yaml:",inline"`
 
-	Template      string                 `yaml:"template"`
-	Name          string                 `yaml:"name"`
-	ResourceGroup string                 `yaml:"resourceGroup"`
-	Parameters    map[string]interface{} `yaml:"parameters"`
-	Settings      map[string]interface{} `yaml:"settings"`
+	Template              string                 `yaml:"template"`
+	Name                  string                 `yaml:"name"`
+	SubscriptionID        string                 `yaml:"subscriptionId"`
+	Credential            string                 `yaml:"credential"`
+	ResourceGroup         string                 `yaml:"resourceGroup"`
+	CreateResourceGroup   *bool                  `yaml:"createResourceGroup"`
+	ResourceGroupLocation string                 `yaml:"resourceGroupLocation"`
+	ResourceGroupTags     map[string]string      `yaml:"resourceGroupTags"`
+	Parameters            map[string]interface{} `yaml:"parameters"`
+	Settings              map[string]interface{} `yaml:"settings"`
 }
 
+// credentialAliasPattern matches the credential aliases that can be mapped to
+// AZURE_<ALIAS>_* environment variables
+var credentialAliasPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
 func parseInstallAction(payload []byte) (InstallArguments, error) {
 	var action InstallAction
 	err := yaml.Unmarshal(payload, &action)
@@ -45,6 +60,32 @@ func parseInstallAction(payload []byte) (InstallArguments, error) {
 	return step.InstallArguments, nil
 }
 
+func parseUpgradeAction(payload []byte) (InstallArguments, error) {
+	var action UpgradeAction
+	err := yaml.Unmarshal(payload, &action)
+	if err != nil {
+		return InstallArguments{}, err
+	}
+	if len(action.Steps) != 1 {
+		return InstallArguments{}, errors.Errorf("expected a single step, but got %d", len(action.Steps))
+	}
+	step := action.Steps[0]
+	return step.InstallArguments, nil
+}
+
+// deployMethod deploys a template with a deployer: Deployer.Deploy or
+// Deployer.Update
+type deployMethod func(
+	deployer arm.Deployer,
+	ctx context.Context,
+	deploymentName string,
+	resourceGroupName string,
+	location string,
+	template []byte,
+	armParams map[string]interface{},
+	options arm.DeploymentOptions,
+) (map[string]interface{}, error)
+
 /*
 Install the ARM template
 --------------------------
@@ -53,58 +94,153 @@ Install the ARM template
 3. Get the resource group from the arguments
 4. Get the parameters from the arguments
 5. Get the settings from the arguments
-6. Get the polling duration from the settings
-7. Get the correlation id from the parameters
-8. Create a new mongo repository if Microsoft_StatusDBConnectionString is not empty
-9. Update the status to "Succeeded" in the database
-10. Return nil on success
+6. Get the polling duration and deployment options from the settings
+7. Get the correlation id from the step or the environment, or generate one
+8. Create the status sink selected by the configuration, the failures from here on are reported
+9. Lock the installation when AZURE_INSTALLATION_LEASE is set, cancelling the step if the lock is lost, and report "Running"
+10. Get the deployer and the template, and deploy the template, tracing each phase
+11. Report the "Succeeded" status with the duration and the deployed template, or "Failed" with the cause
+12. Release the lock and return nil on success
 */
 func (m *Mixin) Install(ctx context.Context) error {
-	payload, err := m.getPayloadData()
-	if err != nil {
-		return err
-	}
+	return m.deployStep(ctx, deployAction{
+		name:   "install",
+		parse:  parseInstallAction,
+		deploy: arm.Deployer.Deploy,
+	})
+}
 
-	installArguments, err := parseInstallAction(payload)
+// Upgrade deploys the template of the upgrade step again, like Install does,
+// but through Deployer.Update: the deployment must exist, and it is
+// submitted again even when it succeeded, so that a changed template or
+// changed parameters are applied. With rollbackOnFailure a failed upgrade is
+// rolled back to the last successful deployment recorded in the status
+// database.
+func (m *Mixin) Upgrade(ctx context.Context) error {
+	return m.deployStep(ctx, deployAction{
+		name:                 "upgrade",
+		parse:                parseUpgradeAction,
+		deploy:               arm.Deployer.Update,
+		rollsBackToKnownGood: true,
+	})
+}
+
+// deployAction is an action deploying the template of its step
+type deployAction struct {
+	name string
+	// parse parses the arguments of the step from the payload
+	parse func(payload []byte) (InstallArguments, error)
+	// deploy deploys the template
+	deploy deployMethod
+	// rollsBackToKnownGood rolls a failed deployment back to the last
+	// successful deployment recorded in the status database
+	rollsBackToKnownGood bool
+}
+
+// deployStep deploys the template of the step of the action
+func (m *Mixin) deployStep(ctx context.Context, action deployAction) (err error) {
+	ctx, step := m.startPhase(ctx, "", action.name)
+	defer func() { step.end(err) }()
+
+	_, phase := m.startPhase(ctx, "", "validate")
+	installArguments, err := m.getInstallArguments(action.parse)
 	if err != nil {
+		phase.end(err)
 		return err
 	}
+	correlationId := m.getCorrelationId(installArguments)
+	installation := m.getInstallationMetadata()
+	step.correlationId = correlationId
+	step.log.SetAttributes(stepAttributes(installArguments, installation, correlationId)...)
+
+	// Create the status sink first, so that the step is reported Failed when
+	// it is invalid, its configuration can't be loaded or it isn't locked
+	statusSink := m.getStatusSink(installArguments, correlationId)
+	defer statusSink.Close()
+	// The subscription of the credential is known once the configuration
+	// is loaded
+	subscriptionId := installArguments.SubscriptionID
+	if subscriptionId == "" {
+		subscriptionId = m.cfg.SubscriptionID
+	}
+	status := m.newStatusReporter(ctx, statusSink, installArguments, installation, correlationId, subscriptionId)
 	err = validateInstallArguments(installArguments)
-	if err != nil {
+	if phase.end(err) != nil {
+		status.fail(arm.PhaseValidate, err)
 		return err
 	}
 	pollingDuration := getPollingDuration(installArguments)
-	var correlationId string = ""
-	correlationId = getCorrelationId(installArguments, m, correlationId)
-
-	// Get the arm deployer
-	deployer, err := m.getARMDeployer(pollingDuration)
-	if err != nil {
+	deploymentOptions := getDeploymentOptions(installArguments)
+	deploymentOptions.Tags = installation.tags(correlationId)
+
+	// Get the configuration for the subscription and credential of the step
+	_, phase = m.startPhase(ctx, correlationId, "config")
+	deployerConfig, err := m.getAzureConfig(installArguments.SubscriptionID, installArguments.Credential)
+	if phase.end(err) != nil {
+		status.fail(arm.PhaseAuth, err)
+		return err
+	}
+	status.subscriptionId = deployerConfig.SubscriptionID
+	step.log.SetAttributes(attribute.String(attributeSubscriptionId, deployerConfig.SubscriptionID))
+	// Lock the installation, so that a concurrent run fails instead of
+	// racing this one
+	_, phase = m.startPhase(ctx, correlationId, "lease")
+	ctx, lease, err := m.acquireInstallationLease(ctx, installArguments, installation, correlationId, deployerConfig.SubscriptionID)
+	if phase.end(err) != nil {
+		status.fail(phaseLease, err)
+		return err
+	}
+	defer lease.release()
+	status.ctx = ctx
+	deploymentOptions.Progress = func(state arm.DeploymentState, message string) {
+		status.report(string(state), message)
+	}
+	// Send the correlation id with the ARM requests, and record the ids ARM
+	// gives the requests submitted for the step
+	m.trackARMRequests(correlationId, func(request arm.ARMRequest) {
+		m.printARMRequest(correlationId, request)
+		if request.IsWrite() {
+			status.addRequest(request.RequestID)
+		}
+	})
+	status.report(db.StatusRunning, "")
+
+	// Get the arm deployer, which authenticates with the credential
+	_, phase = m.startPhase(ctx, correlationId, "auth")
+	deployer, err := m.getARMDeployer(deployerConfig, installArguments.Credential, pollingDuration)
+	if phase.end(err) != nil {
+		status.fail(arm.PhaseAuth, err)
 		return err
 	}
 	// Get the Template based on the arguments (type)
+	_, phase = m.startPhase(ctx, correlationId, "template", attribute.String(attributeTemplate, installArguments.Template))
 	template, err := deployer.FindTemplate(installArguments.Template)
-	if err != nil {
+	if phase.end(err) != nil {
+		status.fail(arm.PhaseValidate, err)
 		return err
 	}
-	azureConfig := m.cfg
-	mongoClientHelper, repository, err := createMongoRepository(azureConfig.Microsoft_StatusDBConnectionString, getDatabaseName(installArguments), getCollectionName(installArguments))
-	if err != nil {
-		fmt.Fprintf(m.Out, "[correlationId : %s] Microsoft_StatusDBConnectionString is empty/invalid\n", correlationId)
+
+	if action.rollsBackToKnownGood && deploymentOptions.RollbackOnFailure {
+		deploymentOptions.KnownGood = m.getKnownGoodDeployment(installArguments, correlationId, deployerConfig.SubscriptionID)
 	}
 
 	fmt.Fprintf(m.Out, "[correlationId: %s] Starting deployment operations...\n", correlationId)
 	fmt.Fprintf(m.Out, "[correlationId: %s] Template location %s...\n", correlationId, installArguments.Template)
-	// call Deployer.Deploy(...)
-	outputs, err := deployer.Deploy(
+	// call Deployer.Deploy(...) or Deployer.Update(...)
+	deployCtx, phase := m.startPhase(ctx, correlationId, "deploy")
+	outputs, err := action.deploy(
+		deployer,
+		deployCtx,
 		installArguments.Name,
 		installArguments.ResourceGroup,
 		installArguments.Parameters["location"].(string),
 		template,
 		installArguments.Parameters, // arm params
+		deploymentOptions,
 	)
-	if err != nil {
-		updateStatus(repository, m, "Failed", installArguments, correlationId, err.Error(), azureConfig.SubscriptionID)
+	err = lease.wrapLost(err)
+	if phase.end(err) != nil {
+		status.fail(arm.PhaseDeploy, err)
 		return err
 	}
 	fmt.Fprintf(m.Out, "[correlationId: %s] Finished deployment operations...\n", correlationId)
@@ -112,23 +248,45 @@ func (m *Mixin) Install(ctx context.Context) error {
 	// ARM does some stupid stuff with output keys, turn them
 	// all into upper case for better matching
 	// ToUpper the key because of the case weirdness with ARM outputs
+	_, phase = m.startPhase(ctx, correlationId, "outputs")
 	outputStr := processArmOutput(outputs, installArguments, m, correlationId)
+	phase.end(nil)
 
-	updateStatus(repository, m, "Succeeded", installArguments, correlationId, outputStr, azureConfig.SubscriptionID)
-	if repository != nil {
-		mongoClientHelper.DisconnectMongoClient()
-	}
+	status.succeed(outputStr, template, installArguments.Parameters)
 	return nil
 }
 
-// getCorrelationId gets the correlation id from the parameters
-func getCorrelationId(installArguments InstallArguments, m *Mixin, correlationId string) string {
-	if _, ok := installArguments.Parameters["correlationId"]; !ok {
-		fmt.Fprintln(m.Out, "correlationId is missing in parameters.")
-	} else {
-		correlationId = installArguments.Parameters["correlationId"].(string)
-		delete(installArguments.Parameters, "correlationId")
+// getInstallArguments reads the arguments of the step from the payload. They
+// are validated once the status sink of the step is created.
+func (m *Mixin) getInstallArguments(parseAction func([]byte) (InstallArguments, error)) (InstallArguments, error) {
+	payload, err := m.getPayloadData()
+	if err != nil {
+		return InstallArguments{}, err
+	}
+	return parseAction(payload)
+}
+
+// getCorrelationId returns the correlation id of the step: the correlationId
+// parameter, which isn't an ARM parameter and is removed from them, the
+// correlationId setting, AZURE_CORRELATION_ID, or else a new UUID. A
+// correlationId that isn't a string is ignored, validation rejects it.
+func (m *Mixin) getCorrelationId(installArguments InstallArguments) string {
+	if value, ok := installArguments.Parameters["correlationId"]; ok {
+		if correlationId, isString := value.(string); isString {
+			delete(installArguments.Parameters, "correlationId")
+			if correlationId != "" {
+				return correlationId
+			}
+		}
+	}
+	if correlationId, _ := installArguments.Settings["correlationId"].(string); correlationId != "" {
+		return correlationId
 	}
+	if m.cfg.CorrelationID != "" {
+		return m.cfg.CorrelationID
+	}
+	correlationId := uuid.New().String()
+	fmt.Fprintf(m.Out, "[correlationId: %s] No correlation id was set, generated one\n", correlationId)
 	return correlationId
 }
 
@@ -152,6 +310,40 @@ func validateInstallArguments(installArguments InstallArguments) error {
 	if _, ok := installArguments.Parameters["location"].(string); !ok {
 		return errors.New("location must be a string")
 	}
+	for name, values := range map[string]map[string]interface{}{
+		"parameter": installArguments.Parameters,
+		"setting":   installArguments.Settings,
+	} {
+		if value, ok := values["correlationId"]; ok {
+			if _, isString := value.(string); !isString {
+				return errors.Errorf("the correlationId %s must be a string", name)
+			}
+		}
+	}
+	if installArguments.Credential != "" && !credentialAliasPattern.MatchString(installArguments.Credential) {
+		return errors.Errorf(
+			"credential %s must only contain letters, digits, dashes and underscores",
+			installArguments.Credential,
+		)
+	}
+	if onFailed, ok := installArguments.Settings["onFailedDeployment"]; ok {
+		value, isString := onFailed.(string)
+		if !isString {
+			return errors.New("onFailedDeployment must be a string")
+		}
+		if _, err := arm.ParseOnFailedDeployment(value); err != nil {
+			return err
+		}
+	}
+	if detailLevel, ok := installArguments.Settings["debugDetailLevel"]; ok {
+		value, isString := detailLevel.(string)
+		if !isString {
+			return errors.New("debugDetailLevel must be a string")
+		}
+		if _, err := arm.ParseDebugDetailLevel(value); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -200,6 +392,43 @@ func getPollingDuration(installArguments InstallArguments) int {
 	return pollingDuration
 }
 
+// getDeploymentOptions gets the deployment options from the settings
+func getDeploymentOptions(installArguments InstallArguments) arm.DeploymentOptions {
+	options := arm.DeploymentOptions{
+		OnFailedDeployment:    arm.OnFailedDeploymentError,
+		CreateResourceGroup:   true,
+		ResourceGroupLocation: installArguments.ResourceGroupLocation,
+		ResourceGroupTags:     installArguments.ResourceGroupTags,
+	}
+	if installArguments.CreateResourceGroup != nil {
+		options.CreateResourceGroup = *installArguments.CreateResourceGroup
+	}
+	settings := installArguments.Settings
+	if settings != nil {
+
+		if value, ok := settings["onFailedDeployment"].(string); ok {
+			if onFailed, err := arm.ParseOnFailedDeployment(value); err == nil {
+				options.OnFailedDeployment = onFailed
+			}
+		}
+		if name, ok := settings["rollbackDeploymentName"].(string); ok {
+			options.RollbackDeploymentName = name
+		}
+		if rollback, ok := settings["rollbackOnFailure"].(bool); ok {
+			options.RollbackOnFailure = rollback
+		}
+		if tagResources, ok := settings["tagResources"].(bool); ok {
+			options.TagResources = tagResources
+		}
+		if value, ok := settings["debugDetailLevel"].(string); ok {
+			if detailLevel, err := arm.ParseDebugDetailLevel(value); err == nil {
+				options.DebugDetailLevel = detailLevel
+			}
+		}
+	}
+	return options
+}
+
 // getDatabaseName gets the database name from the settings
 func getDatabaseName(installArguments InstallArguments) string {
 	var databaseName string = "porter"
@@ -225,49 +454,3 @@ func getCollectionName(installArguments InstallArguments) string {
 	}
 	return collectionName
 }
-
-// createMongoRepository creates a new mongo repository
-func createMongoRepository(connectionStr string, databaseName string, collectionName string) (*db.MongoClientHelper, *db.StatusRepository, error) {
-	if connectionStr == "" {
-		return nil, nil, errors.New("connection string is required")
-	}
-	mongoClientHelper, err := db.NewMongoClientHelper(connectionStr)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	mongoClient := mongoClientHelper.MongoClient
-
-	configuration := db.MongoConfiguration{
-		MongoClient:    mongoClient,
-		DatabaseName:   databaseName,
-		CollectionName: collectionName,
-	}
-
-	return mongoClientHelper, db.NewStatusRepository(configuration), nil
-}
-
-// updateStatus updates the status of the installation in the database
-func updateStatus(repository *db.StatusRepository, m *Mixin, statusValue string, installArguments InstallArguments, correlationId string, output string, subscriptionId string) {
-	if repository == nil {
-		return
-	}
-	status := db.Status{
-		SubscriptionId:      subscriptionId,
-		ResourceGroupName:   installArguments.ResourceGroup,
-		ItemName:            "arm template",
-		ItemType:            "arm",
-		InstallationName:    installArguments.Template,
-		MixInName:           "arm",
-		IsActive:            true,
-		ExecutionStatus:     statusValue,
-		StatusReportedOn:    time.Now(),
-		CorrelationId:       correlationId,
-		PorterCorrelationId: correlationId,
-		Output:              output,
-	}
-	_, err := repository.RecordStatus(status)
-	if err != nil {
-		fmt.Fprintf(m.Out, "[correlationId : %s] Error while updating status\n", correlationId)
-	}
-}
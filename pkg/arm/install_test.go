@@ -1,9 +1,15 @@
 package arm
 
 import (
+	"context"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"get.porter.sh/mixin/arm/pkg/arm/db"
+	arm "get.porter.sh/mixin/arm/pkg/arm/templates"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	yaml "gopkg.in/yaml.v2"
@@ -65,3 +71,382 @@ func TestMixin_UnmarshalInstallAction_WithAction(t *testing.T) {
 	assert.Equal(t, map[string]interface{}{"pollingDuration": 30}, step.Settings)
 
 }
+
+func TestMixin_GetDeploymentOptions(t *testing.T) {
+	args := InstallArguments{
+		Settings: map[string]interface{}{
+			"onFailedDeployment":     "rollback",
+			"rollbackDeploymentName": "storage-v1",
+			"debugDetailLevel":       "responseContent",
+		},
+	}
+	options := getDeploymentOptions(args)
+	assert.Equal(t, arm.OnFailedDeploymentRollback, options.OnFailedDeployment)
+	assert.Equal(t, "storage-v1", options.RollbackDeploymentName)
+	assert.Equal(t, arm.DebugDetailLevelResponseContent, options.DebugDetailLevel)
+
+	options = getDeploymentOptions(InstallArguments{})
+	assert.Equal(t, arm.OnFailedDeploymentError, options.OnFailedDeployment)
+	assert.True(t, options.CreateResourceGroup)
+	assert.Empty(t, options.DebugDetailLevel)
+}
+
+func TestMixin_GetDeploymentOptions_ResourceGroup(t *testing.T) {
+	b, err := os.ReadFile("testdata/install-input-resource-group.yaml")
+	require.NoError(t, err)
+
+	args, err := parseInstallAction(b)
+	require.NoError(t, err)
+
+	options := getDeploymentOptions(args)
+	assert.False(t, options.CreateResourceGroup)
+	assert.Equal(t, "westeurope", options.ResourceGroupLocation)
+	assert.Equal(t, map[string]string{"owner": "platform-team"}, options.ResourceGroupTags)
+}
+
+func TestMixin_ValidateInstallArguments_OnFailedDeployment(t *testing.T) {
+	args := InstallArguments{
+		Template:      "arm/storage.json",
+		Name:          "test-storage",
+		ResourceGroup: "test-rg",
+		Parameters:    map[string]interface{}{"location": "eastus"},
+		Settings:      map[string]interface{}{"onFailedDeployment": "retry"},
+	}
+	err := validateInstallArguments(args)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid onFailedDeployment "retry"`)
+
+	args.Settings["onFailedDeployment"] = "redeploy"
+	require.NoError(t, validateInstallArguments(args))
+}
+
+func TestMixin_ValidateInstallArguments_DebugDetailLevel(t *testing.T) {
+	args := InstallArguments{
+		Template:      "arm/storage.json",
+		Name:          "test-storage",
+		ResourceGroup: "test-rg",
+		Parameters:    map[string]interface{}{"location": "eastus"},
+		Settings:      map[string]interface{}{"debugDetailLevel": "all"},
+	}
+	err := validateInstallArguments(args)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid debugDetailLevel "all"`)
+
+	args.Settings["debugDetailLevel"] = true
+	assert.EqualError(t, validateInstallArguments(args), "debugDetailLevel must be a string")
+
+	args.Settings["debugDetailLevel"] = "requestContent,responseContent"
+	require.NoError(t, validateInstallArguments(args))
+}
+
+func TestMixin_UnmarshalInstallAction_Credential(t *testing.T) {
+	b, err := os.ReadFile("testdata/install-input-credential.yaml")
+	require.NoError(t, err)
+
+	args, err := parseInstallAction(b)
+	require.NoError(t, err)
+	assert.Equal(t, "00000000-0000-0000-0000-0000000000c0", args.SubscriptionID)
+	assert.Equal(t, "connectivity", args.Credential)
+	require.NoError(t, validateInstallArguments(args))
+
+	args.Credential = "connectivity$"
+	err = validateInstallArguments(args)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "must only contain letters, digits, dashes and underscores")
+}
+
+func TestMixin_GetCorrelationId(t *testing.T) {
+	m := NewTestMixin(t)
+	m.cfg.CorrelationID = "from-environment"
+	args := InstallArguments{
+		Parameters: map[string]interface{}{"location": "eastus", "correlationId": "from-parameter"},
+		Settings:   map[string]interface{}{"correlationId": "from-setting"},
+	}
+	assert.Equal(t, "from-parameter", m.getCorrelationId(args))
+	assert.NotContains(t, args.Parameters, "correlationId", "the correlationId parameter isn't passed to ARM")
+	assert.Equal(t, "from-setting", m.getCorrelationId(args))
+	delete(args.Settings, "correlationId")
+	assert.Equal(t, "from-environment", m.getCorrelationId(args))
+
+	m.cfg.CorrelationID = ""
+	correlationId := m.getCorrelationId(args)
+	_, err := uuid.Parse(correlationId)
+	require.NoError(t, err, "a UUID is generated when no correlation id is set")
+	assert.Contains(t, m.TestContext.GetOutput(), "[correlationId: "+correlationId+"] No correlation id was set, generated one")
+}
+
+func TestMixin_ValidateInstallArguments_CorrelationId(t *testing.T) {
+	args := InstallArguments{
+		Template:      "arm/storage.json",
+		Name:          "test-storage",
+		ResourceGroup: "test-rg",
+		Parameters:    map[string]interface{}{"location": "eastus", "correlationId": 42},
+	}
+	assert.EqualError(t, validateInstallArguments(args), "the correlationId parameter must be a string")
+
+	args.Parameters["correlationId"] = "abc-123"
+	args.Settings = map[string]interface{}{"correlationId": true}
+	assert.EqualError(t, validateInstallArguments(args), "the correlationId setting must be a string")
+}
+
+// testDeployer records the deployments of a step instead of sending them to
+// ARM
+type testDeployer struct {
+	arm.Deployer
+	// template is the template of the steps
+	template []byte
+	// calls are the deploy methods called, with the parameters and the
+	// options they got
+	calls   []string
+	params  []map[string]interface{}
+	options []arm.DeploymentOptions
+}
+
+func (d *testDeployer) FindTemplate(template string) ([]byte, error) {
+	if d.template != nil {
+		return d.template, nil
+	}
+	return []byte(`{"resources":[]}`), nil
+}
+
+func (d *testDeployer) Deploy(ctx context.Context, deploymentName string, resourceGroupName string, location string, template []byte, armParams map[string]interface{}, options arm.DeploymentOptions) (map[string]interface{}, error) {
+	d.calls = append(d.calls, "Deploy")
+	d.params = append(d.params, armParams)
+	d.options = append(d.options, options)
+	return map[string]interface{}{}, nil
+}
+
+func (d *testDeployer) Update(ctx context.Context, deploymentName string, resourceGroupName string, location string, template []byte, armParams map[string]interface{}, options arm.DeploymentOptions) (map[string]interface{}, error) {
+	d.calls = append(d.calls, "Update")
+	d.params = append(d.params, armParams)
+	d.options = append(d.options, options)
+	return map[string]interface{}{}, nil
+}
+
+// newTestDeployer makes the mixin deploy the steps of the default
+// subscription with a testDeployer
+func newTestDeployer(m *TestMixin) *testDeployer {
+	deployer := &testDeployer{}
+	m.cfg.SubscriptionID = "sub"
+	m.deployers = map[deployerKey]arm.Deployer{
+		{subscriptionID: "sub", pollingDuration: 30}: deployer,
+	}
+	return deployer
+}
+
+func TestMixin_Install_Deploys(t *testing.T) {
+	m := NewTestMixin(t)
+	deployer := newTestDeployer(m)
+	m.In = strings.NewReader(`install:
+  - arm:
+      template: arm/storage.json
+      name: storage
+      resourceGroup: test-rg
+      parameters:
+        location: eastus
+        sku: Standard_LRS
+`)
+
+	require.NoError(t, m.Install(context.Background()))
+	assert.Equal(t, []string{"Deploy"}, deployer.calls)
+}
+
+func TestMixin_Upgrade_Updates(t *testing.T) {
+	m := NewTestMixin(t)
+	deployer := newTestDeployer(m)
+	m.In = strings.NewReader(`upgrade:
+  - arm:
+      template: arm/storage.json
+      name: storage
+      resourceGroup: test-rg
+      parameters:
+        location: eastus
+        sku: Premium_LRS
+`)
+
+	require.NoError(t, m.Upgrade(context.Background()))
+	assert.Equal(t, []string{"Update"}, deployer.calls, "an upgrade submits the deployment again, even when it succeeded")
+	assert.Equal(t, "Premium_LRS", deployer.params[0]["sku"])
+}
+
+func TestMixin_Upgrade_ExpectsUpgradeStep(t *testing.T) {
+	m := NewTestMixin(t)
+	deployer := newTestDeployer(m)
+	m.In = strings.NewReader(`install:
+  - arm:
+      template: arm/storage.json
+      name: storage
+      resourceGroup: test-rg
+      parameters:
+        location: eastus
+`)
+
+	err := m.Upgrade(context.Background())
+	assert.EqualError(t, err, "expected a single step, but got 0")
+	assert.Empty(t, deployer.calls)
+}
+
+const testUpgradeWithRollback = `upgrade:
+  - arm:
+      template: arm/storage.json
+      name: storage
+      resourceGroup: test-rg
+      parameters:
+        location: eastus
+        sku: Premium_LRS
+      settings:
+        rollbackOnFailure: true
+`
+
+func TestMixin_Install_RecordsDeployedTemplate(t *testing.T) {
+	m := NewTestMixin(t)
+	deployer := newTestDeployer(m)
+	deployer.template = []byte(`{"parameters":{"password":{"type":"securestring"}},"resources":[]}`)
+	sink := db.NewMemoryStatusSink()
+	m.statusSink = sink
+	m.In = strings.NewReader(`install:
+  - arm:
+      template: arm/storage.json
+      name: storage
+      resourceGroup: test-rg
+      parameters:
+        location: eastus
+        password: secret
+`)
+
+	require.NoError(t, m.Install(context.Background()))
+	statuses := sink.Statuses()
+	require.NotEmpty(t, statuses)
+	succeeded := statuses[len(statuses)-1]
+	assert.Equal(t, db.StatusSucceeded, succeeded.ExecutionStatus)
+	assert.Equal(t, string(deployer.template), succeeded.DeployedTemplate)
+	assert.JSONEq(t, `{"location":"eastus"}`, succeeded.DeployedParameters, "secure parameters aren't recorded")
+	assert.Empty(t, statuses[0].DeployedTemplate, "only a successful deployment is known-good")
+}
+
+func TestMixin_Upgrade_RollsBackToLastSucceededDeployment(t *testing.T) {
+	m := NewTestMixin(t)
+	deployer := newTestDeployer(m)
+	querier := &testStatusQuerier{succeeded: &db.Status{
+		DeployedTemplate:   `{"resources":["known-good"]}`,
+		DeployedParameters: `{"location":"eastus","sku":"Standard_LRS"}`,
+	}}
+	m.statusQuerier = querier
+	m.In = strings.NewReader(testUpgradeWithRollback)
+
+	require.NoError(t, m.Upgrade(context.Background()))
+	assert.Equal(t, []string{"GetLastSucceededDeployment sub/test-rg/storage"}, querier.calls)
+	require.Len(t, deployer.options, 1)
+	assert.Equal(t, &arm.KnownGoodDeployment{
+		Template:   []byte(`{"resources":["known-good"]}`),
+		Parameters: map[string]interface{}{"location": "eastus", "sku": "Standard_LRS"},
+	}, deployer.options[0].KnownGood)
+}
+
+func TestMixin_Upgrade_NoSucceededDeployment(t *testing.T) {
+	m := NewTestMixin(t)
+	deployer := newTestDeployer(m)
+	m.statusQuerier = &testStatusQuerier{}
+	m.In = strings.NewReader(testUpgradeWithRollback)
+
+	require.NoError(t, m.Upgrade(context.Background()))
+	require.Len(t, deployer.options, 1)
+	assert.True(t, deployer.options[0].RollbackOnFailure)
+	assert.Nil(t, deployer.options[0].KnownGood, "ARM rolls back to the last successful deployment in the resource group")
+	assert.Contains(t, m.TestContext.GetOutput(), "Rolling back to the last successful deployment in the resource group on failure: no successful deployment is recorded")
+}
+
+func TestMixin_Install_DoesntQueryKnownGood(t *testing.T) {
+	m := NewTestMixin(t)
+	deployer := newTestDeployer(m)
+	querier := &testStatusQuerier{}
+	m.statusQuerier = querier
+	m.In = strings.NewReader(strings.Replace(testUpgradeWithRollback, "upgrade:", "install:", 1))
+
+	require.NoError(t, m.Install(context.Background()))
+	assert.Empty(t, querier.calls, "a new deployment has no known-good state of its own")
+	assert.Nil(t, deployer.options[0].KnownGood)
+}
+
+func TestMixin_Install_ReportsInvalidStep(t *testing.T) {
+	m := NewTestMixin(t)
+	deployer := newTestDeployer(m)
+	sink := db.NewMemoryStatusSink()
+	m.statusSink = sink
+	m.In = strings.NewReader(`install:
+  - arm:
+      template: arm/storage.json
+      name: storage
+      resourceGroup: test-rg
+`)
+
+	err := m.Install(context.Background())
+	assert.EqualError(t, err, "parameters is required")
+	assert.Empty(t, deployer.calls)
+	statuses := sink.Statuses()
+	require.Len(t, statuses, 1)
+	assert.Equal(t, db.StatusFailed, statuses[0].ExecutionStatus)
+	assert.Equal(t, "storage", statuses[0].ResourceName)
+	require.NotNil(t, statuses[0].Error)
+	assert.Equal(t, arm.PhaseValidate, statuses[0].Error.Phase)
+}
+
+func TestMixin_Install_ReportsInvalidCredential(t *testing.T) {
+	m := NewTestMixin(t)
+	newTestDeployer(m)
+	sink := db.NewMemoryStatusSink()
+	m.statusSink = sink
+	m.In = strings.NewReader(`install:
+  - arm:
+      template: arm/storage.json
+      name: storage
+      resourceGroup: test-rg
+      credential: missing
+      parameters:
+        location: eastus
+`)
+
+	err := m.Install(context.Background())
+	require.Error(t, err)
+	statuses := sink.Statuses()
+	require.Len(t, statuses, 1)
+	assert.Equal(t, db.StatusFailed, statuses[0].ExecutionStatus)
+	require.NotNil(t, statuses[0].Error)
+	assert.Equal(t, arm.PhaseAuth, statuses[0].Error.Phase)
+	assert.Equal(t, err.Error(), statuses[0].Error.Message)
+}
+
+func TestMixin_Install_ReportsLeaseHeld(t *testing.T) {
+	store := db.NewMemoryLeaseStore()
+	require.NoError(t, store.AcquireLease(db.InstallationLease{
+		Key:       "deployment sub/test-rg/storage",
+		Holder:    "runner-1 (pid 42)",
+		Action:    "install",
+		ExpiresOn: time.Now().Add(time.Hour),
+	}))
+	m := NewTestMixin(t)
+	deployer := newTestDeployer(m)
+	m.leaseStore = store
+	m.cfg.InstallationLease = true
+	sink := db.NewMemoryStatusSink()
+	m.statusSink = sink
+	m.In = strings.NewReader(`install:
+  - arm:
+      template: arm/storage.json
+      name: storage
+      resourceGroup: test-rg
+      parameters:
+        location: eastus
+`)
+
+	err := m.Install(context.Background())
+	require.Error(t, err)
+	assert.Empty(t, deployer.calls)
+	statuses := sink.Statuses()
+	require.Len(t, statuses, 1, "the step isn't reported running")
+	assert.Equal(t, db.StatusFailed, statuses[0].ExecutionStatus)
+	assert.Equal(t, "sub", statuses[0].SubscriptionId)
+	require.NotNil(t, statuses[0].Error)
+	assert.Equal(t, phaseLease, statuses[0].Error.Phase)
+	assert.Contains(t, statuses[0].Error.Message, "is locked by runner-1 (pid 42)")
+}
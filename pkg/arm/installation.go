@@ -0,0 +1,77 @@
+package arm
+
+import (
+	"fmt"
+
+	"get.porter.sh/mixin/arm/pkg"
+)
+
+// Environment variables describing the installation that the mixin runs for.
+// The CNAB variables are set by the CNAB runtime in the bundle container.
+// Porter doesn't pass the namespace or the bundle reference, so bundles that
+// want them recorded set these variables from the installation.
+const (
+	envInstallationName      = "CNAB_INSTALLATION_NAME"
+	envInstallationNamespace = "PORTER_INSTALLATION_NAMESPACE"
+	envBundleReference       = "PORTER_BUNDLE_REFERENCE"
+	envBundleName            = "CNAB_BUNDLE_NAME"
+	envBundleVersion         = "CNAB_BUNDLE_VERSION"
+	envRevision              = "CNAB_REVISION"
+	envAction                = "CNAB_ACTION"
+)
+
+// Tags stamped on deployments and resources to link them to the installation
+const (
+	installationTagPrefix = "porter-"
+	tagInstallationName   = installationTagPrefix + "installation"
+	tagNamespace          = installationTagPrefix + "namespace"
+	tagBundleReference    = installationTagPrefix + "bundle"
+	tagRevision           = installationTagPrefix + "revision"
+	tagCorrelationId      = installationTagPrefix + "correlation-id"
+	tagMixinVersion       = installationTagPrefix + "arm-mixin-version"
+)
+
+// installationMetadata describes the Porter installation the mixin runs for
+type installationMetadata struct {
+	Name            string
+	Namespace       string
+	BundleReference string
+	Revision        string
+	Action          string
+}
+
+// getInstallationMetadata reads the installation metadata from the CNAB and
+// Porter environment variables
+func (m *Mixin) getInstallationMetadata() installationMetadata {
+	metadata := installationMetadata{
+		Name:            m.Getenv(envInstallationName),
+		Namespace:       m.Getenv(envInstallationNamespace),
+		BundleReference: m.Getenv(envBundleReference),
+		Revision:        m.Getenv(envRevision),
+		Action:          m.Getenv(envAction),
+	}
+	if metadata.BundleReference == "" && m.Getenv(envBundleName) != "" {
+		metadata.BundleReference = fmt.Sprintf("%s:%s", m.Getenv(envBundleName), m.Getenv(envBundleVersion))
+	}
+	return metadata
+}
+
+// tags returns the tags that link a deployment and its resources to the
+// installation. Empty values are left out.
+func (i installationMetadata) tags(correlationId string) map[string]string {
+	tags := map[string]string{}
+	values := map[string]string{
+		tagInstallationName: i.Name,
+		tagNamespace:        i.Namespace,
+		tagBundleReference:  i.BundleReference,
+		tagRevision:         i.Revision,
+		tagCorrelationId:    correlationId,
+		tagMixinVersion:     pkg.Version,
+	}
+	for key, val := range values {
+		if val != "" {
+			tags[key] = val
+		}
+	}
+	return tags
+}
@@ -0,0 +1,30 @@
+package arm
+
+import (
+	"testing"
+
+	"get.porter.sh/mixin/arm/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMixin_GetInstallationMetadata(t *testing.T) {
+	pkg.Version = "v1.2.3"
+	m := NewTestMixin(t)
+	m.Setenv(envInstallationName, "mysql")
+	m.Setenv(envInstallationNamespace, "dev")
+	m.Setenv(envBundleName, "mysql-bundle")
+	m.Setenv(envBundleVersion, "0.1.0")
+	m.Setenv(envRevision, "01H0REVISION")
+
+	metadata := m.getInstallationMetadata()
+	assert.Equal(t, "mysql-bundle:0.1.0", metadata.BundleReference)
+
+	assert.Equal(t, map[string]string{
+		"porter-installation":      "mysql",
+		"porter-namespace":         "dev",
+		"porter-bundle":            "mysql-bundle:0.1.0",
+		"porter-revision":          "01H0REVISION",
+		"porter-correlation-id":    "abc-123",
+		"porter-arm-mixin-version": "v1.2.3",
+	}, metadata.tags("abc-123"))
+}
@@ -0,0 +1,175 @@
+package arm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"get.porter.sh/mixin/arm/pkg/arm/db"
+	"github.com/pkg/errors"
+)
+
+// defaultInstallationLeaseTTL is the TTL of the installation leases when
+// AZURE_INSTALLATION_LEASE_TTL isn't set
+const defaultInstallationLeaseTTL = 2 * time.Minute
+
+// phaseLease is the phase of the steps failing because the installation
+// can't be locked
+const phaseLease = "lease"
+
+// installationLease is the lease held on an installation while a step
+// deploys it. It is renewed in the background until it is released, and
+// the context of the step is cancelled when it is lost.
+type installationLease struct {
+	store         db.LeaseStore
+	lease         db.InstallationLease
+	ttl           time.Duration
+	m             *Mixin
+	correlationId string
+
+	cancel  context.CancelFunc
+	lost    chan struct{}
+	stop    chan struct{}
+	stopped sync.WaitGroup
+}
+
+// getInstallationLeaseKey returns the key of the lease of the installation,
+// or of the deployment when the installation isn't known
+func getInstallationLeaseKey(installArguments InstallArguments, installation installationMetadata, subscriptionId string) string {
+	if installation.Name != "" {
+		return fmt.Sprintf("installation %s/%s", installation.Namespace, installation.Name)
+	}
+	return fmt.Sprintf("deployment %s/%s/%s", subscriptionId, installArguments.ResourceGroup, installArguments.Name)
+}
+
+// getInstallationLeaseHolder identifies the process holding a lease
+func getInstallationLeaseHolder() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown host"
+	}
+	return fmt.Sprintf("%s (pid %d)", hostname, os.Getpid())
+}
+
+// newLeaseStore returns the store of the leases, the status database
+func (m *Mixin) newLeaseStore(installArguments InstallArguments) (db.LeaseStore, error) {
+	if m.leaseStore != nil {
+		return m.leaseStore, nil
+	}
+	if m.cfg.Microsoft_StatusDBConnectionString == "" {
+		return nil, errors.New("AZURE_INSTALLATION_LEASE needs AZURE_STATUSDB_CONNECTION_STRING")
+	}
+	store, err := db.NewMongoLeaseStore(
+		m.cfg.Microsoft_StatusDBConnectionString,
+		getDatabaseName(installArguments),
+		getCollectionName(installArguments),
+	)
+	return store, errors.Wrap(err, "couldn't connect to the status database")
+}
+
+// acquireInstallationLease acquires the lease of the installation when
+// AZURE_INSTALLATION_LEASE is set, and renews it until it is released. It
+// fails right away when another run holds the lease. The returned context is
+// cancelled when the lease is lost, so that the step stops deploying. The
+// lease is nil and the context unchanged when leases aren't enabled.
+func (m *Mixin) acquireInstallationLease(ctx context.Context, installArguments InstallArguments, installation installationMetadata, correlationId string, subscriptionId string) (context.Context, *installationLease, error) {
+	if !m.cfg.InstallationLease {
+		return ctx, nil, nil
+	}
+	ttl := m.cfg.InstallationLeaseTTL
+	if ttl <= 0 {
+		ttl = defaultInstallationLeaseTTL
+	}
+
+	store, err := m.newLeaseStore(installArguments)
+	if err != nil {
+		return ctx, nil, err
+	}
+	now := time.Now()
+	lease := db.InstallationLease{
+		Key:           getInstallationLeaseKey(installArguments, installation, subscriptionId),
+		Holder:        getInstallationLeaseHolder(),
+		CorrelationId: correlationId,
+		Action:        installation.Action,
+		AcquiredOn:    now,
+		ExpiresOn:     now.Add(ttl),
+	}
+	if err = store.AcquireLease(lease); err != nil {
+		store.Close()
+		return ctx, nil, errors.Wrap(err, "couldn't lock the installation")
+	}
+	fmt.Fprintf(m.Out, "[correlationId: %s] Locked %s until the step completes\n", correlationId, lease.Key)
+
+	ctx, cancel := context.WithCancel(ctx)
+	l := &installationLease{
+		store:         store,
+		lease:         lease,
+		ttl:           ttl,
+		m:             m,
+		correlationId: correlationId,
+		cancel:        cancel,
+		lost:          make(chan struct{}),
+		stop:          make(chan struct{}),
+	}
+	l.stopped.Add(1)
+	go l.heartbeat()
+	return ctx, l, nil
+}
+
+// heartbeat renews the lease three times per TTL, so that a renewal can
+// fail without losing the lease. It stops when the lease is released, or
+// cancels the step when the lease is lost to another run.
+func (l *installationLease) heartbeat() {
+	defer l.stopped.Done()
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			err := l.store.RenewLease(l.lease.Key, l.lease.Holder, time.Now().Add(l.ttl))
+			if err == nil {
+				continue
+			}
+			if errors.Is(err, db.ErrLeaseLost) {
+				fmt.Fprintf(l.m.Err, "[correlationId: %s] ERROR: lost the lock of %s, cancelling the step: %s\n", l.correlationId, l.lease.Key, err)
+				close(l.lost)
+				l.cancel()
+				return
+			}
+			fmt.Fprintf(l.m.Err, "[correlationId: %s] WARNING: couldn't renew the lock of %s: %s\n", l.correlationId, l.lease.Key, err)
+		}
+	}
+}
+
+// release stops renewing the lease and releases it. Releasing a nil lease
+// does nothing.
+func (l *installationLease) release() {
+	if l == nil {
+		return
+	}
+	close(l.stop)
+	l.stopped.Wait()
+	l.cancel()
+	defer l.store.Close()
+	if err := l.store.ReleaseLease(l.lease.Key, l.lease.Holder); err != nil {
+		fmt.Fprintf(l.m.Err, "[correlationId: %s] WARNING: couldn't release the lock of %s: %s\n", l.correlationId, l.lease.Key, err)
+	}
+}
+
+// wrapLost explains the error of a step cancelled because the lease was
+// lost. Other errors, and the errors of a nil lease, are returned as is.
+func (l *installationLease) wrapLost(err error) error {
+	if l == nil || err == nil {
+		return err
+	}
+	select {
+	case <-l.lost:
+		return errors.Wrapf(err, "the step was cancelled because another run took over the lock of %s", l.lease.Key)
+	default:
+		return err
+	}
+}
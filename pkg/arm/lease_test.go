@@ -0,0 +1,144 @@
+package arm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"get.porter.sh/mixin/arm/pkg/arm/db"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetInstallationLeaseKey(t *testing.T) {
+	args := InstallArguments{Name: "mysql-deployment", ResourceGroup: "test-rg"}
+	assert.Equal(t, "installation dev/mysql", getInstallationLeaseKey(args, installationMetadata{Name: "mysql", Namespace: "dev"}, "sub"))
+	assert.Equal(t, "deployment sub/test-rg/mysql-deployment", getInstallationLeaseKey(args, installationMetadata{}, "sub"),
+		"deployments without an installation are locked by their name")
+}
+
+func TestMixin_AcquireInstallationLease_Disabled(t *testing.T) {
+	m := NewTestMixin(t)
+	ctx := context.Background()
+	leaseCtx, lease, err := m.acquireInstallationLease(ctx, InstallArguments{}, installationMetadata{Name: "mysql"}, "correlation-id", "sub")
+	require.NoError(t, err)
+	assert.Nil(t, lease)
+	assert.Equal(t, ctx, leaseCtx)
+	lease.release()
+
+	m.cfg.InstallationLease = true
+	_, _, err = m.acquireInstallationLease(ctx, InstallArguments{}, installationMetadata{Name: "mysql"}, "correlation-id", "sub")
+	assert.EqualError(t, err, "AZURE_INSTALLATION_LEASE needs AZURE_STATUSDB_CONNECTION_STRING")
+}
+
+func TestMixin_AcquireInstallationLease(t *testing.T) {
+	store := db.NewMemoryLeaseStore()
+	m := NewTestMixin(t)
+	m.leaseStore = store
+	m.cfg.InstallationLease = true
+	m.cfg.InstallationLeaseTTL = 30 * time.Millisecond
+	installation := installationMetadata{Name: "mysql", Namespace: "dev", Action: "upgrade"}
+
+	_, lease, err := m.acquireInstallationLease(context.Background(), InstallArguments{}, installation, "correlation-id", "sub")
+	require.NoError(t, err)
+	acquired, ok := store.Lease("installation dev/mysql")
+	require.True(t, ok)
+	assert.Equal(t, "correlation-id", acquired.CorrelationId)
+	assert.Equal(t, "upgrade", acquired.Action)
+
+	time.Sleep(100 * time.Millisecond)
+	renewed, ok := store.Lease("installation dev/mysql")
+	require.True(t, ok)
+	assert.True(t, renewed.ExpiresOn.After(acquired.ExpiresOn), "the lease is renewed while the step runs")
+
+	lease.release()
+	_, ok = store.Lease("installation dev/mysql")
+	assert.False(t, ok, "the lease is released when the step completes")
+	assert.Contains(t, m.TestContext.GetOutput(), "[correlationId: correlation-id] Locked installation dev/mysql until the step completes")
+}
+
+func TestMixin_AcquireInstallationLease_Held(t *testing.T) {
+	store := db.NewMemoryLeaseStore()
+	acquiredOn := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, store.AcquireLease(db.InstallationLease{
+		Key:           "installation dev/mysql",
+		Holder:        "runner-1 (pid 42)",
+		CorrelationId: "other-correlation-id",
+		Action:        "install",
+		AcquiredOn:    acquiredOn,
+		ExpiresOn:     time.Now().Add(time.Hour),
+	}))
+	m := NewTestMixin(t)
+	m.leaseStore = store
+	m.cfg.InstallationLease = true
+
+	_, _, err := m.acquireInstallationLease(context.Background(), InstallArguments{}, installationMetadata{Name: "mysql", Namespace: "dev"}, "correlation-id", "sub")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "couldn't lock the installation: installation dev/mysql is locked by runner-1 (pid 42), "+
+		"running install with the correlation id other-correlation-id since 2024-06-01T12:00:00Z")
+	var held db.LeaseHeldError
+	assert.ErrorAs(t, err, &held)
+}
+
+func TestMixin_AcquireInstallationLease_Expired(t *testing.T) {
+	store := db.NewMemoryLeaseStore()
+	require.NoError(t, store.AcquireLease(db.InstallationLease{
+		Key:       "installation dev/mysql",
+		Holder:    "runner-1 (pid 42)",
+		ExpiresOn: time.Now().Add(-time.Minute),
+	}))
+	m := NewTestMixin(t)
+	m.leaseStore = store
+	m.cfg.InstallationLease = true
+
+	_, lease, err := m.acquireInstallationLease(context.Background(), InstallArguments{}, installationMetadata{Name: "mysql", Namespace: "dev"}, "correlation-id", "sub")
+	require.NoError(t, err, "expired leases are taken over")
+	lease.release()
+}
+
+func TestMixin_AcquireInstallationLease_Lost(t *testing.T) {
+	store := db.NewMemoryLeaseStore()
+	m := NewTestMixin(t)
+	m.leaseStore = store
+	m.cfg.InstallationLease = true
+	m.cfg.InstallationLeaseTTL = 30 * time.Millisecond
+
+	ctx, lease, err := m.acquireInstallationLease(context.Background(), InstallArguments{}, installationMetadata{Name: "mysql", Namespace: "dev"}, "correlation-id", "sub")
+	require.NoError(t, err)
+	// Another run takes over the lease
+	require.NoError(t, store.ReleaseLease(lease.lease.Key, lease.lease.Holder))
+	require.NoError(t, store.AcquireLease(db.InstallationLease{Key: lease.lease.Key, Holder: "runner-2", ExpiresOn: time.Now().Add(time.Hour)}))
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("the step should be cancelled when the lease is lost")
+	}
+	err = lease.wrapLost(ctx.Err())
+	assert.EqualError(t, err, "the step was cancelled because another run took over the lock of installation dev/mysql: context canceled")
+	assert.ErrorIs(t, err, context.Canceled)
+	lease.release()
+	assert.Contains(t, m.TestContext.GetError(), "[correlationId: correlation-id] ERROR: lost the lock of installation dev/mysql, cancelling the step: "+db.ErrLeaseLost.Error())
+	current, ok := store.Lease(lease.lease.Key)
+	require.True(t, ok)
+	assert.Equal(t, "runner-2", current.Holder, "the lease of the other run is kept")
+}
+
+func TestInstallationLease_WrapLost(t *testing.T) {
+	var lease *installationLease
+	assert.EqualError(t, lease.wrapLost(errors.New("deployment has failed")), "deployment has failed")
+
+	store := db.NewMemoryLeaseStore()
+	m := NewTestMixin(t)
+	m.leaseStore = store
+	m.cfg.InstallationLease = true
+	ctx, lease, err := m.acquireInstallationLease(context.Background(), InstallArguments{}, installationMetadata{Name: "mysql", Namespace: "dev"}, "correlation-id", "sub")
+	require.NoError(t, err)
+	assert.EqualError(t, lease.wrapLost(errors.New("deployment has failed")), "deployment has failed",
+		"the errors of a step holding the lease are kept")
+	assert.NoError(t, lease.wrapLost(nil))
+
+	lease.release()
+	assert.Error(t, ctx.Err(), "the context of the step is released with the lease")
+}
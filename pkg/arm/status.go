@@ -0,0 +1,429 @@
+package arm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"get.porter.sh/mixin/arm/pkg/arm/db"
+	arm "get.porter.sh/mixin/arm/pkg/arm/templates"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// The status sinks that can be selected with AZURE_STATUS_SINK
+const (
+	statusSinkMongo   = "mongo"
+	statusSinkFile    = "file"
+	statusSinkWebhook = "webhook"
+	statusSinkNone    = "none"
+)
+
+// getStatusSinkName returns the configured status sink, defaulting to mongo
+// when a connection string is set so that existing bundles keep reporting
+func getStatusSinkName(azureConfig Config) string {
+	if azureConfig.StatusSink != "" {
+		return azureConfig.StatusSink
+	}
+	if azureConfig.Microsoft_StatusDBConnectionString != "" {
+		return statusSinkMongo
+	}
+	return statusSinkNone
+}
+
+// mongoDestinationPrefix starts the destination of the mongo sink, followed
+// by the database and the collection
+const mongoDestinationPrefix = statusSinkMongo + ":"
+
+// getStatusDestination validates the configuration of the status sink and
+// returns the destination of the statuses of the step. The destination
+// doesn't hold secrets, so that it can be kept in the spool and replayed with
+// the configuration of a later run.
+func (m *Mixin) getStatusDestination(installArguments InstallArguments) (string, error) {
+	azureConfig := m.cfg
+	switch sinkName := getStatusSinkName(azureConfig); sinkName {
+	case statusSinkMongo:
+		if azureConfig.Microsoft_StatusDBConnectionString == "" {
+			return "", errors.New("the mongo status sink needs AZURE_STATUSDB_CONNECTION_STRING")
+		}
+		return mongoDestinationPrefix + getDatabaseName(installArguments) + "/" + getCollectionName(installArguments), nil
+	case statusSinkFile:
+		if azureConfig.StatusFile == "" {
+			return "", errors.New("the file status sink needs AZURE_STATUS_FILE")
+		}
+		return sinkName, nil
+	case statusSinkWebhook:
+		if azureConfig.StatusWebhookURL == "" {
+			return "", errors.New("the webhook status sink needs AZURE_STATUS_WEBHOOK_URL")
+		}
+		return sinkName, nil
+	case statusSinkNone:
+		return sinkName, nil
+	default:
+		return "", errors.Errorf(
+			"invalid AZURE_STATUS_SINK %q, expected one of %s, %s, %s or %s",
+			sinkName,
+			statusSinkMongo,
+			statusSinkFile,
+			statusSinkWebhook,
+			statusSinkNone,
+		)
+	}
+}
+
+// openStatusDestination returns the sink of the destination, configured from
+// the current configuration
+func (m *Mixin) openStatusDestination(destination string) (db.StatusSink, error) {
+	azureConfig := m.cfg
+	switch {
+	case strings.HasPrefix(destination, mongoDestinationPrefix):
+		if azureConfig.Microsoft_StatusDBConnectionString == "" {
+			return nil, errors.New("the mongo status sink needs AZURE_STATUSDB_CONNECTION_STRING")
+		}
+		databaseName, collectionName, ok := strings.Cut(strings.TrimPrefix(destination, mongoDestinationPrefix), "/")
+		if !ok {
+			return nil, errors.Errorf("invalid status destination %q", destination)
+		}
+		sink, err := db.NewMongoStatusSink(
+			azureConfig.Microsoft_StatusDBConnectionString,
+			databaseName,
+			collectionName,
+			azureConfig.StatusHistoryTTL,
+		)
+		return sink, errors.Wrap(err, "couldn't connect to the status database")
+	case destination == statusSinkFile:
+		if azureConfig.StatusFile == "" {
+			return nil, errors.New("the file status sink needs AZURE_STATUS_FILE")
+		}
+		return db.NewFileStatusSink(azureConfig.StatusFile)
+	case destination == statusSinkWebhook:
+		if azureConfig.StatusWebhookURL == "" {
+			return nil, errors.New("the webhook status sink needs AZURE_STATUS_WEBHOOK_URL")
+		}
+		return db.NewWebhookStatusSink(azureConfig.StatusWebhookURL, azureConfig.StatusWebhookHeaders), nil
+	case destination == statusSinkNone:
+		return db.NoopStatusSink{}, nil
+	default:
+		return nil, errors.Errorf("invalid status destination %q", destination)
+	}
+}
+
+// newStatusSink returns the status sink selected by the configuration. The
+// database and collection of the mongo sink are step settings.
+func (m *Mixin) newStatusSink(installArguments InstallArguments) (db.StatusSink, error) {
+	if m.statusSink != nil {
+		return m.statusSink, nil
+	}
+
+	destination, err := m.getStatusDestination(installArguments)
+	if err != nil {
+		return nil, err
+	}
+	return m.openStatusDestination(destination)
+}
+
+// getStatusSink returns the configured status sink. Status reporting must
+// not stop a deployment: when the configuration is invalid the reason is
+// printed and statuses are discarded, and statuses that can't be delivered
+// are spooled and replayed by a later run or by arm status flush.
+func (m *Mixin) getStatusSink(installArguments InstallArguments, correlationId string) db.StatusSink {
+	if m.statusSink != nil {
+		return m.statusSink
+	}
+
+	destination, err := m.getStatusDestination(installArguments)
+	if err != nil {
+		fmt.Fprintf(m.Out, "[correlationId: %s] Status reporting is disabled: %s\n", correlationId, err)
+		return db.NoopStatusSink{}
+	}
+	if destination == statusSinkNone {
+		return db.NoopStatusSink{}
+	}
+	// Sensitive fields must never be recorded in clear when a key is set
+	cipher, err := m.getStatusCipher()
+	if err != nil {
+		fmt.Fprintf(m.Out, "[correlationId: %s] Status reporting is disabled: %s\n", correlationId, err)
+		return db.NoopStatusSink{}
+	}
+
+	// Replay the statuses of earlier runs first, so that they are delivered
+	// in order
+	spool := db.NewStatusSpool(m.getStatusSpoolPath())
+	delivered, pending, err := m.replayStatusSpool(spool)
+	if delivered > 0 {
+		fmt.Fprintf(m.Out, "[correlationId: %s] Delivered %d spooled statuses\n", correlationId, delivered)
+	}
+	if err != nil {
+		fmt.Fprintf(m.Out, "[correlationId: %s] %d statuses remain spooled in %s: %s\n", correlationId, pending, spool.Path(), err)
+	}
+
+	sink, err := m.openStatusDestination(destination)
+	if err != nil {
+		fmt.Fprintf(m.Out, "[correlationId: %s] Statuses are spooled to %s until the status sink is available: %s\n", correlationId, spool.Path(), err)
+		sink = nil
+	}
+	spoolingSink := db.NewSpoolingStatusSink(sink, destination, spool, pending > 0)
+	if cipher != nil {
+		// Encrypt before spooling, so that the spool doesn't hold them in clear
+		return db.NewEncryptingStatusSink(spoolingSink, cipher)
+	}
+	return spoolingSink
+}
+
+// getStatusSpoolPath returns the file of the status spool, by default in the
+// home directory so that it is kept between runs on the same machine
+func (m *Mixin) getStatusSpoolPath() string {
+	if m.cfg.StatusSpoolFile != "" {
+		return m.cfg.StatusSpoolFile
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = os.TempDir()
+	}
+	return filepath.Join(home, ".porter", "mixins", "arm", "status-spool.jsonl")
+}
+
+// replayStatusSpool delivers the spooled statuses to their destinations in
+// order, returning the number of statuses delivered and left in the spool.
+// When a key is configured the statuses spooled before it was are encrypted,
+// statuses spooled with a key are already encrypted.
+func (m *Mixin) replayStatusSpool(spool *db.StatusSpool) (int, int, error) {
+	cipher, err := m.getStatusCipher()
+	if err != nil {
+		pending, _ := spool.Pending()
+		return 0, pending, err
+	}
+	sinks := map[string]db.StatusSink{}
+	defer func() {
+		for _, sink := range sinks {
+			sink.Close()
+		}
+	}()
+
+	return spool.Flush(func(entry db.SpooledStatus) error {
+		sink, ok := sinks[entry.Destination]
+		if !ok {
+			var err error
+			if sink, err = m.openStatusDestination(entry.Destination); err != nil {
+				return err
+			}
+			if cipher != nil {
+				sink = db.NewEncryptingStatusSink(sink, cipher)
+			}
+			sinks[entry.Destination] = sink
+		}
+		return sink.RecordStatus(entry.Status)
+	})
+}
+
+// FlushStatusSpool delivers the statuses spooled by earlier runs
+func (m *Mixin) FlushStatusSpool() error {
+	spool := db.NewStatusSpool(m.getStatusSpoolPath())
+	delivered, pending, err := m.replayStatusSpool(spool)
+	fmt.Fprintf(m.Out, "Delivered %d spooled statuses\n", delivered)
+	if err != nil {
+		return errors.Wrapf(err, "%d statuses remain spooled in %s", pending, spool.Path())
+	}
+	return nil
+}
+
+// statusReporter reports the lifecycle of a step to the status sink, from
+// "Running" through any retries or rollback to "Succeeded" or "Failed"
+type statusReporter struct {
+	// ctx is the context of the step, the parent of the spans of the
+	// status writes
+	ctx              context.Context
+	sink             db.StatusSink
+	m                *Mixin
+	installArguments InstallArguments
+	installation     installationMetadata
+	correlationId    string
+	subscriptionId   string
+	startedOn        time.Time
+	// requestIds are the ids ARM gave the requests submitted for the step
+	requestIds []string
+}
+
+// newStatusReporter returns a reporter for a step starting now
+func (m *Mixin) newStatusReporter(
+	ctx context.Context,
+	sink db.StatusSink,
+	installArguments InstallArguments,
+	installation installationMetadata,
+	correlationId string,
+	subscriptionId string,
+) *statusReporter {
+	return &statusReporter{
+		ctx:              ctx,
+		sink:             sink,
+		m:                m,
+		installArguments: installArguments,
+		installation:     installation,
+		correlationId:    correlationId,
+		subscriptionId:   subscriptionId,
+		startedOn:        time.Now(),
+	}
+}
+
+// report records the execution status of the step. Terminal statuses also
+// record when the step completed and how long it took. The output is the
+// step outputs, or a description of the failure or of the intermediate state.
+func (r *statusReporter) report(executionStatus string, output string) {
+	r.record(r.newStatus(executionStatus, output))
+}
+
+// succeed reports that the step succeeded with the outputs. The template and
+// parameters deployed, without the secure ones, are recorded as the
+// known-good state a failed upgrade is rolled back to.
+func (r *statusReporter) succeed(output string, template []byte, armParams map[string]interface{}) {
+	status := r.newStatus(db.StatusSucceeded, output)
+	knownGood, err := arm.NewKnownGoodDeployment(template, armParams)
+	var parameters []byte
+	if err == nil {
+		parameters, err = json.Marshal(knownGood.Parameters)
+	}
+	if err != nil {
+		fmt.Fprintf(r.m.Out, "[correlationId: %s] The deployed template isn't recorded: %s\n", r.correlationId, err)
+	} else {
+		status.DeployedTemplate = string(template)
+		status.DeployedParameters = string(parameters)
+	}
+	r.record(status)
+}
+
+// fail reports that the step failed in the phase, with the details of the
+// ARM error that caused it. The output keeps the message of the error.
+func (r *statusReporter) fail(phase string, err error) {
+	status := r.newStatus(db.StatusFailed, err.Error())
+	status.Error = r.newStatusError(phase, err)
+	r.record(status)
+}
+
+// newStatusError describes the error of the step. Errors of the deployer
+// carry their own phase, which is more precise than the phase of the step.
+func (r *statusReporter) newStatusError(phase string, err error) *db.StatusError {
+	statusErr := &db.StatusError{
+		Message: err.Error(),
+		Step:    r.installArguments.Description,
+		Phase:   phase,
+	}
+	if statusErr.Step == "" {
+		statusErr.Step = r.installArguments.Name
+	}
+	var deploymentErr *arm.DeploymentError
+	if !errors.As(arm.NewDeploymentError(phase, err), &deploymentErr) {
+		return statusErr
+	}
+	statusErr.Phase = deploymentErr.Phase
+	statusErr.RequestId = deploymentErr.RequestID
+	statusErr.CorrelationId = deploymentErr.CorrelationID
+	if armErr := deploymentErr.ARMError; armErr != nil {
+		statusErr.Code = armErr.Code
+		if armErr.Message != "" {
+			statusErr.Message = armErr.Message
+		}
+		statusErr.Target = armErr.Target
+		statusErr.Details = toStatusErrorDetails(armErr.Details)
+	}
+	return statusErr
+}
+
+// toStatusErrorDetails converts the tree of ARM errors
+func toStatusErrorDetails(details []arm.ErrorDetail) []db.StatusErrorDetail {
+	var statusDetails []db.StatusErrorDetail
+	for _, d := range details {
+		statusDetails = append(statusDetails, db.StatusErrorDetail{
+			Code:    d.Code,
+			Message: d.Message,
+			Target:  d.Target,
+			Details: toStatusErrorDetails(d.Details),
+		})
+	}
+	return statusDetails
+}
+
+// newStatus returns the status of the step
+func (r *statusReporter) newStatus(executionStatus string, output string) db.Status {
+	now := time.Now()
+	status := db.Status{
+		StatusId:              uuid.NewString(),
+		SubscriptionId:        r.subscriptionId,
+		ResourceGroupName:     r.installArguments.ResourceGroup,
+		ResourceName:          r.installArguments.Name,
+		ItemName:              r.itemName(),
+		ItemType:              "arm",
+		InstallationName:      r.installationName(),
+		InstallationNameSpace: r.installation.Namespace,
+		CnabRevision:          r.installation.Revision,
+		Action:                r.installation.Action,
+		BundleReference:       r.installation.BundleReference,
+		Template:              r.installArguments.Template,
+		DeploymentName:        r.installArguments.Name,
+		DeploymentId:          r.deploymentId(),
+		SchemaVersion:         db.StatusSchemaVersion,
+		MixInName:             "arm",
+		IsActive:              true,
+		ExecutionStatus:       executionStatus,
+		StatusReportedOn:      now,
+		CorrelationId:         r.correlationId,
+		PorterCorrelationId:   r.correlationId,
+		Output:                output,
+		StartedOn:             r.startedOn,
+		RequestIds:            r.requestIds,
+	}
+	if db.IsTerminalStatus(executionStatus) {
+		status.CompletedOn = &now
+		status.DurationSeconds = now.Sub(r.startedOn).Seconds()
+	}
+	return status
+}
+
+// addRequest records the ARM request id of a request submitted for the step
+// with the statuses reported after it
+func (r *statusReporter) addRequest(requestId string) {
+	if requestId != "" {
+		r.requestIds = append(r.requestIds, requestId)
+	}
+}
+
+// record records the status in the sink, printing the errors
+func (r *statusReporter) record(status db.Status) {
+	_, phase := r.m.startPhase(r.ctx, r.correlationId, "status", attribute.String(attributeExecutionStatus, status.ExecutionStatus))
+	err := phase.end(r.sink.RecordStatus(status))
+	if err != nil {
+		fmt.Fprintf(r.m.Out, "[correlationId : %s] Error while updating status: %s\n", r.correlationId, err)
+	}
+}
+
+// itemName returns the description of the step, which names the item in the
+// bundle
+func (r *statusReporter) itemName() string {
+	if r.installArguments.Description != "" {
+		return r.installArguments.Description
+	}
+	return "arm template"
+}
+
+// installationName returns the name of the Porter installation, or the
+// template when the mixin doesn't run in a CNAB runtime
+func (r *statusReporter) installationName() string {
+	if r.installation.Name != "" {
+		return r.installation.Name
+	}
+	return r.installArguments.Template
+}
+
+// deploymentId returns the resource ID of the ARM deployment of the step
+func (r *statusReporter) deploymentId() string {
+	return fmt.Sprintf(
+		"/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Resources/deployments/%s",
+		r.subscriptionId,
+		r.installArguments.ResourceGroup,
+		r.installArguments.Name,
+	)
+}
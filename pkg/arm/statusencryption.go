@@ -0,0 +1,80 @@
+package arm
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+
+	"get.porter.sh/mixin/arm/pkg/arm/db"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// statusKeyFile is the file of status encryption keys in
+// AZURE_STATUS_ENCRYPTION_KEY_FILE, as JSON or YAML:
+//
+//	{"keyId": "2024-06", "keys": {"2024-06": "<base64>", "2024-01": "<base64>"}}
+//
+// The key with the ID keyId encrypts, and every key decrypts.
+type statusKeyFile struct {
+	KeyID string            `yaml:"keyId"`
+	Keys  map[string]string `yaml:"keys"`
+}
+
+// getStatusCipher returns the cipher of the configured status encryption
+// keys, or nil when no key is configured. The key in
+// AZURE_STATUS_ENCRYPTION_KEY encrypts, otherwise the current key of the
+// key file does.
+func (m *Mixin) getStatusCipher() (*db.StatusCipher, error) {
+	azureConfig := m.cfg
+	keys := map[string][]byte{}
+	var keyID string
+
+	if path := azureConfig.StatusEncryptionKeyFile; path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't read the status encryption key file")
+		}
+		var keyFile statusKeyFile
+		if err = yaml.Unmarshal(data, &keyFile); err != nil {
+			return nil, errors.Wrapf(err, "invalid status encryption key file %s", path)
+		}
+		for id, encoded := range keyFile.Keys {
+			if keys[id], err = decodeStatusEncryptionKey(encoded); err != nil {
+				return nil, errors.Wrapf(err, "invalid status encryption key %q in %s", id, path)
+			}
+		}
+		keyID = keyFile.KeyID
+	}
+
+	if encoded := azureConfig.StatusEncryptionKey; encoded != "" {
+		key, err := decodeStatusEncryptionKey(encoded)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid AZURE_STATUS_ENCRYPTION_KEY")
+		}
+		keyID = azureConfig.StatusEncryptionKeyID
+		if keyID == "" {
+			keyID = getStatusEncryptionKeyFingerprint(key)
+		}
+		keys[keyID] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	return db.NewStatusCipher(keyID, keys)
+}
+
+// decodeStatusEncryptionKey decodes a base64 encryption key
+func decodeStatusEncryptionKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	return key, errors.Wrap(err, "the key must be base64 encoded")
+}
+
+// getStatusEncryptionKeyFingerprint returns the default ID of a key, derived
+// from the key so that it stays the same across runs
+func getStatusEncryptionKeyFingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,129 @@
+package arm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"get.porter.sh/mixin/arm/pkg/arm/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testStatusKeyOld = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	testStatusKeyNew = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+)
+
+func TestMixin_GetStatusCipher(t *testing.T) {
+	m := NewTestMixin(t)
+	cipher, err := m.getStatusCipher()
+	require.NoError(t, err)
+	assert.Nil(t, cipher, "statuses aren't encrypted without a key")
+
+	m.cfg.StatusEncryptionKey = testStatusKeyNew
+	cipher, err = m.getStatusCipher()
+	require.NoError(t, err)
+	encrypted, err := cipher.Encrypt("output", "secret")
+	require.NoError(t, err)
+	key, _ := base64.StdEncoding.DecodeString(testStatusKeyNew)
+	assert.Contains(t, encrypted, "enc:v1:"+getStatusEncryptionKeyFingerprint(key)+":", "the key ID defaults to the fingerprint of the key")
+
+	m.cfg.StatusEncryptionKeyID = "2024-06"
+	cipher, err = m.getStatusCipher()
+	require.NoError(t, err)
+	encrypted, err = cipher.Encrypt("output", "secret")
+	require.NoError(t, err)
+	assert.Contains(t, encrypted, "enc:v1:2024-06:")
+
+	m.cfg.StatusEncryptionKey = "not base64!"
+	_, err = m.getStatusCipher()
+	assert.EqualError(t, err, "invalid AZURE_STATUS_ENCRYPTION_KEY: the key must be base64 encoded: illegal base64 data at input byte 3")
+}
+
+func TestMixin_GetStatusCipher_KeyFile(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keys.yaml")
+	require.NoError(t, os.WriteFile(keyFile, []byte(`keyId: "2024-06"
+keys:
+  "2024-06": `+testStatusKeyNew+`
+  "2024-01": `+testStatusKeyOld+`
+`), 0600))
+
+	oldOnly, err := db.NewStatusCipher("2024-01", map[string][]byte{"2024-01": bytes.Repeat([]byte{1}, 32)})
+	require.NoError(t, err)
+	encryptedWithOldKey, err := oldOnly.EncryptStatus(db.Status{Output: "secret"})
+	require.NoError(t, err)
+
+	m := NewTestMixin(t)
+	m.cfg.StatusEncryptionKeyFile = keyFile
+	cipher, err := m.getStatusCipher()
+	require.NoError(t, err)
+	assert.Equal(t, "secret", db.DecryptStatus(cipher, encryptedWithOldKey).Output, "rotated keys still decrypt")
+	encrypted, err := cipher.Encrypt("output", "secret")
+	require.NoError(t, err)
+	assert.Contains(t, encrypted, "enc:v1:2024-06:", "the current key encrypts")
+
+	m.cfg.StatusEncryptionKeyFile = filepath.Join(t.TempDir(), "missing.yaml")
+	_, err = m.getStatusCipher()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "couldn't read the status encryption key file")
+}
+
+func TestMixin_GetStatusSink_Encrypts(t *testing.T) {
+	dir := t.TempDir()
+	m := NewTestMixin(t)
+	m.cfg = Config{
+		StatusSink:          statusSinkFile,
+		StatusFile:          filepath.Join(dir, "status.jsonl"),
+		StatusSpoolFile:     filepath.Join(dir, "status-spool.jsonl"),
+		StatusEncryptionKey: testStatusKeyNew,
+	}
+
+	sink := m.getStatusSink(InstallArguments{}, "correlation-id")
+	require.IsType(t, &db.EncryptingStatusSink{}, sink)
+	require.NoError(t, sink.RecordStatus(db.Status{CorrelationId: "correlation-id", Output: `{"PASSWORD":"secret"}`}))
+	require.NoError(t, sink.Close())
+
+	status, err := os.ReadFile(m.cfg.StatusFile)
+	require.NoError(t, err)
+	assert.NotContains(t, string(status), "secret")
+	assert.Contains(t, string(status), `"output":"enc:v1:`)
+}
+
+func TestMixin_GetStatusSink_EncryptsSpooledStatuses(t *testing.T) {
+	dir := t.TempDir()
+	m := NewTestMixin(t)
+	m.cfg = Config{
+		StatusSink:          statusSinkFile,
+		StatusFile:          filepath.Join(dir, "status.jsonl"),
+		StatusSpoolFile:     filepath.Join(dir, "status-spool.jsonl"),
+		StatusEncryptionKey: testStatusKeyNew,
+	}
+	// A status spooled by a run without a key is in clear
+	spool := db.NewStatusSpool(m.cfg.StatusSpoolFile)
+	require.NoError(t, spool.Append(statusSinkFile, db.Status{CorrelationId: "earlier", Output: `{"PASSWORD":"secret"}`}))
+
+	sink := m.getStatusSink(InstallArguments{}, "correlation-id")
+	require.NoError(t, sink.Close())
+
+	assert.Contains(t, m.TestContext.GetOutput(), "Delivered 1 spooled statuses")
+	status, err := os.ReadFile(m.cfg.StatusFile)
+	require.NoError(t, err)
+	assert.NotContains(t, string(status), "secret", "spooled statuses are encrypted when they are replayed")
+	assert.Contains(t, string(status), `"output":"enc:v1:`)
+}
+
+func TestMixin_GetStatusSink_InvalidKey(t *testing.T) {
+	m := NewTestMixin(t)
+	m.cfg = Config{
+		StatusSink:          statusSinkFile,
+		StatusFile:          filepath.Join(t.TempDir(), "status.jsonl"),
+		StatusEncryptionKey: base64.StdEncoding.EncodeToString([]byte("too short")),
+	}
+
+	sink := m.getStatusSink(InstallArguments{}, "correlation-id")
+	assert.IsType(t, db.NoopStatusSink{}, sink, "statuses aren't recorded in clear when the key is invalid")
+	assert.Contains(t, m.TestContext.GetOutput(), "[correlationId: correlation-id] Status reporting is disabled")
+}
@@ -0,0 +1,253 @@
+package arm
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"get.porter.sh/mixin/arm/pkg/arm/db"
+	arm "get.porter.sh/mixin/arm/pkg/arm/templates"
+	"get.porter.sh/porter/pkg/printer"
+	"github.com/pkg/errors"
+)
+
+// StatusOptions are the options of the status command
+type StatusOptions struct {
+	printer.PrintOptions
+
+	// CorrelationId shows every status reported for the correlation id
+	CorrelationId string
+	// Installation and Namespace select the statuses of an installation
+	Installation string
+	Namespace    string
+	// SubscriptionId and ResourceGroup select the statuses of the
+	// deployments to a resource group
+	SubscriptionId string
+	ResourceGroup  string
+	// Since and Until bound the time the statuses were reported. They are
+	// either a duration before now, like 24h, or a RFC 3339 time or date.
+	Since string
+	Until string
+	// Latest shows only the newest status of each installation
+	Latest bool
+	Skip   int64
+	Limit  int64
+	// Database and Collection are the database and collection of the status
+	// settings of the steps
+	Database   string
+	Collection string
+}
+
+// Validate checks the output format and that the options can be used
+// together
+func (o *StatusOptions) Validate() error {
+	if err := o.ParseFormat(); err != nil {
+		return err
+	}
+	formats := []printer.Format{printer.FormatPlaintext, printer.FormatJson, printer.FormatYaml}
+	if err := o.PrintOptions.Validate(printer.FormatPlaintext, formats); err != nil {
+		return err
+	}
+	if o.CorrelationId != "" && o.Latest {
+		return errors.New("--correlation-id and --latest can't be used together")
+	}
+	if o.Skip < 0 {
+		return errors.New("--skip must not be negative")
+	}
+	if o.Limit < 0 {
+		return errors.New("--limit must not be negative")
+	}
+	_, err := o.query(time.Now())
+	return err
+}
+
+// query returns the status query of the options
+func (o *StatusOptions) query(now time.Time) (db.StatusQuery, error) {
+	query := db.StatusQuery{
+		InstallationName:      o.Installation,
+		InstallationNamespace: o.Namespace,
+		SubscriptionId:        o.SubscriptionId,
+		ResourceGroupName:     o.ResourceGroup,
+		Skip:                  o.Skip,
+		Limit:                 o.Limit,
+	}
+	var err error
+	if query.ReportedAfter, err = parseStatusTime(o.Since, now); err != nil {
+		return query, errors.Wrap(err, "invalid --since")
+	}
+	if query.ReportedBefore, err = parseStatusTime(o.Until, now); err != nil {
+		return query, errors.Wrap(err, "invalid --until")
+	}
+	return query, nil
+}
+
+// parseStatusTime parses a duration before now, like 24h, or a RFC 3339 time
+// or date. An empty value is the zero time.
+func parseStatusTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.Errorf("%q is neither a duration nor a RFC 3339 time or date", value)
+}
+
+// statusQuerier reads the status history
+type statusQuerier interface {
+	GetHistory(correlationId string) ([]db.Status, error)
+	QueryStatuses(query db.StatusQuery) ([]db.Status, error)
+	GetLatestStatusPerInstallation(query db.StatusQuery) ([]db.Status, error)
+	GetLastSucceededDeployment(subscriptionId string, resourceGroupName string, deploymentName string) (*db.Status, error)
+}
+
+// openStatusQuerier returns the querier of the status database and
+// collection, and a function closing it
+func (m *Mixin) openStatusQuerier(databaseName string, collectionName string) (statusQuerier, func(), error) {
+	if m.statusQuerier != nil {
+		return m.statusQuerier, func() {}, nil
+	}
+	if m.cfg.Microsoft_StatusDBConnectionString == "" {
+		return nil, nil, errors.New("AZURE_STATUSDB_CONNECTION_STRING is not set")
+	}
+	clientHelper, err := db.NewMongoClientHelper(m.cfg.Microsoft_StatusDBConnectionString)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "couldn't connect to the status database")
+	}
+	querier := db.NewStatusRepository(db.MongoConfiguration{
+		MongoClient:    clientHelper.MongoClient,
+		DatabaseName:   databaseName,
+		CollectionName: collectionName,
+		HistoryTTL:     m.cfg.StatusHistoryTTL,
+	})
+	return querier, func() { clientHelper.DisconnectMongoClient() }, nil
+}
+
+// getKnownGoodDeployment returns the last successful deployment of the step
+// recorded in the status database, which a failed upgrade is rolled back to.
+// It returns nil when the status database isn't configured, or doesn't have
+// a usable deployment, so that ARM rolls back to the last successful
+// deployment in the resource group instead.
+func (m *Mixin) getKnownGoodDeployment(installArguments InstallArguments, correlationId string, subscriptionId string) *arm.KnownGoodDeployment {
+	if m.statusQuerier == nil && m.cfg.Microsoft_StatusDBConnectionString == "" {
+		return nil
+	}
+	knownGood, err := m.queryKnownGoodDeployment(installArguments, subscriptionId)
+	if err == nil && knownGood == nil {
+		err = errors.New("no successful deployment is recorded")
+	}
+	if err != nil {
+		fmt.Fprintf(m.Out, "[correlationId: %s] Rolling back to the last successful deployment in the resource group on failure: %s\n", correlationId, err)
+		return nil
+	}
+	return knownGood
+}
+
+// queryKnownGoodDeployment reads the template and parameters of the last
+// Succeeded status of the deployment of the step
+func (m *Mixin) queryKnownGoodDeployment(installArguments InstallArguments, subscriptionId string) (*arm.KnownGoodDeployment, error) {
+	querier, closeQuerier, err := m.openStatusQuerier(getDatabaseName(installArguments), getCollectionName(installArguments))
+	if err != nil {
+		return nil, err
+	}
+	defer closeQuerier()
+	status, err := querier.GetLastSucceededDeployment(subscriptionId, installArguments.ResourceGroup, installArguments.Name)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't query the status database")
+	}
+	if status == nil {
+		return nil, nil
+	}
+
+	cipher, err := m.getStatusCipher()
+	if err != nil {
+		return nil, err
+	}
+	decrypted := db.DecryptStatus(cipher, *status)
+	if decrypted.DeployedParameters == db.EncryptedPlaceholder {
+		return nil, errors.New("the parameters of the last successful deployment can't be decrypted")
+	}
+	var parameters map[string]interface{}
+	if err := json.Unmarshal([]byte(decrypted.DeployedParameters), &parameters); err != nil {
+		return nil, errors.Wrap(err, "invalid parameters of the last successful deployment")
+	}
+	return &arm.KnownGoodDeployment{
+		Template:   []byte(decrypted.DeployedTemplate),
+		Parameters: parameters,
+	}, nil
+}
+
+// getStatuses returns the statuses selected by the options
+func getStatuses(querier statusQuerier, opts StatusOptions) ([]db.Status, error) {
+	if opts.CorrelationId != "" {
+		return querier.GetHistory(opts.CorrelationId)
+	}
+	query, err := opts.query(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if opts.Latest {
+		return querier.GetLatestStatusPerInstallation(query)
+	}
+	return querier.QueryStatuses(query)
+}
+
+// PrintStatus prints the statuses reported to the status database
+func (m *Mixin) PrintStatus(opts StatusOptions) error {
+	if m.statusQuerier == nil && m.cfg.Microsoft_StatusDBConnectionString == "" {
+		return errors.New("the status command needs AZURE_STATUSDB_CONNECTION_STRING")
+	}
+	querier, closeQuerier, err := m.openStatusQuerier(opts.Database, opts.Collection)
+	if err != nil {
+		return err
+	}
+	defer closeQuerier()
+
+	cipher, err := m.getStatusCipher()
+	if err != nil {
+		return err
+	}
+	statuses, err := getStatuses(querier, opts)
+	if err != nil {
+		return errors.Wrap(err, "couldn't query the status database")
+	}
+	// Sensitive fields that can't be decrypted are shown as <encrypted>
+	for i := range statuses {
+		statuses[i] = db.DecryptStatus(cipher, statuses[i])
+	}
+
+	switch opts.Format {
+	case printer.FormatJson:
+		return printer.PrintJson(m.Out, statuses)
+	case printer.FormatYaml:
+		return printer.PrintYaml(m.Out, statuses)
+	default:
+		return printer.PrintTable(m.Out, statuses, func(row interface{}) []string {
+			s := row.(db.Status)
+			return []string{
+				s.StatusReportedOn.Local().Format(time.RFC3339),
+				s.InstallationNameSpace,
+				s.InstallationName,
+				s.Action,
+				s.ExecutionStatus,
+				s.ResourceGroupName,
+				s.DeploymentName,
+				s.CorrelationId,
+				formatStatusDuration(s),
+			}
+		}, "REPORTED", "NAMESPACE", "INSTALLATION", "ACTION", "STATUS", "RESOURCE GROUP", "DEPLOYMENT", "CORRELATION ID", "DURATION")
+	}
+}
+
+// formatStatusDuration returns how long a completed step took
+func formatStatusDuration(s db.Status) string {
+	if s.CompletedOn == nil {
+		return ""
+	}
+	return fmt.Sprint(time.Duration(s.DurationSeconds * float64(time.Second)).Round(time.Second))
+}
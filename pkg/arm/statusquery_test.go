@@ -0,0 +1,119 @@
+package arm
+
+import (
+	"testing"
+	"time"
+
+	"get.porter.sh/mixin/arm/pkg/arm/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testStatusQuerier records the queries of the status command
+type testStatusQuerier struct {
+	calls   []string
+	queries []db.StatusQuery
+	// succeeded is the last Succeeded status of the deployments
+	succeeded *db.Status
+}
+
+func (q *testStatusQuerier) GetHistory(correlationId string) ([]db.Status, error) {
+	q.calls = append(q.calls, "GetHistory "+correlationId)
+	return []db.Status{{CorrelationId: correlationId}}, nil
+}
+
+func (q *testStatusQuerier) QueryStatuses(query db.StatusQuery) ([]db.Status, error) {
+	q.calls = append(q.calls, "QueryStatuses")
+	q.queries = append(q.queries, query)
+	return nil, nil
+}
+
+func (q *testStatusQuerier) GetLatestStatusPerInstallation(query db.StatusQuery) ([]db.Status, error) {
+	q.calls = append(q.calls, "GetLatestStatusPerInstallation")
+	q.queries = append(q.queries, query)
+	return nil, nil
+}
+
+func (q *testStatusQuerier) GetLastSucceededDeployment(subscriptionId string, resourceGroupName string, deploymentName string) (*db.Status, error) {
+	q.calls = append(q.calls, "GetLastSucceededDeployment "+subscriptionId+"/"+resourceGroupName+"/"+deploymentName)
+	return q.succeeded, nil
+}
+
+func TestGetStatuses(t *testing.T) {
+	t.Run("correlation id", func(t *testing.T) {
+		querier := &testStatusQuerier{}
+		statuses, err := getStatuses(querier, StatusOptions{CorrelationId: "abc-123", Installation: "ignored"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"GetHistory abc-123"}, querier.calls)
+		assert.Len(t, statuses, 1)
+	})
+
+	t.Run("installation", func(t *testing.T) {
+		querier := &testStatusQuerier{}
+		_, err := getStatuses(querier, StatusOptions{Installation: "mysql", Namespace: "dev", Since: "24h", Limit: 10})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"QueryStatuses"}, querier.calls)
+		query := querier.queries[0]
+		assert.Equal(t, "mysql", query.InstallationName)
+		assert.Equal(t, "dev", query.InstallationNamespace)
+		assert.Equal(t, int64(10), query.Limit)
+		assert.WithinDuration(t, time.Now().Add(-24*time.Hour), query.ReportedAfter, time.Minute)
+		assert.True(t, query.ReportedBefore.IsZero())
+	})
+
+	t.Run("latest", func(t *testing.T) {
+		querier := &testStatusQuerier{}
+		_, err := getStatuses(querier, StatusOptions{SubscriptionId: "sub", ResourceGroup: "test-rg", Latest: true})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"GetLatestStatusPerInstallation"}, querier.calls)
+		assert.Equal(t, "sub", querier.queries[0].SubscriptionId)
+		assert.Equal(t, "test-rg", querier.queries[0].ResourceGroupName)
+	})
+}
+
+func TestParseStatusTime(t *testing.T) {
+	now := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	testcases := []struct {
+		value   string
+		want    time.Time
+		wantErr string
+	}{
+		{"", time.Time{}, ""},
+		{"2h", now.Add(-2 * time.Hour), ""},
+		{"2024-01-01T06:30:00Z", time.Date(2024, 1, 1, 6, 30, 0, 0, time.UTC), ""},
+		{"2024-01-01", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), ""},
+		{"yesterday", time.Time{}, `"yesterday" is neither a duration nor a RFC 3339 time or date`},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.value, func(t *testing.T) {
+			got, err := parseStatusTime(tc.value, now)
+			if tc.wantErr != "" {
+				require.EqualError(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestStatusOptions_Validate(t *testing.T) {
+	opts := StatusOptions{CorrelationId: "abc-123", Latest: true}
+	assert.EqualError(t, opts.Validate(), "--correlation-id and --latest can't be used together")
+
+	opts = StatusOptions{Limit: -1}
+	assert.EqualError(t, opts.Validate(), "--limit must not be negative")
+
+	opts = StatusOptions{Until: "soon"}
+	assert.EqualError(t, opts.Validate(), `invalid --until: "soon" is neither a duration nor a RFC 3339 time or date`)
+
+	opts = StatusOptions{Installation: "mysql", Since: "24h"}
+	assert.NoError(t, opts.Validate())
+}
+
+func TestMixin_PrintStatus_WithoutConnectionString(t *testing.T) {
+	m := NewTestMixin(t)
+
+	err := m.PrintStatus(StatusOptions{Installation: "mysql"})
+	assert.EqualError(t, err, "the status command needs AZURE_STATUSDB_CONNECTION_STRING")
+}
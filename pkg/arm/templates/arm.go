@@ -6,12 +6,16 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
-	resourcesSDK "github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2017-05-10/resources" // nolint: lll
+	resourcesSDK "github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources" // nolint: lll
+	whatIfSDK "github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-07-01/features"     // nolint: lll
 	"github.com/Azure/go-autorest/autorest"
+	"go.opentelemetry.io/otel/attribute"
 
 	"get.porter.sh/porter/pkg/portercontext"
+	"get.porter.sh/porter/pkg/tracing"
 )
 
 type deploymentStatus string
@@ -29,20 +33,32 @@ const (
 type Deployer interface {
 	FindTemplate(template string) ([]byte, error)
 	Deploy(
+		ctx context.Context,
 		deploymentName string,
 		resourceGroupName string,
 		location string,
 		template []byte,
 		armParams map[string]interface{},
+		options DeploymentOptions,
 	) (map[string]interface{}, error)
 	Update(
+		ctx context.Context,
 		deploymentName string,
 		resourceGroupName string,
 		location string,
 		template []byte,
 		armParams map[string]interface{},
+		options DeploymentOptions,
 	) (map[string]interface{}, error)
-	Delete(deploymentName string, resourceGroupName string) error
+	Delete(ctx context.Context, deploymentName string, resourceGroupName string) error
+	DetectDrift(
+		ctx context.Context,
+		deploymentName string,
+		resourceGroupName string,
+		location string,
+		template []byte,
+		armParams map[string]interface{},
+	) ([]ResourceDrift, error)
 }
 
 // deployer is an ARM-based implementation of the Deployer interface
@@ -50,6 +66,13 @@ type deployer struct {
 	context           *portercontext.Context
 	groupsClient      resourcesSDK.GroupsClient
 	deploymentsClient resourcesSDK.DeploymentsClient
+	whatIfClient      whatIfSDK.DeploymentsClient
+	apiVersionProfile APIVersionProfile
+	// pollingDuration is how long a deployment is polled before giving up,
+	// the PollingDuration of the deployments client. Zero means no limit.
+	pollingDuration time.Duration
+	// pollInterval is how often a deployment is polled
+	pollInterval time.Duration
 }
 
 // NewDeployer returns a new ARM-based implementation of the Deployer interface
@@ -57,11 +80,35 @@ func NewDeployer(
 	context *portercontext.Context,
 	groupsClient resourcesSDK.GroupsClient,
 	deploymentsClient resourcesSDK.DeploymentsClient,
+	apiVersionProfile APIVersionProfile,
 ) Deployer {
+	// What-if is only available from a newer API version, so it gets its own
+	// client configured like the deployments client
+	whatIfClient := whatIfSDK.NewDeploymentsClientWithBaseURI(
+		deploymentsClient.BaseURI,
+		deploymentsClient.SubscriptionID,
+	)
+	whatIfClient.Client = deploymentsClient.Client
+
+	if !apiVersionProfile.isLatest() {
+		groupsClient.RequestInspector = chainPrepareDecorators(
+			groupsClient.RequestInspector,
+			apiVersionProfile.WithAPIVersion(),
+		)
+		deploymentsClient.RequestInspector = chainPrepareDecorators(
+			deploymentsClient.RequestInspector,
+			apiVersionProfile.WithAPIVersion(),
+		)
+	}
+
 	return &deployer{
 		context:           context,
 		groupsClient:      groupsClient,
 		deploymentsClient: deploymentsClient,
+		whatIfClient:      whatIfClient,
+		apiVersionProfile: apiVersionProfile,
+		pollingDuration:   deploymentsClient.PollingDuration,
+		pollInterval:      10 * time.Second,
 	}
 }
 
@@ -69,25 +116,34 @@ func NewDeployer(
 // existence and status of a deployment before choosing to create a new one,
 // poll until success or failure, or return an error.
 func (d *deployer) Deploy(
+	ctx context.Context,
 	deploymentName string,
 	resourceGroupName string,
 	location string,
 	template []byte,
 	armParams map[string]interface{},
-) (map[string]interface{}, error) {
+	options DeploymentOptions,
+) (outputs map[string]interface{}, err error) {
+	ctx, log := tracing.StartSpan(ctx, deploymentAttributes(deploymentName, resourceGroupName)...)
+	defer func() { EndSpan(ctx, log, err) }()
+
+	if err = d.apiVersionProfile.validateOptions(options); err != nil {
+		return nil, NewDeploymentError(PhaseValidate, err)
+	}
 
 	// Get the deployment and its current status
 	deployment, ds, err := d.getDeploymentAndStatus(
+		ctx,
 		deploymentName,
 		resourceGroupName,
 	)
 	if err != nil {
 		return nil, fmt.Errorf(
 			`error deploying "%s" in resource group "%s": error getting `+
-				`deployment: %s`,
+				`deployment: %w`,
 			deploymentName,
 			resourceGroupName,
-			err,
+			NewDeploymentError(PhaseDeploy, err),
 		)
 	}
 
@@ -96,15 +152,18 @@ func (d *deployer) Deploy(
 	case deploymentStatusNotFound:
 		// The deployment wasn't found, which means we are free to proceed with
 		// initiating a new deployment
-		if deployment, err = d.doDeployment(
+		if deployment, err = d.deployWithRollback(
+			ctx,
 			deploymentName,
 			resourceGroupName,
 			location,
 			template,
 			armParams,
+			options,
+			nil,
 		); err != nil {
 			return nil, fmt.Errorf(
-				`error deploying "%s" in resource group "%s": %s`,
+				`error deploying "%s" in resource group "%s": %w`,
 				deploymentName,
 				resourceGroupName,
 				err,
@@ -115,11 +174,12 @@ func (d *deployer) Deploy(
 		// until it completes. The return at the end of the function will return the
 		// deployment's outputs.
 		if deployment, err = d.pollUntilComplete(
+			ctx,
 			deploymentName,
 			resourceGroupName,
 		); err != nil {
 			return nil, fmt.Errorf(
-				`error deploying "%s" in resource group "%s": %s`,
+				`error deploying "%s" in resource group "%s": %w`,
 				deploymentName,
 				resourceGroupName,
 				err,
@@ -130,13 +190,24 @@ func (d *deployer) Deploy(
 		// The return at the end of the function will return the deployment's
 		// outputs.
 	case deploymentStatusFailed:
-		// The deployment exists and has failed already.
-		return nil, fmt.Errorf(
-			`error deploying "%s" in resource group "%s": deployment is in failed `+
-				`state`,
+		// The deployment exists and has failed already. Depending on the options
+		// we either give up or submit it again.
+		if deployment, err = d.redeployFailed(
+			ctx,
 			deploymentName,
 			resourceGroupName,
-		)
+			location,
+			template,
+			armParams,
+			options,
+		); err != nil {
+			return nil, fmt.Errorf(
+				`error deploying "%s" in resource group "%s": %w`,
+				deploymentName,
+				resourceGroupName,
+				err,
+			)
+		}
 	case deploymentStatusUnknown:
 		fallthrough
 	default:
@@ -149,31 +220,42 @@ func (d *deployer) Deploy(
 		)
 	}
 
-	return getOutputs(deployment)
+	outputs, err = getOutputs(deployment)
+	return outputs, NewDeploymentError(PhaseOutputs, err)
 }
 
 // Update idempotently handles ARM deployments. To do this, it checks for the
 // existence and status of a deployment before choosing to update one,
 // poll until success or failure, or return an error.
 func (d *deployer) Update(
+	ctx context.Context,
 	deploymentName string,
 	resourceGroupName string,
 	location string,
 	template []byte,
 	armParams map[string]interface{},
-) (map[string]interface{}, error) {
-	// Get the deployment's current status
+	options DeploymentOptions,
+) (outputs map[string]interface{}, err error) {
+	ctx, log := tracing.StartSpan(ctx, deploymentAttributes(deploymentName, resourceGroupName)...)
+	defer func() { EndSpan(ctx, log, err) }()
+
+	if err = d.apiVersionProfile.validateOptions(options); err != nil {
+		return nil, NewDeploymentError(PhaseValidate, err)
+	}
+
+	// Get the deployment and its current status
 	_, ds, err := d.getDeploymentAndStatus(
+		ctx,
 		deploymentName,
 		resourceGroupName,
 	)
 	if err != nil {
 		return nil, fmt.Errorf(
-			`error deploying "%s" in resource group "%s": error getting `+
-				`deployment: %s`,
+			`error updating "%s" in resource group "%s": error getting `+
+				`deployment: %w`,
 			deploymentName,
 			resourceGroupName,
-			err,
+			NewDeploymentError(PhaseDeploy, err),
 		)
 	}
 
@@ -184,10 +266,10 @@ func (d *deployer) Update(
 		// If we get here, that is a bad thing so we should error.
 
 		return nil, fmt.Errorf(
-			`error updating "%s" in resource group "%s": %s`,
+			`error updating "%s" in resource group "%s": %w`,
 			deploymentName,
 			resourceGroupName,
-			err,
+			NewDeploymentError(PhaseDeploy, errors.New("the deployment doesn't exist, install it first")),
 		)
 	case deploymentStatusRunning:
 		// The deployment exists and is currently running, which means we'll poll
@@ -195,53 +277,73 @@ func (d *deployer) Update(
 		// deployment's outputs.
 
 		deployment, err := d.pollUntilComplete(
+			ctx,
 			deploymentName,
 			resourceGroupName,
 		)
 		if err != nil {
 			return nil, fmt.Errorf(
-				`error deploying "%s" in resource group "%s": %s`,
+				`error updating "%s" in resource group "%s": %w`,
 				deploymentName,
 				resourceGroupName,
 				err,
 			)
 		}
-		return getOutputs(deployment)
+		outputs, err = getOutputs(deployment)
+		return outputs, NewDeploymentError(PhaseOutputs, err)
 
 	case deploymentStatusSucceeded:
 
 		// doDeployment will call deploymentsClient.CreateOrUpdate
-		// and update an existing deployment.
-		deployment, err := d.doDeployment(
+		// and update an existing deployment
+		deployment, err := d.deployWithRollback(
+			ctx,
 			deploymentName,
 			resourceGroupName,
 			location,
 			template,
 			armParams,
+			options,
+			nil,
 		)
 		if err != nil {
 			return nil, fmt.Errorf(
-				`error deploying "%s" in resource group "%s": %s`,
+				`error updating "%s" in resource group "%s": %w`,
 				deploymentName,
 				resourceGroupName,
 				err,
 			)
 		}
-		return getOutputs(deployment)
+		outputs, err = getOutputs(deployment)
+		return outputs, NewDeploymentError(PhaseOutputs, err)
 	case deploymentStatusFailed:
-		// The deployment exists and has failed already.
-		return nil, fmt.Errorf(
-			`error deploying "%s" in resource group "%s": deployment is in failed `+
-				`state`,
+		// The deployment exists and has failed already. Depending on the options
+		// we either give up or submit it again.
+		deployment, err := d.redeployFailed(
+			ctx,
 			deploymentName,
 			resourceGroupName,
+			location,
+			template,
+			armParams,
+			options,
 		)
+		if err != nil {
+			return nil, fmt.Errorf(
+				`error updating "%s" in resource group "%s": %w`,
+				deploymentName,
+				resourceGroupName,
+				err,
+			)
+		}
+		outputs, err = getOutputs(deployment)
+		return outputs, NewDeploymentError(PhaseOutputs, err)
 	case deploymentStatusUnknown:
 		fallthrough
 	default:
 		// Unrecognized state
 		return nil, fmt.Errorf(
-			`error deploying "%s" in resource group "%s": deployment is in an `+
+			`error updating "%s" in resource group "%s": deployment is in an `+
 				`unrecognized state`,
 			deploymentName,
 			resourceGroupName,
@@ -250,11 +352,13 @@ func (d *deployer) Update(
 }
 
 func (d *deployer) Delete(
+	ctx context.Context,
 	deploymentName string,
 	resourceGroupName string,
-) error {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+) (err error) {
+	ctx, log := tracing.StartSpan(ctx, deploymentAttributes(deploymentName, resourceGroupName)...)
+	defer func() { EndSpan(ctx, log, err) }()
+
 	result, err := d.deploymentsClient.Delete(
 		ctx,
 		resourceGroupName,
@@ -288,11 +392,10 @@ func (d *deployer) Delete(
 // given deployment doesn't exist, there isn't one to return. Returning a
 // separate status indicator resolves that problem.)
 func (d *deployer) getDeploymentAndStatus(
+	ctx context.Context,
 	deploymentName string,
 	resourceGroupName string,
 ) (*resourcesSDK.DeploymentExtended, deploymentStatus, error) {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
 	deployment, err := d.deploymentsClient.Get(
 		ctx,
 		resourceGroupName,
@@ -318,80 +421,106 @@ func (d *deployer) getDeploymentAndStatus(
 }
 
 func (d *deployer) doDeployment(
+	ctx context.Context,
 	deploymentName string,
 	resourceGroupName string,
 	location string,
 	armTemplate []byte,
 	armParams map[string]interface{},
+	options DeploymentOptions,
+	onErrorDeployment *resourcesSDK.OnErrorDeployment,
 ) (*resourcesSDK.DeploymentExtended, error) {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	res, err := d.groupsClient.CheckExistence(ctx, resourceGroupName)
+	err := d.ensureResourceGroup(ctx, resourceGroupName, location, options)
 	if err != nil {
-		return nil, fmt.Errorf(
-			"error checking existence of resource group: %s",
-			err,
-		)
-	}
-	if res.StatusCode == http.StatusNotFound {
-		if _, err = d.groupsClient.CreateOrUpdate(
-			ctx,
-			resourceGroupName,
-			resourcesSDK.Group{
-				Name:     &resourceGroupName,
-				Location: &location,
-			},
-		); err != nil {
-			return nil, fmt.Errorf(
-				"error creating resource group: %s",
-				err,
-			)
-		}
+		return nil, NewDeploymentError(PhaseDeploy, err)
 	}
 
 	// Unmarshal the template into a map
 	var armTemplateMap map[string]interface{}
 	err = json.Unmarshal(armTemplate, &armTemplateMap)
 	if err != nil {
-		return nil, fmt.Errorf("error unmarshaling ARM template: %s", err)
+		return nil, NewDeploymentError(PhaseValidate, fmt.Errorf("error unmarshaling ARM template: %w", err))
 	}
-
-	// Deal with the possiiblity that params == nil
-	if armParams == nil {
-		armParams = make(map[string]interface{})
+	if options.TagResources {
+		if err = injectResourceTags(armTemplateMap, options.Tags); err != nil {
+			return nil, NewDeploymentError(PhaseValidate, err)
+		}
 	}
 
-	// Convert a simple map[string]interface{} to the more complex
-	// map[string]map[string]interface{} required by the deployments client
-	armParamsMap := map[string]interface{}{}
-	for key, val := range armParams {
-		armParamsMap[key] = map[string]interface{}{
-			"value": val,
-		}
+	// Tags are added to the deployment by decorating this one request
+	deploymentsClient := d.deploymentsClient
+	// Deployment tags need a newer api-version than the older profiles pin,
+	// so with those only the resources are tagged
+	if len(options.Tags) != 0 && d.apiVersionProfile.isLatest() {
+		deploymentsClient.RequestInspector = chainPrepareDecorators(
+			deploymentsClient.RequestInspector,
+			withDeploymentTags(options.Tags),
+		)
 	}
+
+	armParamsMap := toARMParameters(armParams)
 	// Deploy the template
-	result, err := d.deploymentsClient.CreateOrUpdate(
+	result, err := d.submit(ctx, deploymentsClient, deploymentName, resourceGroupName, resourcesSDK.Deployment{
+		Properties: &resourcesSDK.DeploymentProperties{
+			Template:          &armTemplateMap,
+			Parameters:        &armParamsMap,
+			Mode:              resourcesSDK.Incremental,
+			OnErrorDeployment: onErrorDeployment,
+			DebugSetting:      options.debugSetting(),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d.waitForDeployment(ctx, result, deploymentName, resourceGroupName)
+}
+
+// submit submits the deployment to ARM
+func (d *deployer) submit(
+	ctx context.Context,
+	deploymentsClient resourcesSDK.DeploymentsClient,
+	deploymentName string,
+	resourceGroupName string,
+	deployment resourcesSDK.Deployment,
+) (result resourcesSDK.DeploymentsCreateOrUpdateFuture, err error) {
+	ctx, log := tracing.StartSpanWithName(ctx, "submit", deploymentAttributes(deploymentName, resourceGroupName)...)
+	defer func() { EndSpan(ctx, log, err) }()
+
+	result, err = deploymentsClient.CreateOrUpdate(
 		ctx,
 		resourceGroupName,
 		deploymentName,
-		resourcesSDK.Deployment{
-			Properties: &resourcesSDK.DeploymentProperties{
-				Template:   &armTemplateMap,
-				Parameters: &armParamsMap,
-				Mode:       resourcesSDK.Incremental,
-			},
-		},
+		deployment,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("error submitting ARM template: %s", err)
+		return result, NewDeploymentError(
+			submitPhase(err),
+			fmt.Errorf("error submitting ARM template: %w", err),
+		)
 	}
+	return result, nil
+}
+
+// waitForDeployment polls a submitted deployment until it completes, and
+// returns it. Each request polling ARM is traced as a child of the span of
+// the wait.
+func (d *deployer) waitForDeployment(
+	ctx context.Context,
+	result resourcesSDK.DeploymentsCreateOrUpdateFuture,
+	deploymentName string,
+	resourceGroupName string,
+) (_ *resourcesSDK.DeploymentExtended, err error) {
+	ctx, log := tracing.StartSpanWithName(ctx, "poll", deploymentAttributes(deploymentName, resourceGroupName)...)
+	defer func() { EndSpan(ctx, log, err) }()
 
 	if err = result.WaitForCompletionRef(
 		ctx,
 		d.deploymentsClient.Client,
 	); err != nil {
-		return nil,
-			fmt.Errorf("error while waiting for deployment to complete: %s", err)
+		return nil, NewDeploymentError(
+			PhasePoll,
+			fmt.Errorf("error while waiting for deployment to complete: %w", err),
+		)
 	}
 
 	// Deployment object found via the result doesn't include properties, so we
@@ -402,42 +531,438 @@ func (d *deployer) doDeployment(
 		deploymentName,
 	)
 	if err != nil {
-		return nil, err
+		return nil, NewDeploymentError(PhasePoll, err)
 	}
 
 	return &deployment, nil
 }
 
+// redeployFailed handles a deployment that already exists in a failed state.
+// By default that is an error. Otherwise the deployment is submitted again
+// under the same name, with ARM's onErrorDeployment set when a rollback was
+// requested.
+func (d *deployer) redeployFailed(
+	ctx context.Context,
+	deploymentName string,
+	resourceGroupName string,
+	location string,
+	armTemplate []byte,
+	armParams map[string]interface{},
+	options DeploymentOptions,
+) (*resourcesSDK.DeploymentExtended, error) {
+	var onErrorDeployment *resourcesSDK.OnErrorDeployment
+	switch options.OnFailedDeployment {
+	case OnFailedDeploymentRedeploy:
+	case OnFailedDeploymentRollback:
+		onErrorDeployment = options.onErrorDeployment()
+	default:
+		return nil, NewDeploymentError(PhaseDeploy, errors.New("deployment is in failed state"))
+	}
+	options.progress(
+		DeploymentRetrying,
+		`redeploying failed deployment "%s"`,
+		deploymentName,
+	)
+	return d.deployWithRollback(
+		ctx,
+		deploymentName,
+		resourceGroupName,
+		location,
+		armTemplate,
+		armParams,
+		options,
+		onErrorDeployment,
+	)
+}
+
+// deployWithRollback submits a deployment and, when rollback on failure is
+// enabled, puts the resource group back into its previous known-good state if
+// the deployment fails while running. The known-good state is the one of the
+// options when there is one. Otherwise ARM's onErrorDeployment is used to
+// redeploy the last successful deployment in the resource group. Errors
+// raised before ARM ran the deployment, such as a rejected template, are
+// returned as is.
+func (d *deployer) deployWithRollback(
+	ctx context.Context,
+	deploymentName string,
+	resourceGroupName string,
+	location string,
+	armTemplate []byte,
+	armParams map[string]interface{},
+	options DeploymentOptions,
+	onErrorDeployment *resourcesSDK.OnErrorDeployment,
+) (*resourcesSDK.DeploymentExtended, error) {
+	if !options.RollbackOnFailure {
+		return d.doDeployment(
+			ctx,
+			deploymentName,
+			resourceGroupName,
+			location,
+			armTemplate,
+			armParams,
+			options,
+			onErrorDeployment,
+		)
+	}
+
+	// When ARM doesn't roll back through onErrorDeployment already, the
+	// known-good state is redeployed after a failure
+	var knownGood *KnownGoodDeployment
+	if onErrorDeployment == nil {
+		if options.KnownGood != nil {
+			var err error
+			if knownGood, err = options.KnownGood.withSecureParameters(armParams); err != nil {
+				return nil, NewDeploymentError(
+					PhaseValidate,
+					fmt.Errorf("error preparing the known-good deployment for rollback: %w", err),
+				)
+			}
+		} else {
+			onErrorDeployment = options.onErrorDeployment()
+		}
+	}
+
+	deployment, err := d.doDeployment(
+		ctx,
+		deploymentName,
+		resourceGroupName,
+		location,
+		armTemplate,
+		armParams,
+		options,
+		onErrorDeployment,
+	)
+	if err == nil {
+		return deployment, nil
+	}
+	// Only a deployment that ARM accepted and that failed while running
+	// changed the resource group. When it was rejected, or never submitted,
+	// there is nothing to roll back and ARM didn't start a rollback.
+	var deploymentErr *DeploymentError
+	if !errors.As(err, &deploymentErr) || deploymentErr.Phase != PhasePoll {
+		return nil, err
+	}
+	return nil, d.rollback(
+		ctx,
+		deploymentName,
+		resourceGroupName,
+		location,
+		options,
+		knownGood,
+		err,
+	)
+}
+
+// KnownGoodDeployment is the template and parameters of a successful
+// deployment, kept so that it can be redeployed. The values of the secure
+// parameters aren't kept, they are taken from the parameters of the
+// deployment that failed.
+type KnownGoodDeployment struct {
+	Template   []byte
+	Parameters map[string]interface{}
+}
+
+// NewKnownGoodDeployment returns the known-good state of a successful
+// deployment of the template, without the parameters the template declares
+// as secure
+func NewKnownGoodDeployment(template []byte, armParams map[string]interface{}) (*KnownGoodDeployment, error) {
+	secure, err := getSecureParameterNames(template)
+	if err != nil {
+		return nil, err
+	}
+	parameters := map[string]interface{}{}
+	for name, value := range armParams {
+		if !secure[strings.ToLower(name)] {
+			parameters[name] = value
+		}
+	}
+	return &KnownGoodDeployment{Template: template, Parameters: parameters}, nil
+}
+
+// withSecureParameters returns the known-good deployment with the values of
+// the parameters its template declares as secure taken from the parameters
+// of the failed deployment
+func (k *KnownGoodDeployment) withSecureParameters(armParams map[string]interface{}) (*KnownGoodDeployment, error) {
+	secure, err := getSecureParameterNames(k.Template)
+	if err != nil {
+		return nil, err
+	}
+	parameters := map[string]interface{}{}
+	for name, value := range k.Parameters {
+		parameters[name] = value
+	}
+	for name, value := range armParams {
+		if _, ok := parameters[name]; !ok && secure[strings.ToLower(name)] {
+			parameters[name] = value
+		}
+	}
+	return &KnownGoodDeployment{Template: k.Template, Parameters: parameters}, nil
+}
+
+// getSecureParameterNames returns the names, in lower case, of the
+// parameters the template declares as secure
+func getSecureParameterNames(template []byte) (map[string]bool, error) {
+	var armTemplate map[string]interface{}
+	if err := json.Unmarshal(template, &armTemplate); err != nil {
+		return nil, fmt.Errorf("error unmarshaling ARM template: %w", err)
+	}
+	declarations, _ := armTemplate["parameters"].(map[string]interface{})
+	return secureParameterNames(declarations), nil
+}
+
+// rollback puts the resource group back into its known-good state after a
+// failed deployment and returns a RollbackError describing both the original
+// failure and the outcome of the rollback. Without a known-good deployment the
+// rollback is the one ARM started through onErrorDeployment, and we wait for
+// it to finish.
+func (d *deployer) rollback(
+	ctx context.Context,
+	deploymentName string,
+	resourceGroupName string,
+	location string,
+	options DeploymentOptions,
+	knownGood *KnownGoodDeployment,
+	deployErr error,
+) error {
+	ctx, log := tracing.StartSpanWithName(ctx, "rollback", deploymentAttributes(deploymentName, resourceGroupName)...)
+	rollbackErr := &RollbackError{Err: deployErr}
+	defer func() { EndSpan(ctx, log, rollbackErr.RollbackErr) }()
+	options.progress(
+		DeploymentRollingBack,
+		`rolling back deployment "%s" after it failed: %s`,
+		deploymentName,
+		deployErr,
+	)
+	if knownGood != nil {
+		rollbackErr.RollbackDeploymentName = deploymentName
+		_, rollbackErr.RollbackErr = d.doDeployment(
+			ctx,
+			deploymentName,
+			resourceGroupName,
+			location,
+			knownGood.Template,
+			knownGood.Parameters,
+			options,
+			nil,
+		)
+		return rollbackErr
+	}
+	rollbackErr.RollbackDeploymentName, rollbackErr.RollbackErr =
+		d.pollRollbackUntilComplete(ctx, deploymentName, resourceGroupName)
+	return rollbackErr
+}
+
+// pollRollbackUntilComplete polls a failed deployment until the rollback ARM
+// started through onErrorDeployment succeeds or fails, polling fails, or a
+// timeout is reached. It returns the name of the deployment ARM redeployed.
+func (d *deployer) pollRollbackUntilComplete(
+	ctx context.Context,
+	deploymentName string,
+	resourceGroupName string,
+) (string, error) {
+	ticker := time.NewTicker(d.pollInterval)
+	defer ticker.Stop()
+	timeout, stop := d.pollingTimeout()
+	defer stop()
+	var rollbackName string
+	for {
+		deployment, _, err := d.getDeploymentAndStatus(
+			ctx,
+			deploymentName,
+			resourceGroupName,
+		)
+		if err != nil {
+			return rollbackName, err
+		}
+		if deployment == nil ||
+			deployment.Properties.OnErrorDeployment == nil {
+			return rollbackName, errors.New("ARM did not start a rollback deployment")
+		}
+		onError := deployment.Properties.OnErrorDeployment
+		if onError.DeploymentName != nil {
+			rollbackName = *onError.DeploymentName
+		}
+		if onError.ProvisioningState != nil {
+			switch *onError.ProvisioningState {
+			case "Succeeded":
+				return rollbackName, nil
+			case "Failed", "Canceled":
+				return rollbackName, errors.New("rollback deployment has failed")
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-timeout:
+			return rollbackName,
+				errors.New("timed out waiting for rollback to complete")
+		case <-ctx.Done():
+			return rollbackName, ctx.Err()
+		}
+	}
+}
+
+// ensureResourceGroup creates the resource group when it doesn't exist yet,
+// unless the options turn that off. Identities that may only deploy into an
+// existing group can't check whether it exists, so nothing is looked up in
+// that case. When the group exists already, a location other than the
+// requested one only produces a warning, and the requested tags are merged
+// into the group's tags.
+func (d *deployer) ensureResourceGroup(
+	ctx context.Context,
+	resourceGroupName string,
+	location string,
+	options DeploymentOptions,
+) (err error) {
+	if !options.CreateResourceGroup {
+		return nil
+	}
+	ctx, log := tracing.StartSpanWithName(ctx, "resourceGroup", attribute.String(attributeResourceGroup, resourceGroupName))
+	defer func() { EndSpan(ctx, log, err) }()
+
+	groupLocation := options.ResourceGroupLocation
+	if groupLocation == "" {
+		groupLocation = location
+	}
+
+	res, err := d.groupsClient.CheckExistence(ctx, resourceGroupName)
+	if err != nil {
+		return fmt.Errorf(
+			"error checking existence of resource group: %s",
+			err,
+		)
+	}
+	if res.StatusCode == http.StatusNotFound {
+		if _, err = d.groupsClient.CreateOrUpdate(
+			ctx,
+			resourceGroupName,
+			resourcesSDK.Group{
+				Name:     &resourceGroupName,
+				Location: &groupLocation,
+				Tags:     toTags(options.ResourceGroupTags),
+			},
+		); err != nil {
+			return fmt.Errorf(
+				"error creating resource group: %s",
+				err,
+			)
+		}
+		return nil
+	}
+
+	group, err := d.groupsClient.Get(ctx, resourceGroupName)
+	if err != nil {
+		return fmt.Errorf("error getting resource group: %s", err)
+	}
+	if group.Location != nil &&
+		normalizeLocation(*group.Location) != normalizeLocation(groupLocation) {
+		fmt.Fprintf(
+			d.context.Err,
+			"WARNING: resource group %s is in location %s, not in the requested location %s\n",
+			resourceGroupName,
+			*group.Location,
+			groupLocation,
+		)
+	}
+	if len(options.ResourceGroupTags) == 0 {
+		return nil
+	}
+	tags := group.Tags
+	if tags == nil {
+		tags = map[string]*string{}
+	}
+	for key, val := range toTags(options.ResourceGroupTags) {
+		tags[key] = val
+	}
+	if _, err = d.groupsClient.Update(
+		ctx,
+		resourceGroupName,
+		resourcesSDK.GroupPatchable{
+			Tags: tags,
+		},
+	); err != nil {
+		return fmt.Errorf("error tagging resource group: %s", err)
+	}
+	return nil
+}
+
+// normalizeLocation turns a display name such as "East US" into the name
+// ARM uses, "eastus"
+func normalizeLocation(location string) string {
+	return strings.ToLower(strings.ReplaceAll(location, " ", ""))
+}
+
+// toTags converts tags to the map of pointers used by the SDK
+func toTags(tags map[string]string) map[string]*string {
+	if tags == nil {
+		return nil
+	}
+	sdkTags := make(map[string]*string, len(tags))
+	for key, val := range tags {
+		val := val
+		sdkTags[key] = &val
+	}
+	return sdkTags
+}
+
+// chainPrepareDecorators returns a PrepareDecorator that applies first, when
+// set, and then second. It is used to add behaviour to a client's
+// RequestInspector without dropping the one already configured.
+func chainPrepareDecorators(
+	first autorest.PrepareDecorator,
+	second autorest.PrepareDecorator,
+) autorest.PrepareDecorator {
+	if first == nil {
+		return second
+	}
+	return func(p autorest.Preparer) autorest.Preparer {
+		return second(first(p))
+	}
+}
+
+// toARMParameters converts a simple map[string]interface{} to the more complex
+// map[string]map[string]interface{} required by the deployments client
+func toARMParameters(armParams map[string]interface{}) map[string]interface{} {
+	armParamsMap := map[string]interface{}{}
+	for key, val := range armParams {
+		armParamsMap[key] = map[string]interface{}{
+			"value": val,
+		}
+	}
+	return armParamsMap
+}
+
 // pollUntilComplete polls the status of a deployment periodically until the
 // deployment succeeds or fails, polling fails, or a timeout is reached
 func (d *deployer) pollUntilComplete(
+	ctx context.Context,
 	deploymentName string,
 	resourceGroupName string,
 ) (*resourcesSDK.DeploymentExtended, error) {
-	ticker := time.NewTicker(time.Second * 10)
+	ticker := time.NewTicker(d.pollInterval)
 	defer ticker.Stop()
-	timer := time.NewTimer(time.Minute * 30)
-	defer timer.Stop()
+	timeout, stop := d.pollingTimeout()
+	defer stop()
 	var deployment *resourcesSDK.DeploymentExtended
 	var ds deploymentStatus
 	var err error
 	for {
 		select {
 		case <-ticker.C:
-			if deployment, ds, err = d.getDeploymentAndStatus(
+			if deployment, ds, err = d.poll(
+				ctx,
 				deploymentName,
 				resourceGroupName,
 			); err != nil {
-				return nil, err
+				return nil, NewDeploymentError(PhasePoll, err)
 			}
 			switch ds {
 			case deploymentStatusNotFound:
 				// This is an error. We'd only be polling for status on a deployment
 				// that exists. If it no longer exists, something is very wrong.
-				return nil, errors.New(
-					"error polling deployment status; deployment should exist, but " +
+				return nil, NewDeploymentError(PhasePoll, errors.New(
+					"error polling deployment status; deployment should exist, but "+
 						"does not",
-				)
+				))
 			case deploymentStatusRunning:
 				// Do nothing == continue the loop
 			case deploymentStatusSucceeded:
@@ -445,20 +970,45 @@ func (d *deployer) pollUntilComplete(
 				return deployment, nil
 			case deploymentStatusFailed:
 				// The deployment has failed
-				return nil, errors.New("deployment has failed")
+				return nil, newFailedDeploymentError(deployment)
 			case deploymentStatusUnknown:
 				fallthrough
 			default:
 				// The deployment has entered an unknown state
-				return nil, errors.New("deployment is in an unrecognized state")
+				return nil, NewDeploymentError(PhasePoll, errors.New("deployment is in an unrecognized state"))
 			}
-		case <-timer.C:
+		case <-timeout:
 			// We've reached a timeout
-			return nil, errors.New("timed out waiting for deployment to complete")
+			return nil, NewDeploymentError(PhasePoll, errors.New("timed out waiting for deployment to complete"))
+		case <-ctx.Done():
+			return nil, NewDeploymentError(PhasePoll, ctx.Err())
 		}
 	}
 }
 
+// pollingTimeout returns a channel that receives when the polling duration has
+// elapsed, and a function releasing its timer. Without a polling duration the
+// channel never receives.
+func (d *deployer) pollingTimeout() (<-chan time.Time, func()) {
+	if d.pollingDuration <= 0 {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(d.pollingDuration)
+	return timer.C, func() { timer.Stop() }
+}
+
+// poll gets the status of a deployment, in a span of its own
+func (d *deployer) poll(
+	ctx context.Context,
+	deploymentName string,
+	resourceGroupName string,
+) (_ *resourcesSDK.DeploymentExtended, _ deploymentStatus, err error) {
+	ctx, log := tracing.StartSpanWithName(ctx, "poll", deploymentAttributes(deploymentName, resourceGroupName)...)
+	defer func() { EndSpan(ctx, log, err) }()
+
+	return d.getDeploymentAndStatus(ctx, deploymentName, resourceGroupName)
+}
+
 func getOutputs(
 	deployment *resourcesSDK.DeploymentExtended,
 ) (map[string]interface{}, error) {
@@ -0,0 +1,609 @@
+package templates
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"get.porter.sh/porter/pkg/portercontext"
+	resourcesSDK "github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Submission results of fakeARM
+const (
+	submitSucceeded = "Succeeded"
+	submitFailed    = "Failed"
+	submitRejected  = "Rejected"
+)
+
+// fakeARM serves the resource group and deployment requests of the deployer
+// from memory
+type fakeARM struct {
+	mu sync.Mutex
+	// requests are the requests received, as "METHOD path"
+	requests []string
+	// group is the existing resource group, nil when it doesn't exist
+	group map[string]interface{}
+	// groupForbidden denies access to the resource group
+	groupForbidden bool
+	// deployments are the properties of the existing deployments by name
+	deployments map[string]map[string]interface{}
+	// submissions are the properties of the submitted deployments
+	submissions []map[string]interface{}
+	// results are the results of the next submissions. Submissions succeed
+	// once they are used up.
+	results []string
+	// rollbackState is the state reported for the rollback ARM starts when a
+	// deployment with onErrorDeployment fails. When empty, ARM doesn't start
+	// one.
+	rollbackState string
+	// operations are the results of the asynchronous operations of the
+	// submissions
+	operations []string
+}
+
+func (f *fakeARM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+
+	var body map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&body) // nolint: errcheck
+
+	// subscriptions/sub/resourcegroups/rg/providers/Microsoft.Resources/deployments/name
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "operations":
+		f.serveOperation(w, parts[1])
+	case len(parts) == 4:
+		f.serveGroup(w, r, body)
+	case len(parts) == 8:
+		f.serveDeployment(w, r, parts[7], body)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeARM) serveGroup(w http.ResponseWriter, r *http.Request, body map[string]interface{}) {
+	if f.groupForbidden {
+		writeJSON(w, http.StatusForbidden, armError("AuthorizationFailed", "not authorized"))
+		return
+	}
+	switch r.Method {
+	case http.MethodHead:
+		if f.group == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, f.group)
+	case http.MethodPut:
+		f.group = body
+		writeJSON(w, http.StatusCreated, f.group)
+	case http.MethodPatch:
+		f.group["tags"] = body["tags"]
+		writeJSON(w, http.StatusOK, f.group)
+	}
+}
+
+func (f *fakeARM) serveDeployment(w http.ResponseWriter, r *http.Request, name string, body map[string]interface{}) {
+	switch r.Method {
+	case http.MethodGet:
+		properties, ok := f.deployments[name]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, armError("DeploymentNotFound", "deployment not found"))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"name": name, "properties": properties})
+	case http.MethodPut:
+		submitted, _ := body["properties"].(map[string]interface{})
+		f.submissions = append(f.submissions, submitted)
+		result := submitSucceeded
+		if len(f.results) > 0 {
+			result, f.results = f.results[0], f.results[1:]
+		}
+		if result == submitRejected {
+			writeJSON(w, http.StatusBadRequest, armError("InvalidTemplate", "the template is invalid"))
+			return
+		}
+
+		properties := map[string]interface{}{
+			"provisioningState": result,
+			"parameters":        submitted["parameters"],
+		}
+		if result == submitSucceeded {
+			properties["outputs"] = map[string]interface{}{
+				"name": map[string]interface{}{"type": "String", "value": name},
+			}
+		}
+		if _, ok := submitted["onErrorDeployment"]; ok && result == submitFailed && f.rollbackState != "" {
+			properties["onErrorDeployment"] = map[string]interface{}{
+				"type":              "LastSuccessful",
+				"deploymentName":    "storage-v1",
+				"provisioningState": f.rollbackState,
+			}
+		}
+		if f.deployments == nil {
+			f.deployments = map[string]map[string]interface{}{}
+		}
+		f.deployments[name] = properties
+
+		// ARM accepts the deployment and reports its result through an
+		// asynchronous operation
+		f.operations = append(f.operations, result)
+		w.Header().Set("Azure-AsyncOperation", fmt.Sprintf("http://%s/operations/%d", r.Host, len(f.operations)-1))
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"name":       name,
+			"properties": map[string]interface{}{"provisioningState": "Accepted"},
+		})
+	}
+}
+
+func (f *fakeARM) serveOperation(w http.ResponseWriter, id string) {
+	index, err := strconv.Atoi(id)
+	if err != nil || index >= len(f.operations) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	operation := map[string]interface{}{"status": f.operations[index]}
+	if f.operations[index] == submitFailed {
+		operation["error"] = map[string]interface{}{"code": "DeploymentFailed", "message": "deployment has failed"}
+	}
+	writeJSON(w, http.StatusOK, operation)
+}
+
+// newDeployer returns a deployer sending its requests to the fake, polling
+// every few milliseconds
+func (f *fakeARM) newDeployer(t *testing.T) (*deployer, *portercontext.TestContext) {
+	return newServedDeployer(t, f)
+}
+
+// newServedDeployer returns a deployer sending its requests to the handler,
+// polling every few milliseconds
+func newServedDeployer(t *testing.T, handler http.Handler) (*deployer, *portercontext.TestContext) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	groupsClient := resourcesSDK.NewGroupsClientWithBaseURI(server.URL, "sub")
+	deploymentsClient := resourcesSDK.NewDeploymentsClientWithBaseURI(server.URL, "sub")
+	deploymentsClient.PollingDelay = 10 * time.Millisecond
+	deploymentsClient.PollingDuration = time.Minute
+	ctx := portercontext.NewTestContext(t)
+	d := NewDeployer(ctx.Context, groupsClient, deploymentsClient, LatestAPIVersionProfile).(*deployer)
+	d.pollInterval = 10 * time.Millisecond
+	return d, ctx
+}
+
+// submitted returns the requests that submitted a deployment
+func (f *fakeARM) submitted() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var submitted []string
+	for _, request := range f.requests {
+		if strings.HasPrefix(request, http.MethodPut+" ") && strings.Contains(request, "/deployments/") {
+			submitted = append(submitted, request)
+		}
+	}
+	return submitted
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body) // nolint: errcheck
+}
+
+func armError(code string, message string) map[string]interface{} {
+	return map[string]interface{}{
+		"error": map[string]interface{}{"code": code, "message": message},
+	}
+}
+
+var testTemplate = []byte(`{"resources":[]}`)
+
+func TestDeployer_Update_RollsBackToKnownGoodDeployment(t *testing.T) {
+	arm := &fakeARM{
+		group: map[string]interface{}{"location": "eastus"},
+		deployments: map[string]map[string]interface{}{
+			"storage": {"provisioningState": "Succeeded"},
+		},
+		results: []string{submitFailed},
+	}
+	d, _ := arm.newDeployer(t)
+	knownGood, err := NewKnownGoodDeployment(
+		[]byte(`{"parameters":{"password":{"type":"SecureString"}},"resources":["known-good"]}`),
+		map[string]interface{}{"name": "storage-v1", "password": "old-secret"},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "storage-v1"}, knownGood.Parameters, "secure parameters aren't kept")
+
+	_, err = d.Update(context.Background(), "storage", "rg", "eastus", testTemplate,
+		map[string]interface{}{"name": "storage-v2", "password": "secret"},
+		DeploymentOptions{RollbackOnFailure: true, CreateResourceGroup: true, KnownGood: knownGood},
+	)
+
+	var rollbackErr *RollbackError
+	require.True(t, errors.As(err, &rollbackErr), "expected a rollback error, got %v", err)
+	assert.NoError(t, rollbackErr.RollbackErr)
+	assert.Contains(t, err.Error(), `deployment has failed"; rolled back to deployment "storage"`)
+	require.Len(t, arm.submissions, 2)
+	assert.Nil(t, arm.submissions[0]["onErrorDeployment"], "the deployer rolls back, not ARM")
+	assert.Equal(t, []interface{}{"known-good"}, arm.submissions[1]["template"].(map[string]interface{})["resources"])
+	assert.Equal(t, map[string]interface{}{
+		"name":     map[string]interface{}{"value": "storage-v1"},
+		"password": map[string]interface{}{"value": "secret"},
+	}, arm.submissions[1]["parameters"], "secure parameters are taken from the step")
+}
+
+func TestDeployer_Update_RollsBackWithOnErrorDeployment(t *testing.T) {
+	// Without a known-good deployment ARM redeploys the last successful one
+	arm := &fakeARM{
+		group: map[string]interface{}{"location": "eastus"},
+		deployments: map[string]map[string]interface{}{
+			"storage": {"provisioningState": "Succeeded"},
+		},
+		results:       []string{submitFailed},
+		rollbackState: "Succeeded",
+	}
+	d, _ := arm.newDeployer(t)
+
+	_, err := d.Update(context.Background(), "storage", "rg", "eastus", testTemplate, nil,
+		DeploymentOptions{RollbackOnFailure: true, CreateResourceGroup: true},
+	)
+
+	var rollbackErr *RollbackError
+	require.True(t, errors.As(err, &rollbackErr), "expected a rollback error, got %v", err)
+	assert.NoError(t, rollbackErr.RollbackErr)
+	assert.Equal(t, "storage-v1", rollbackErr.RollbackDeploymentName)
+	require.Len(t, arm.submissions, 1)
+	assert.Equal(t, map[string]interface{}{"type": "LastSuccessful"}, arm.submissions[0]["onErrorDeployment"])
+}
+
+func TestDeployer_Update_SubmitsNewParameters(t *testing.T) {
+	// Unlike Deploy, Update submits a deployment that succeeded again, so
+	// that the new parameters are applied
+	arm := &fakeARM{
+		group: map[string]interface{}{"location": "eastus"},
+		deployments: map[string]map[string]interface{}{
+			"storage": {
+				"provisioningState": "Succeeded",
+				"parameters": map[string]interface{}{
+					"sku": map[string]interface{}{"type": "String", "value": "Standard_LRS"},
+				},
+			},
+		},
+	}
+	d, _ := arm.newDeployer(t)
+
+	outputs, err := d.Update(context.Background(), "storage", "rg", "eastus", testTemplate,
+		map[string]interface{}{"sku": "Premium_LRS"},
+		DeploymentOptions{CreateResourceGroup: true},
+	)
+
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "storage"}, outputs)
+	require.Len(t, arm.submissions, 1)
+	assert.Equal(t, map[string]interface{}{
+		"sku": map[string]interface{}{"value": "Premium_LRS"},
+	}, arm.submissions[0]["parameters"])
+}
+
+func TestDeployer_Update_NotFound(t *testing.T) {
+	arm := &fakeARM{group: map[string]interface{}{"location": "eastus"}}
+	d, _ := arm.newDeployer(t)
+
+	_, err := d.Update(context.Background(), "storage", "rg", "eastus", testTemplate, nil, DeploymentOptions{})
+
+	assert.EqualError(t, err, `error updating "storage" in resource group "rg": the deployment doesn't exist, install it first`)
+	var deploymentErr *DeploymentError
+	require.True(t, errors.As(err, &deploymentErr), "expected a deployment error, got %v", err)
+	assert.Equal(t, PhaseDeploy, deploymentErr.Phase)
+	assert.Empty(t, arm.submitted(), "nothing is deployed")
+}
+
+func TestDeployer_Deploy_RollsBackToLastSuccessfulDeployment(t *testing.T) {
+	arm := &fakeARM{
+		group:         map[string]interface{}{"location": "eastus"},
+		results:       []string{submitFailed},
+		rollbackState: "Succeeded",
+	}
+	d, _ := arm.newDeployer(t)
+
+	var states []DeploymentState
+	_, err := d.Deploy(context.Background(), "storage", "rg", "eastus", testTemplate, nil, DeploymentOptions{
+		RollbackOnFailure:   true,
+		CreateResourceGroup: true,
+		Progress: func(state DeploymentState, message string) {
+			states = append(states, state)
+		},
+	})
+
+	var rollbackErr *RollbackError
+	require.True(t, errors.As(err, &rollbackErr), "expected a rollback error, got %v", err)
+	assert.NoError(t, rollbackErr.RollbackErr)
+	assert.Equal(t, "storage-v1", rollbackErr.RollbackDeploymentName)
+	assert.Equal(t, []DeploymentState{DeploymentRollingBack}, states)
+	require.Len(t, arm.submissions, 1, "ARM redeploys the last successful deployment itself")
+	assert.Equal(t, map[string]interface{}{"type": "LastSuccessful"}, arm.submissions[0]["onErrorDeployment"])
+}
+
+func TestDeployer_Deploy_RollbackFails(t *testing.T) {
+	arm := &fakeARM{
+		group:         map[string]interface{}{"location": "eastus"},
+		results:       []string{submitFailed},
+		rollbackState: "Failed",
+	}
+	d, _ := arm.newDeployer(t)
+
+	_, err := d.Deploy(context.Background(), "storage", "rg", "eastus", testTemplate, nil,
+		DeploymentOptions{RollbackOnFailure: true, CreateResourceGroup: true},
+	)
+
+	var rollbackErr *RollbackError
+	require.True(t, errors.As(err, &rollbackErr), "expected a rollback error, got %v", err)
+	assert.EqualError(t, rollbackErr.RollbackErr, "rollback deployment has failed")
+	assert.Contains(t, err.Error(), `rollback to deployment "storage-v1" failed`)
+}
+
+func TestDeployer_Deploy_NoPreviousDeployment(t *testing.T) {
+	// Without a successful deployment in the group, ARM doesn't start a
+	// rollback
+	arm := &fakeARM{
+		group:   map[string]interface{}{"location": "eastus"},
+		results: []string{submitFailed},
+	}
+	d, _ := arm.newDeployer(t)
+
+	_, err := d.Deploy(context.Background(), "storage", "rg", "eastus", testTemplate, nil,
+		DeploymentOptions{RollbackOnFailure: true, CreateResourceGroup: true},
+	)
+
+	var rollbackErr *RollbackError
+	require.True(t, errors.As(err, &rollbackErr), "expected a rollback error, got %v", err)
+	assert.EqualError(t, rollbackErr.RollbackErr, "ARM did not start a rollback deployment")
+}
+
+func TestDeployer_Deploy_RollbackTimesOut(t *testing.T) {
+	arm := &fakeARM{
+		group:         map[string]interface{}{"location": "eastus"},
+		results:       []string{submitFailed},
+		rollbackState: "Running",
+	}
+	d, _ := arm.newDeployer(t)
+	d.pollingDuration = 50 * time.Millisecond
+
+	_, err := d.Deploy(context.Background(), "storage", "rg", "eastus", testTemplate, nil,
+		DeploymentOptions{RollbackOnFailure: true, CreateResourceGroup: true},
+	)
+
+	var rollbackErr *RollbackError
+	require.True(t, errors.As(err, &rollbackErr), "expected a rollback error, got %v", err)
+	assert.EqualError(t, rollbackErr.RollbackErr, "timed out waiting for rollback to complete")
+}
+
+func TestDeployer_Deploy_NoRollbackWhenRejected(t *testing.T) {
+	arm := &fakeARM{
+		group:         map[string]interface{}{"location": "eastus"},
+		results:       []string{submitRejected},
+		rollbackState: "Succeeded",
+	}
+	d, _ := arm.newDeployer(t)
+
+	var states []DeploymentState
+	_, err := d.Deploy(context.Background(), "storage", "rg", "eastus", testTemplate, nil, DeploymentOptions{
+		RollbackOnFailure:   true,
+		CreateResourceGroup: true,
+		Progress: func(state DeploymentState, message string) {
+			states = append(states, state)
+		},
+	})
+
+	require.Error(t, err)
+	var rollbackErr *RollbackError
+	assert.False(t, errors.As(err, &rollbackErr), "a rejected deployment changed nothing to roll back")
+	var deploymentErr *DeploymentError
+	require.True(t, errors.As(err, &deploymentErr))
+	assert.Equal(t, PhaseValidate, deploymentErr.Phase)
+	assert.Empty(t, states)
+}
+
+func TestDeployer_Deploy_NoRollbackWhenResourceGroupFails(t *testing.T) {
+	arm := &fakeARM{groupForbidden: true, rollbackState: "Succeeded"}
+	d, _ := arm.newDeployer(t)
+
+	_, err := d.Deploy(context.Background(), "storage", "rg", "eastus", testTemplate, nil,
+		DeploymentOptions{RollbackOnFailure: true, CreateResourceGroup: true},
+	)
+
+	require.Error(t, err)
+	var rollbackErr *RollbackError
+	assert.False(t, errors.As(err, &rollbackErr), "nothing was deployed to roll back")
+	assert.Contains(t, err.Error(), "error checking existence of resource group")
+	assert.Empty(t, arm.submitted())
+}
+
+func TestDeployer_Deploy_RedeploysFailedDeployment(t *testing.T) {
+	arm := &fakeARM{
+		group: map[string]interface{}{"location": "eastus"},
+		deployments: map[string]map[string]interface{}{
+			"storage": {"provisioningState": "Failed"},
+		},
+	}
+	d, _ := arm.newDeployer(t)
+
+	var messages []string
+	outputs, err := d.Deploy(context.Background(), "storage", "rg", "eastus", testTemplate, nil, DeploymentOptions{
+		OnFailedDeployment:  OnFailedDeploymentRedeploy,
+		CreateResourceGroup: true,
+		Progress: func(state DeploymentState, message string) {
+			assert.Equal(t, DeploymentRetrying, state)
+			messages = append(messages, message)
+		},
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "storage"}, outputs)
+	assert.Equal(t, []string{`redeploying failed deployment "storage"`}, messages)
+	require.Len(t, arm.submissions, 1)
+	assert.Nil(t, arm.submissions[0]["onErrorDeployment"])
+}
+
+func TestDeployer_Deploy_RedeploysFailedDeploymentWithRollback(t *testing.T) {
+	arm := &fakeARM{
+		group: map[string]interface{}{"location": "eastus"},
+		deployments: map[string]map[string]interface{}{
+			"storage": {"provisioningState": "Failed"},
+		},
+	}
+	d, _ := arm.newDeployer(t)
+
+	_, err := d.Deploy(context.Background(), "storage", "rg", "eastus", testTemplate, nil, DeploymentOptions{
+		OnFailedDeployment:     OnFailedDeploymentRollback,
+		RollbackDeploymentName: "storage-v1",
+		CreateResourceGroup:    true,
+	})
+
+	require.NoError(t, err)
+	require.Len(t, arm.submissions, 1)
+	assert.Equal(t, map[string]interface{}{
+		"type":           "SpecificDeployment",
+		"deploymentName": "storage-v1",
+	}, arm.submissions[0]["onErrorDeployment"])
+}
+
+func TestDeployer_Deploy_FailedDeployment(t *testing.T) {
+	// By default a failed deployment is an error and isn't submitted again
+	arm := &fakeARM{
+		group: map[string]interface{}{"location": "eastus"},
+		deployments: map[string]map[string]interface{}{
+			"storage": {"provisioningState": "Failed"},
+		},
+	}
+	d, _ := arm.newDeployer(t)
+
+	_, err := d.Deploy(context.Background(), "storage", "rg", "eastus", testTemplate, nil,
+		DeploymentOptions{CreateResourceGroup: true},
+	)
+
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "deployment is in failed state")
+	assert.Empty(t, arm.submitted())
+}
+
+func TestDeployer_Deploy_SucceededDeployment(t *testing.T) {
+	// A deployment that succeeded already isn't submitted again, even when
+	// failed deployments are redeployed
+	arm := &fakeARM{
+		deployments: map[string]map[string]interface{}{
+			"storage": {
+				"provisioningState": "Succeeded",
+				"outputs": map[string]interface{}{
+					"name": map[string]interface{}{"type": "String", "value": "storage-v1"},
+				},
+			},
+		},
+	}
+	d, _ := arm.newDeployer(t)
+
+	outputs, err := d.Deploy(context.Background(), "storage", "rg", "eastus", testTemplate, nil, DeploymentOptions{
+		OnFailedDeployment:  OnFailedDeploymentRedeploy,
+		CreateResourceGroup: true,
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "storage-v1"}, outputs)
+	assert.Equal(t, []string{"GET /subscriptions/sub/resourcegroups/rg/providers/Microsoft.Resources/deployments/storage"}, arm.requests)
+}
+
+func TestDeployer_EnsureResourceGroup_Skipped(t *testing.T) {
+	arm := &fakeARM{}
+	d, _ := arm.newDeployer(t)
+
+	_, err := d.Deploy(context.Background(), "storage", "rg", "eastus", testTemplate, nil,
+		DeploymentOptions{CreateResourceGroup: false},
+	)
+
+	require.NoError(t, err)
+	for _, request := range arm.requests {
+		assert.NotRegexp(t, "/resourcegroups/rg$", request, "the resource group shouldn't be looked up")
+	}
+}
+
+func TestDeployer_EnsureResourceGroup_Create(t *testing.T) {
+	arm := &fakeARM{}
+	d, _ := arm.newDeployer(t)
+
+	err := d.ensureResourceGroup(context.Background(), "rg", "eastus", DeploymentOptions{
+		CreateResourceGroup:   true,
+		ResourceGroupLocation: "westus",
+		ResourceGroupTags:     map[string]string{"owner": "platform-team"},
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, "westus", arm.group["location"])
+	assert.Equal(t, map[string]interface{}{"owner": "platform-team"}, arm.group["tags"])
+}
+
+func TestDeployer_EnsureResourceGroup_LocationMismatch(t *testing.T) {
+	arm := &fakeARM{group: map[string]interface{}{"location": "East US"}}
+	d, ctx := arm.newDeployer(t)
+
+	// Display names match the ARM name of the location
+	err := d.ensureResourceGroup(context.Background(), "rg", "eastus", DeploymentOptions{CreateResourceGroup: true})
+	require.NoError(t, err)
+	assert.NotContains(t, ctx.GetError(), "WARNING")
+
+	err = d.ensureResourceGroup(context.Background(), "rg", "westus", DeploymentOptions{CreateResourceGroup: true})
+	require.NoError(t, err)
+	assert.Contains(t, ctx.GetError(), "WARNING: resource group rg is in location East US, not in the requested location westus")
+	assert.Equal(t, "East US", arm.group["location"], "the group isn't moved")
+}
+
+func TestDeployer_EnsureResourceGroup_MergeTags(t *testing.T) {
+	arm := &fakeARM{
+		group: map[string]interface{}{
+			"location": "eastus",
+			"tags":     map[string]interface{}{"owner": "portal", "cost-center": "1234"},
+		},
+	}
+	d, _ := arm.newDeployer(t)
+
+	err := d.ensureResourceGroup(context.Background(), "rg", "eastus", DeploymentOptions{
+		CreateResourceGroup: true,
+		ResourceGroupTags:   map[string]string{"owner": "platform-team", "env": "dev"},
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"owner":       "platform-team",
+		"cost-center": "1234",
+		"env":         "dev",
+	}, arm.group["tags"], "the requested tags are merged into the tags of the group")
+}
+
+func TestDeployer_Deploy_UnsupportedOptions(t *testing.T) {
+	arm := &fakeARM{}
+	d, _ := arm.newDeployer(t)
+	d.apiVersionProfile, _ = GetAPIVersionProfile("2020-09-01-hybrid")
+
+	_, err := d.Deploy(context.Background(), "storage", "rg", "eastus", testTemplate, nil,
+		DeploymentOptions{DebugDetailLevel: DebugDetailLevelRequestContent},
+	)
+
+	var deploymentErr *DeploymentError
+	require.True(t, errors.As(err, &deploymentErr), "expected a deployment error, got %v", err)
+	assert.Equal(t, PhaseValidate, deploymentErr.Phase)
+	assert.Contains(t, err.Error(), "debugDetailLevel can't be used with the API version profile 2020-09-01-hybrid")
+	assert.Empty(t, arm.requests, "nothing should be sent to ARM")
+}
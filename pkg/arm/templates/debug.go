@@ -0,0 +1,227 @@
+package templates
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+)
+
+// redacted replaces the secrets in the logged requests and responses
+const redacted = "REDACTED"
+
+// redactedHeaders are the headers that carry credentials
+var redactedHeaders = map[string]bool{
+	"authorization":                true,
+	"x-ms-authorization-auxiliary": true,
+	"cookie":                       true,
+	"set-cookie":                   true,
+}
+
+// RequestLogger logs the requests of the clients it logs and their responses:
+// the method, URL, status, duration, headers and bodies. Credentials, secure
+// parameters and secure outputs are redacted.
+type RequestLogger struct {
+	// Out is where the requests are logged
+	Out io.Writer
+}
+
+// Log logs the requests of the client, including the polling of long-running
+// operations. When the client is also tracked, Log must be called first so
+// that the correlation id of the requests is logged.
+func (l *RequestLogger) Log(client *autorest.Client) {
+	sender := client.Sender
+	if sender == nil {
+		sender = autorest.CreateSender()
+	}
+	client.Sender = autorest.DecorateSender(sender, l.withLogging())
+}
+
+// withLogging logs each request before it is sent, and its response or error
+func (l *RequestLogger) withLogging() autorest.SendDecorator {
+	return func(s autorest.Sender) autorest.Sender {
+		return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+			prefix := "DEBUG"
+			if correlationID := r.Header.Get(HeaderCorrelationRequestID); correlationID != "" {
+				prefix = fmt.Sprintf("[correlationId: %s] DEBUG", correlationID)
+			}
+
+			var requestBody []byte
+			if r.Body != nil {
+				var err error
+				requestBody, err = io.ReadAll(r.Body)
+				r.Body.Close()
+				if err != nil {
+					return nil, fmt.Errorf("error reading the body of the request: %w", err)
+				}
+				r.Body = io.NopCloser(bytes.NewReader(requestBody))
+			}
+			var message strings.Builder
+			fmt.Fprintf(&message, "%s ARM request %s %s\n", prefix, r.Method, r.URL)
+			writeHeaders(&message, r.Header)
+			writeBody(&message, requestBody)
+			l.write(message.String())
+
+			startedOn := time.Now()
+			resp, err := s.Do(r)
+			duration := time.Since(startedOn).Round(time.Millisecond)
+			message.Reset()
+			if resp == nil {
+				fmt.Fprintf(&message, "%s ARM request %s %s failed after %s: %s\n", prefix, r.Method, r.URL, duration, err)
+				l.write(message.String())
+				return resp, err
+			}
+
+			var responseBody []byte
+			if resp.Body != nil {
+				var readErr error
+				responseBody, readErr = io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if readErr != nil && err == nil {
+					err = fmt.Errorf("error reading the body of the response: %w", readErr)
+				}
+				resp.Body = io.NopCloser(bytes.NewReader(responseBody))
+			}
+			fmt.Fprintf(&message, "%s ARM response %s %s returned %d in %s\n", prefix, r.Method, r.URL, resp.StatusCode, duration)
+			writeHeaders(&message, resp.Header)
+			writeBody(&message, responseBody)
+			l.write(message.String())
+			return resp, err
+		})
+	}
+}
+
+// write writes a whole message at once, so that the messages of concurrent
+// requests aren't interleaved
+func (l *RequestLogger) write(message string) {
+	io.WriteString(l.Out, message) // nolint: errcheck
+}
+
+// writeHeaders writes the headers sorted by name, redacting the credentials
+func writeHeaders(out *strings.Builder, header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := strings.Join(header[name], ", ")
+		if redactedHeaders[strings.ToLower(name)] {
+			value = redacted
+		}
+		fmt.Fprintf(out, "  %s: %s\n", name, value)
+	}
+}
+
+// writeBody writes the body with its secrets redacted. A body that isn't JSON
+// is written as is.
+func writeBody(out *strings.Builder, body []byte) {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return
+	}
+	fmt.Fprintf(out, "  %s\n", redactBody(body))
+}
+
+// redactBody redacts the values of the secure parameters and outputs of a
+// JSON body
+func redactBody(body []byte) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return body
+	}
+	redactedBody, err := json.Marshal(redactSecrets(value))
+	if err != nil {
+		return body
+	}
+	return redactedBody
+}
+
+// redactSecrets walks a decoded JSON value and redacts:
+//   - the parameters of a deployment declared as secure by its template
+//   - the value of any parameter or output typed as secure, as in the
+//     properties of a deployment returned by ARM
+//   - the default value of any parameter declared as secure by a template
+func redactSecrets(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if isSecureType(v["type"]) {
+			for _, key := range []string{"value", "defaultValue"} {
+				if _, ok := v[key]; ok {
+					v[key] = redacted
+				}
+			}
+		}
+		redactSecureParameters(v)
+		for key, child := range v {
+			v[key] = redactSecrets(child)
+		}
+		return v
+	case []interface{}:
+		for i, child := range v {
+			v[i] = redactSecrets(child)
+		}
+		return v
+	default:
+		return value
+	}
+}
+
+// redactSecureParameters redacts the parameters of deployment properties
+// that their template declares as secure
+func redactSecureParameters(properties map[string]interface{}) {
+	template, ok := properties["template"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	declarations, ok := template["parameters"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	parameters, ok := properties["parameters"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	secure := secureParameterNames(declarations)
+	for name, parameter := range parameters {
+		if !secure[strings.ToLower(name)] {
+			continue
+		}
+		if parameter, ok := parameter.(map[string]interface{}); ok {
+			if _, ok := parameter["value"]; ok {
+				parameter["value"] = redacted
+			}
+		}
+	}
+}
+
+// secureParameterNames returns the names, in lower case, of the parameters
+// that the parameter declarations of a template declare as secure. Parameter
+// names are case-insensitive.
+func secureParameterNames(declarations map[string]interface{}) map[string]bool {
+	secure := map[string]bool{}
+	for name, declaration := range declarations {
+		if declaration, ok := declaration.(map[string]interface{}); ok && isSecureType(declaration["type"]) {
+			secure[strings.ToLower(name)] = true
+		}
+	}
+	return secure
+}
+
+// isSecureType reports whether an ARM type is securestring or secureobject.
+// ARM types are case-insensitive.
+func isSecureType(value interface{}) bool {
+	armType, ok := value.(string)
+	if !ok {
+		return false
+	}
+	armType = strings.ToLower(armType)
+	return armType == "securestring" || armType == "secureobject"
+}
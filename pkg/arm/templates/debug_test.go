@@ -0,0 +1,119 @@
+package templates
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestLogger_Log(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), "p@ssw0rd", "the request sent isn't redacted")
+		assert.Equal(t, "Bearer secret-token", r.Header.Get("Authorization"))
+
+		w.Header().Set("Set-Cookie", "session=secret-cookie")
+		w.Header().Set(HeaderRequestID, "request-1")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"properties":{"outputs":{"connectionString":{"type":"SecureString","value":"secret-output"},"name":{"type":"String","value":"storage"}}}}`) // nolint: errcheck
+	}))
+	defer server.Close()
+
+	var out bytes.Buffer
+	logger := &RequestLogger{Out: &out}
+	tracker := &RequestTracker{CorrelationID: "00000000-0000-0000-0000-0000000000c0"}
+	client := autorest.NewClientWithUserAgent("test")
+	logger.Log(&client)
+	tracker.Track(&client)
+
+	deployment := map[string]interface{}{
+		"properties": map[string]interface{}{
+			"template": map[string]interface{}{
+				"parameters": map[string]interface{}{
+					"adminPassword": map[string]interface{}{"type": "secureString"},
+					"location":      map[string]interface{}{"type": "string"},
+				},
+			},
+			"parameters": map[string]interface{}{
+				"AdminPassword": map[string]interface{}{"value": "p@ssw0rd"},
+				"location":      map[string]interface{}{"value": "eastus"},
+			},
+		},
+	}
+	req, err := autorest.Prepare(&http.Request{},
+		autorest.AsPut(),
+		autorest.WithBaseURL(server.URL),
+		autorest.WithPath("/deployments/storage"),
+		autorest.WithHeader("Authorization", "Bearer secret-token"),
+		autorest.WithJSON(deployment),
+	)
+	require.NoError(t, err)
+	resp, err := client.Send(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "secret-output", "the response returned isn't redacted")
+
+	logs := out.String()
+	assert.Contains(t, logs, "[correlationId: 00000000-0000-0000-0000-0000000000c0] DEBUG ARM request PUT "+server.URL+"/deployments/storage\n")
+	assert.Contains(t, logs, "[correlationId: 00000000-0000-0000-0000-0000000000c0] DEBUG ARM response PUT "+server.URL+"/deployments/storage returned 201 in ")
+	assert.Contains(t, logs, "  Authorization: REDACTED\n")
+	assert.Contains(t, logs, "  Set-Cookie: REDACTED\n")
+	assert.Contains(t, logs, "  X-Ms-Request-Id: request-1\n")
+	assert.Contains(t, logs, `"AdminPassword":{"value":"REDACTED"}`)
+	assert.Contains(t, logs, `"location":{"value":"eastus"}`)
+	assert.Contains(t, logs, `"connectionString":{"type":"SecureString","value":"REDACTED"}`)
+	assert.Contains(t, logs, `"name":{"type":"String","value":"storage"}`)
+	for _, secret := range []string{"p@ssw0rd", "secret-token", "secret-cookie", "secret-output"} {
+		assert.NotContains(t, logs, secret)
+	}
+}
+
+func TestRequestLogger_Failure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	url := server.URL
+	server.Close()
+
+	// Without a correlation id, the requests are logged without it
+	var out bytes.Buffer
+	logger := &RequestLogger{Out: &out}
+	client := autorest.NewClientWithUserAgent("test")
+	client.RetryAttempts = 0
+	logger.Log(&client)
+
+	req, err := autorest.Prepare(&http.Request{}, autorest.AsGet(), autorest.WithBaseURL(url))
+	require.NoError(t, err)
+	_, err = client.Send(req)
+	require.Error(t, err)
+
+	assert.Contains(t, out.String(), "DEBUG ARM request GET "+url+" failed after ")
+	assert.NotContains(t, out.String(), "correlationId")
+}
+
+func TestRedactBody(t *testing.T) {
+	// Bodies that aren't JSON are logged as is
+	assert.Equal(t, "not json", string(redactBody([]byte("not json"))))
+
+	// Numbers keep their precision
+	body := redactBody([]byte(`{"value":[{"properties":{"parameters":{"key":{"type":"SecureObject","value":{"a":1}}},"count":12345678901234567890}}]}`))
+	assert.JSONEq(t, `{"value":[{"properties":{"parameters":{"key":{"type":"SecureObject","value":"REDACTED"}},"count":12345678901234567890}}]}`, string(body))
+
+	// The default values of the secure parameters of a template
+	body = redactBody([]byte(`{"properties":{"template":{"parameters":{` +
+		`"adminPassword":{"type":"securestring","defaultValue":"p@ssw0rd"},` +
+		`"settings":{"type":"secureObject","defaultValue":{"key":"secret"}},` +
+		`"location":{"type":"string","defaultValue":"eastus"}}}}}`))
+	assert.JSONEq(t, `{"properties":{"template":{"parameters":{`+
+		`"adminPassword":{"type":"securestring","defaultValue":"REDACTED"},`+
+		`"settings":{"type":"secureObject","defaultValue":"REDACTED"},`+
+		`"location":{"type":"string","defaultValue":"eastus"}}}}}`, string(body))
+}
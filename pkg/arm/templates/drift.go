@@ -0,0 +1,264 @@
+package templates
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	whatIfSDK "github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-07-01/features" // nolint: lll
+
+	"get.porter.sh/porter/pkg/tracing"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+// DriftType describes how the deployed state of a resource or property
+// differs from what the template declares
+type DriftType string
+
+const (
+	// DriftAdded is a resource of the deployment that the template doesn't
+	// declare, or a property that exists in Azure but not in the template
+	DriftAdded DriftType = "added"
+	// DriftChanged is something whose value in Azure differs from the template
+	DriftChanged DriftType = "changed"
+	// DriftRemoved is something declared in the template that is missing in
+	// Azure
+	DriftRemoved DriftType = "removed"
+)
+
+// PropertyDrift is a single property of a resource that drifted
+type PropertyDrift struct {
+	Path     string      `json:"path"`
+	Type     DriftType   `json:"type"`
+	Expected interface{} `json:"expected,omitempty"`
+	Actual   interface{} `json:"actual,omitempty"`
+}
+
+// ResourceDrift is a resource whose state in Azure differs from the template
+type ResourceDrift struct {
+	ResourceID string          `json:"resourceId"`
+	Type       DriftType       `json:"type"`
+	Properties []PropertyDrift `json:"properties,omitempty"`
+}
+
+// DetectDrift runs an ARM what-if of the template and parameters against the
+// resource group and reports every resource whose current state differs from
+// the template. What-if describes the changes a deployment would make, so the
+// drift is the reverse of those changes: a property the deployment would
+// create has been removed in Azure, and so on. What-if runs in Complete mode,
+// in which the resources of the group that the template doesn't declare would
+// be deleted. Of those, only the resources of the deployment are reported,
+// the other resources of the group belong to other deployments.
+func (d *deployer) DetectDrift(
+	ctx context.Context,
+	deploymentName string,
+	resourceGroupName string,
+	location string,
+	template []byte,
+	armParams map[string]interface{},
+) (_ []ResourceDrift, err error) {
+	if !d.apiVersionProfile.isLatest() {
+		return nil, fmt.Errorf(
+			"drift detection uses what-if, which isn't available with the API version profile %s",
+			d.apiVersionProfile.Name,
+		)
+	}
+
+	ctx, log := tracing.StartSpan(ctx, deploymentAttributes(deploymentName, resourceGroupName)...)
+	defer func() { EndSpan(ctx, log, err) }()
+
+	var armTemplateMap map[string]interface{}
+	if err := json.Unmarshal(template, &armTemplateMap); err != nil {
+		return nil, fmt.Errorf("error unmarshaling ARM template: %s", err)
+	}
+	deployedResources, err := d.getDeployedResources(ctx, deploymentName, resourceGroupName)
+	if err != nil {
+		return nil, fmt.Errorf(
+			`error getting the resources of "%s" in resource group "%s": %s`,
+			deploymentName,
+			resourceGroupName,
+			err,
+		)
+	}
+
+	future, err := d.whatIfClient.WhatIf(
+		ctx,
+		resourceGroupName,
+		deploymentName,
+		whatIfSDK.DeploymentWhatIf{
+			Location: &location,
+			Properties: &whatIfSDK.DeploymentWhatIfProperties{
+				Template:   armTemplateMap,
+				Parameters: toARMParameters(armParams),
+				Mode:       whatIfSDK.Complete,
+				WhatIfSettings: &whatIfSDK.DeploymentWhatIfSettings{
+					ResultFormat: whatIfSDK.FullResourcePayloads,
+				},
+			},
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf(
+			`error running what-if for "%s" in resource group "%s": %s`,
+			deploymentName,
+			resourceGroupName,
+			err,
+		)
+	}
+	if err = future.WaitForCompletionRef(ctx, d.whatIfClient.Client); err != nil {
+		return nil, fmt.Errorf(
+			"error while waiting for what-if to complete: %s",
+			err,
+		)
+	}
+	result, err := future.Result(d.whatIfClient)
+	if err != nil {
+		return nil, fmt.Errorf("error getting what-if result: %s", err)
+	}
+	if result.WhatIfOperationProperties == nil ||
+		result.WhatIfOperationProperties.Changes == nil {
+		return nil, nil
+	}
+
+	return getResourceDrift(*result.WhatIfOperationProperties.Changes, deployedResources), nil
+}
+
+// outputResourcesAPIVersion is a version of the deployments API that returns
+// the resources a deployment created or updated
+const outputResourcesAPIVersion = "2020-06-01"
+
+// getDeployedResources returns the IDs, in lower case, of the resources the
+// deployment created or updated. The api-version of the deployments client
+// doesn't return them, so the deployment is read with a newer one. A
+// deployment that doesn't exist has no resources.
+func (d *deployer) getDeployedResources(
+	ctx context.Context,
+	deploymentName string,
+	resourceGroupName string,
+) (map[string]bool, error) {
+	req, err := d.deploymentsClient.GetPreparer(ctx, resourceGroupName, deploymentName)
+	if err != nil {
+		return nil, err
+	}
+	query := req.URL.Query()
+	query.Set("api-version", outputResourcesAPIVersion)
+	req.URL.RawQuery = query.Encode()
+	resp, err := d.deploymentsClient.GetSender(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return map[string]bool{}, nil
+	}
+
+	var deployment struct {
+		Properties struct {
+			OutputResources []struct {
+				ID string `json:"id"`
+			} `json:"outputResources"`
+		} `json:"properties"`
+	}
+	if err = autorest.Respond(
+		resp,
+		d.deploymentsClient.ByInspecting(),
+		azure.WithErrorUnlessStatusCode(http.StatusOK),
+		autorest.ByUnmarshallingJSON(&deployment),
+		autorest.ByClosing(),
+	); err != nil {
+		return nil, err
+	}
+	resources := map[string]bool{}
+	for _, resource := range deployment.Properties.OutputResources {
+		resources[strings.ToLower(resource.ID)] = true
+	}
+	return resources, nil
+}
+
+// getResourceDrift converts what-if changes into drift. The resources that
+// the deployment would delete are only drift when they are resources of the
+// deployment, deployedResources.
+func getResourceDrift(changes []whatIfSDK.WhatIfChange, deployedResources map[string]bool) []ResourceDrift {
+	var drift []ResourceDrift
+	for _, change := range changes {
+		resource := ResourceDrift{}
+		if change.ResourceID != nil {
+			resource.ResourceID = *change.ResourceID
+		}
+		switch change.ChangeType {
+		case whatIfSDK.Create:
+			// The deployment would create the resource, so it has been deleted
+			resource.Type = DriftRemoved
+		case whatIfSDK.Delete:
+			// The deployment would delete the resource. When the deployment
+			// deployed it, the template no longer declares it. Otherwise it
+			// belongs to another deployment of the group.
+			if !deployedResources[strings.ToLower(resource.ResourceID)] {
+				continue
+			}
+			resource.Type = DriftAdded
+		case whatIfSDK.Modify:
+			resource.Type = DriftChanged
+			if change.Delta != nil {
+				resource.Properties = getPropertyDrift("", false, *change.Delta)
+			}
+			if len(resource.Properties) == 0 {
+				continue
+			}
+		default:
+			// Deploy, NoChange and Ignore don't mean the resource drifted
+			continue
+		}
+		drift = append(drift, resource)
+	}
+	return drift
+}
+
+// getPropertyDrift flattens the nested what-if property changes into a list
+// of property paths
+func getPropertyDrift(
+	parentPath string,
+	parentIsArray bool,
+	changes []whatIfSDK.WhatIfPropertyChange,
+) []PropertyDrift {
+	var drift []PropertyDrift
+	for _, change := range changes {
+		path := ""
+		if change.Path != nil {
+			path = *change.Path
+		}
+		switch {
+		case parentPath == "":
+		case parentIsArray:
+			path = fmt.Sprintf("%s[%s]", parentPath, path)
+		default:
+			path = fmt.Sprintf("%s.%s", parentPath, path)
+		}
+
+		property := PropertyDrift{
+			Path:     path,
+			Expected: change.After,
+			Actual:   change.Before,
+		}
+		switch change.PropertyChangeType {
+		case whatIfSDK.PropertyChangeTypeCreate:
+			property.Type = DriftRemoved
+		case whatIfSDK.PropertyChangeTypeDelete:
+			property.Type = DriftAdded
+		case whatIfSDK.PropertyChangeTypeModify:
+			property.Type = DriftChanged
+		case whatIfSDK.PropertyChangeTypeArray:
+			if change.Children != nil {
+				drift = append(drift, getPropertyDrift(path, true, *change.Children)...)
+			}
+			continue
+		default:
+			continue
+		}
+		drift = append(drift, property)
+	}
+	return drift
+}
@@ -0,0 +1,163 @@
+package templates
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	whatIfSDK "github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-07-01/features"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetResourceDrift(t *testing.T) {
+	changes := []whatIfSDK.WhatIfChange{
+		{
+			ResourceID: to.StringPtr("/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Storage/storageAccounts/unchanged"),
+			ChangeType: whatIfSDK.NoChange,
+		},
+		{
+			ResourceID: to.StringPtr("/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Storage/storageAccounts/deleted"),
+			ChangeType: whatIfSDK.Create,
+		},
+		{
+			ResourceID: to.StringPtr("/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Storage/storageAccounts/modified"),
+			ChangeType: whatIfSDK.Modify,
+			Delta: &[]whatIfSDK.WhatIfPropertyChange{
+				{
+					Path:               to.StringPtr("properties.supportsHttpsTrafficOnly"),
+					PropertyChangeType: whatIfSDK.PropertyChangeTypeModify,
+					Before:             false,
+					After:              true,
+				},
+				{
+					Path:               to.StringPtr("tags.owner"),
+					PropertyChangeType: whatIfSDK.PropertyChangeTypeDelete,
+					Before:             "portal",
+				},
+				{
+					Path:               to.StringPtr("properties.networkAcls.ipRules"),
+					PropertyChangeType: whatIfSDK.PropertyChangeTypeArray,
+					Children: &[]whatIfSDK.WhatIfPropertyChange{
+						{
+							Path:               to.StringPtr("0"),
+							PropertyChangeType: whatIfSDK.PropertyChangeTypeCreate,
+							After:              "10.0.0.1",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	drift := getResourceDrift(changes, nil)
+
+	assert.Equal(t, []ResourceDrift{
+		{
+			ResourceID: "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Storage/storageAccounts/deleted",
+			Type:       DriftRemoved,
+		},
+		{
+			ResourceID: "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Storage/storageAccounts/modified",
+			Type:       DriftChanged,
+			Properties: []PropertyDrift{
+				{Path: "properties.supportsHttpsTrafficOnly", Type: DriftChanged, Expected: true, Actual: false},
+				{Path: "tags.owner", Type: DriftAdded, Actual: "portal"},
+				{Path: "properties.networkAcls.ipRules[0]", Type: DriftRemoved, Expected: "10.0.0.1"},
+			},
+		},
+	}, drift)
+}
+
+// fakeWhatIf serves the what-if requests of the deployer, and its other
+// requests with the fakeARM
+type fakeWhatIf struct {
+	fakeARM
+	// properties are the properties of the last what-if
+	properties map[string]interface{}
+	// changes are the changes what-if reports
+	changes []interface{}
+}
+
+func (f *fakeWhatIf) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasSuffix(r.URL.Path, "/whatIf") {
+		f.fakeARM.ServeHTTP(w, r)
+		return
+	}
+	var body map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&body) // nolint: errcheck
+	f.properties, _ = body["properties"].(map[string]interface{})
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":     "Succeeded",
+		"properties": map[string]interface{}{"changes": f.changes},
+	})
+}
+
+func TestDeployer_DetectDrift(t *testing.T) {
+	arm := &fakeWhatIf{
+		fakeARM: fakeARM{deployments: map[string]map[string]interface{}{
+			"storage": {
+				"provisioningState": "Succeeded",
+				"outputResources": []interface{}{
+					map[string]interface{}{"id": "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Storage/storageAccounts/storage"},
+					map[string]interface{}{"id": "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Storage/storageAccounts/Undeclared"},
+				},
+			},
+		}},
+		changes: []interface{}{
+			map[string]interface{}{
+				"resourceId": "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Storage/storageAccounts/storage",
+				"changeType": "NoChange",
+			},
+			map[string]interface{}{
+				"resourceId": "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Storage/storageAccounts/undeclared",
+				"changeType": "Delete",
+			},
+			map[string]interface{}{
+				"resourceId": "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Storage/storageAccounts/other-deployment",
+				"changeType": "Delete",
+			},
+		},
+	}
+	d, _ := newServedDeployer(t, arm)
+
+	drift, err := d.DetectDrift(context.Background(), "storage", "rg", "eastus", testTemplate, nil)
+
+	require.NoError(t, err)
+	assert.Equal(t, "Complete", arm.properties["mode"], "resources missing from the template are only reported in Complete mode")
+	assert.Equal(t, []ResourceDrift{
+		{
+			ResourceID: "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Storage/storageAccounts/undeclared",
+			Type:       DriftAdded,
+		},
+	}, drift, "only the resources of the deployment are reported as added")
+}
+
+func TestDeployer_DetectDrift_NotDeployed(t *testing.T) {
+	arm := &fakeWhatIf{
+		changes: []interface{}{
+			map[string]interface{}{
+				"resourceId": "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Storage/storageAccounts/storage",
+				"changeType": "Create",
+			},
+			map[string]interface{}{
+				"resourceId": "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Storage/storageAccounts/other-deployment",
+				"changeType": "Delete",
+			},
+		},
+	}
+	d, _ := newServedDeployer(t, arm)
+
+	drift, err := d.DetectDrift(context.Background(), "storage", "rg", "eastus", testTemplate, nil)
+
+	require.NoError(t, err)
+	assert.Equal(t, []ResourceDrift{
+		{
+			ResourceID: "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Storage/storageAccounts/storage",
+			Type:       DriftRemoved,
+		},
+	}, drift)
+}
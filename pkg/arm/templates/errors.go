@@ -0,0 +1,164 @@
+package templates
+
+import (
+	"errors"
+	"net/http"
+
+	resourcesSDK "github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+// The phases of a step in which an error can occur
+const (
+	// PhaseAuth is authenticating with Azure
+	PhaseAuth = "auth"
+	// PhaseValidate is checking the arguments and the template, including
+	// the validation of the template by ARM
+	PhaseValidate = "validate"
+	// PhaseDeploy is submitting the deployment and its resource group
+	PhaseDeploy = "deploy"
+	// PhasePoll is waiting for the deployment to complete
+	PhasePoll = "poll"
+	// PhaseOutputs is reading the outputs of the deployment
+	PhaseOutputs = "outputs"
+)
+
+// ErrorDetail is an error returned by ARM, with the errors that caused it
+type ErrorDetail struct {
+	Code    string        `json:"code,omitempty"`
+	Message string        `json:"message,omitempty"`
+	Target  string        `json:"target,omitempty"`
+	Details []ErrorDetail `json:"details,omitempty"`
+}
+
+// DeploymentError is an error of a step with the phase it occurred in and
+// the ARM error that caused it
+type DeploymentError struct {
+	Phase string
+	Err   error
+	// ARMError is the error returned by ARM, if any
+	ARMError *ErrorDetail
+	// RequestID and CorrelationID identify the failed ARM request, from its
+	// x-ms-request-id and x-ms-correlation-request-id headers
+	RequestID     string
+	CorrelationID string
+}
+
+func (e *DeploymentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DeploymentError) Unwrap() error {
+	return e.Err
+}
+
+// NewDeploymentError returns the error of a step in the phase, with the
+// details of the ARM error it wraps. Errors that already carry details are
+// returned as is, so the innermost phase is kept, and token errors are
+// always in the auth phase.
+func NewDeploymentError(phase string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var deploymentErr *DeploymentError
+	if errors.As(err, &deploymentErr) {
+		return err
+	}
+
+	deploymentErr = &DeploymentError{Phase: phase, Err: err}
+	var tokenErr adal.TokenRefreshError
+	if errors.As(err, &tokenErr) {
+		deploymentErr.Phase = PhaseAuth
+		deploymentErr.setResponse(tokenErr.Response())
+	}
+	var detailedErr autorest.DetailedError
+	if errors.As(err, &detailedErr) {
+		deploymentErr.setResponse(detailedErr.Response)
+	}
+	var requestErr *azure.RequestError
+	var serviceErr *azure.ServiceError
+	switch {
+	case errors.As(err, &requestErr):
+		deploymentErr.setResponse(requestErr.Response)
+		if requestErr.RequestID != "" {
+			deploymentErr.RequestID = requestErr.RequestID
+		}
+		if requestErr.ServiceError != nil {
+			deploymentErr.ARMError = fromServiceError(requestErr.ServiceError)
+		}
+	case errors.As(err, &serviceErr):
+		deploymentErr.ARMError = fromServiceError(serviceErr)
+	}
+	return deploymentErr
+}
+
+// setResponse records the ids of the failed request
+func (e *DeploymentError) setResponse(resp *http.Response) {
+	if resp == nil {
+		return
+	}
+	if id := resp.Header.Get("x-ms-request-id"); id != "" {
+		e.RequestID = id
+	}
+	if id := resp.Header.Get("x-ms-correlation-request-id"); id != "" {
+		e.CorrelationID = id
+	}
+}
+
+// newFailedDeploymentError returns the error of a deployment found in a
+// failed state. The api-version of the deployments client doesn't return the
+// error of the deployment, only its correlation id.
+func newFailedDeploymentError(deployment *resourcesSDK.DeploymentExtended) error {
+	deploymentErr := &DeploymentError{
+		Phase: PhasePoll,
+		Err:   errors.New("deployment has failed"),
+	}
+	if deployment != nil && deployment.Properties != nil && deployment.Properties.CorrelationID != nil {
+		deploymentErr.CorrelationID = *deployment.Properties.CorrelationID
+	}
+	return deploymentErr
+}
+
+// fromServiceError converts the error returned by an Azure API
+func fromServiceError(se *azure.ServiceError) *ErrorDetail {
+	detail := &ErrorDetail{
+		Code:    se.Code,
+		Message: se.Message,
+	}
+	if se.Target != nil {
+		detail.Target = *se.Target
+	}
+	for _, d := range se.Details {
+		detail.Details = append(detail.Details, fromErrorMap(d))
+	}
+	return detail
+}
+
+// fromErrorMap converts an error decoded as a map, as the details of
+// service errors are
+func fromErrorMap(m map[string]interface{}) ErrorDetail {
+	detail := ErrorDetail{}
+	detail.Code, _ = m["code"].(string)
+	detail.Message, _ = m["message"].(string)
+	detail.Target, _ = m["target"].(string)
+	details, _ := m["details"].([]interface{})
+	for _, d := range details {
+		if dm, ok := d.(map[string]interface{}); ok {
+			detail.Details = append(detail.Details, fromErrorMap(dm))
+		}
+	}
+	return detail
+}
+
+// submitPhase returns the phase of an error submitting a deployment. ARM
+// validates the template when it is submitted and rejects invalid templates
+// as bad requests.
+func submitPhase(err error) string {
+	var detailedErr autorest.DetailedError
+	if errors.As(err, &detailedErr) && detailedErr.StatusCode == http.StatusBadRequest {
+		return PhaseValidate
+	}
+	return PhaseDeploy
+}
@@ -0,0 +1,122 @@
+package templates
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	resourcesSDK "github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDeploymentError_RequestError(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusBadRequest,
+		Header: http.Header{
+			"X-Ms-Request-Id":             []string{"request-id"},
+			"X-Ms-Correlation-Request-Id": []string{"correlation-id"},
+		},
+	}
+	requestErr := &azure.RequestError{
+		DetailedError: autorest.DetailedError{StatusCode: http.StatusBadRequest, Response: resp},
+		ServiceError: &azure.ServiceError{
+			Code:    "InvalidTemplateDeployment",
+			Message: "The template deployment is not valid",
+			Target:  to.StringPtr("storage"),
+			Details: []map[string]interface{}{
+				{
+					"code":    "StorageAccountAlreadyTaken",
+					"message": "The storage account named porter is already taken.",
+					"details": []interface{}{
+						map[string]interface{}{"code": "Conflict", "target": "porter"},
+					},
+				},
+			},
+		},
+		RequestID: "request-id",
+	}
+	var err error = autorest.NewErrorWithError(requestErr, "resources.DeploymentsClient", "CreateOrUpdate", resp, "Failure sending request")
+	err = fmt.Errorf("error submitting ARM template: %w", err)
+
+	err = NewDeploymentError(submitPhase(err), err)
+	var deploymentErr *DeploymentError
+	require.True(t, errors.As(err, &deploymentErr))
+	assert.Equal(t, PhaseValidate, deploymentErr.Phase, "ARM rejects invalid templates as bad requests")
+	assert.Equal(t, "request-id", deploymentErr.RequestID)
+	assert.Equal(t, "correlation-id", deploymentErr.CorrelationID)
+	assert.Equal(t, &ErrorDetail{
+		Code:    "InvalidTemplateDeployment",
+		Message: "The template deployment is not valid",
+		Target:  "storage",
+		Details: []ErrorDetail{
+			{
+				Code:    "StorageAccountAlreadyTaken",
+				Message: "The storage account named porter is already taken.",
+				Details: []ErrorDetail{{Code: "Conflict", Target: "porter"}},
+			},
+		},
+	}, deploymentErr.ARMError)
+	assert.Contains(t, err.Error(), "error submitting ARM template")
+}
+
+func TestNewDeploymentError_ServiceError(t *testing.T) {
+	// Polling returns the error of the deployment as a service error
+	serviceErr := &azure.ServiceError{Code: "DeploymentFailed", Message: "At least one resource deployment operation failed."}
+
+	err := NewDeploymentError(PhasePoll, fmt.Errorf("error while waiting for deployment to complete: %w", serviceErr))
+	var deploymentErr *DeploymentError
+	require.True(t, errors.As(err, &deploymentErr))
+	assert.Equal(t, PhasePoll, deploymentErr.Phase)
+	assert.Equal(t, &ErrorDetail{Code: "DeploymentFailed", Message: "At least one resource deployment operation failed."}, deploymentErr.ARMError)
+	assert.True(t, errors.Is(err, serviceErr))
+
+	// The innermost phase is kept when the error is wrapped again
+	wrapped := NewDeploymentError(PhaseDeploy, fmt.Errorf("error deploying: %w", err))
+	require.True(t, errors.As(wrapped, &deploymentErr))
+	assert.Equal(t, PhasePoll, deploymentErr.Phase)
+}
+
+// testTokenError is an error getting a token
+type testTokenError struct{}
+
+func (testTokenError) Error() string {
+	return "adal: Refresh request failed. Status Code = '401'."
+}
+
+func (testTokenError) Response() *http.Response {
+	return &http.Response{StatusCode: http.StatusUnauthorized, Header: http.Header{}}
+}
+
+func TestNewDeploymentError_TokenError(t *testing.T) {
+	err := NewDeploymentError(PhaseDeploy, fmt.Errorf("error getting resource group: %w", testTokenError{}))
+	var deploymentErr *DeploymentError
+	require.True(t, errors.As(err, &deploymentErr))
+	assert.Equal(t, PhaseAuth, deploymentErr.Phase)
+	assert.Nil(t, deploymentErr.ARMError)
+}
+
+func TestNewDeploymentError_Nil(t *testing.T) {
+	assert.NoError(t, NewDeploymentError(PhaseOutputs, nil))
+}
+
+func TestSubmitPhase(t *testing.T) {
+	assert.Equal(t, PhaseDeploy, submitPhase(errors.New("connection reset")))
+	assert.Equal(t, PhaseDeploy, submitPhase(autorest.DetailedError{StatusCode: http.StatusConflict}))
+	assert.Equal(t, PhaseValidate, submitPhase(autorest.DetailedError{StatusCode: http.StatusBadRequest}))
+}
+
+func TestNewFailedDeploymentError(t *testing.T) {
+	err := newFailedDeploymentError(&resourcesSDK.DeploymentExtended{
+		Properties: &resourcesSDK.DeploymentPropertiesExtended{CorrelationID: to.StringPtr("correlation-id")},
+	})
+	var deploymentErr *DeploymentError
+	require.True(t, errors.As(err, &deploymentErr))
+	assert.Equal(t, PhasePoll, deploymentErr.Phase)
+	assert.Equal(t, "correlation-id", deploymentErr.CorrelationID)
+	assert.EqualError(t, err, "deployment has failed")
+}
@@ -0,0 +1,191 @@
+package templates
+
+import (
+	"fmt"
+
+	resourcesSDK "github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources" // nolint: lll
+)
+
+// OnFailedDeployment controls what the deployer does when it finds an existing
+// deployment with the same name in a failed state
+type OnFailedDeployment string
+
+const (
+	// OnFailedDeploymentError returns an error and leaves the failed deployment
+	// alone. This is the default.
+	OnFailedDeploymentError OnFailedDeployment = "error"
+	// OnFailedDeploymentRedeploy submits the deployment again with the same name
+	OnFailedDeploymentRedeploy OnFailedDeployment = "redeploy"
+	// OnFailedDeploymentRollback submits the deployment again with ARM's
+	// onErrorDeployment set, so that if it fails ARM redeploys the last
+	// successful deployment (or a specific one) in the resource group
+	OnFailedDeploymentRollback OnFailedDeployment = "rollback"
+)
+
+// ParseOnFailedDeployment validates the given value, defaulting to
+// OnFailedDeploymentError when it is empty
+func ParseOnFailedDeployment(value string) (OnFailedDeployment, error) {
+	switch OnFailedDeployment(value) {
+	case "":
+		return OnFailedDeploymentError, nil
+	case OnFailedDeploymentError, OnFailedDeploymentRedeploy, OnFailedDeploymentRollback:
+		return OnFailedDeployment(value), nil
+	default:
+		return "", fmt.Errorf(
+			`invalid onFailedDeployment "%s", expected one of %s, %s or %s`,
+			value,
+			OnFailedDeploymentError,
+			OnFailedDeploymentRedeploy,
+			OnFailedDeploymentRollback,
+		)
+	}
+}
+
+// DebugDetailLevel is the information ARM logs about the deployment
+// operations, sent as the debugSetting.detailLevel of the deployment. The
+// logged request and response content may expose sensitive data.
+type DebugDetailLevel string
+
+const (
+	// DebugDetailLevelNone doesn't log anything. This is ARM's default.
+	DebugDetailLevelNone DebugDetailLevel = "none"
+	// DebugDetailLevelRequestContent logs the requests of the operations
+	DebugDetailLevelRequestContent DebugDetailLevel = "requestContent"
+	// DebugDetailLevelResponseContent logs the responses of the operations
+	DebugDetailLevelResponseContent DebugDetailLevel = "responseContent"
+	// DebugDetailLevelAll logs both the requests and the responses of the
+	// operations
+	DebugDetailLevelAll DebugDetailLevel = "requestContent,responseContent"
+)
+
+// ParseDebugDetailLevel validates the given value. An empty value isn't sent
+// to ARM.
+func ParseDebugDetailLevel(value string) (DebugDetailLevel, error) {
+	switch DebugDetailLevel(value) {
+	case "", DebugDetailLevelNone, DebugDetailLevelRequestContent, DebugDetailLevelResponseContent, DebugDetailLevelAll:
+		return DebugDetailLevel(value), nil
+	default:
+		return "", fmt.Errorf(
+			`invalid debugDetailLevel "%s", expected one of %s, %s, %s or %s`,
+			value,
+			DebugDetailLevelNone,
+			DebugDetailLevelRequestContent,
+			DebugDetailLevelResponseContent,
+			DebugDetailLevelAll,
+		)
+	}
+}
+
+// DeploymentOptions are the per-step options that control how a deployment is
+// submitted to ARM
+type DeploymentOptions struct {
+	// OnFailedDeployment decides how an existing failed deployment is handled
+	OnFailedDeployment OnFailedDeployment
+	// RollbackDeploymentName is the deployment ARM redeploys when a rollback is
+	// triggered. When empty the last successful deployment is used.
+	RollbackDeploymentName string
+	// RollbackOnFailure redeploys the previous known-good state when a
+	// deployment submitted by the deployer fails
+	RollbackOnFailure bool
+	// KnownGood is the known-good state redeployed when RollbackOnFailure is
+	// set, such as the last successful deployment recorded in the status
+	// database. When nil ARM's onErrorDeployment redeploys the last
+	// successful deployment in the resource group.
+	KnownGood *KnownGoodDeployment
+	// CreateResourceGroup creates the resource group when it doesn't exist.
+	// When false the group isn't looked up at all and must already exist.
+	CreateResourceGroup bool
+	// ResourceGroupLocation is the location of a created resource group. It
+	// defaults to the location of the deployment.
+	ResourceGroupLocation string
+	// ResourceGroupTags are applied to the resource group
+	ResourceGroupTags map[string]string
+	// Tags are applied to the deployment
+	Tags map[string]string
+	// TagResources also applies Tags to every taggable resource in the
+	// template
+	TagResources bool
+	// DebugDetailLevel is sent as the debugSetting of the deployment when set
+	DebugDetailLevel DebugDetailLevel
+	// Progress is called with the intermediate states of the deployment, such
+	// as a retry of a failed deployment or a rollback. It may be nil.
+	Progress func(state DeploymentState, message string)
+}
+
+// DeploymentState is an intermediate state of a deployment reported through
+// DeploymentOptions.Progress
+type DeploymentState string
+
+const (
+	// DeploymentRetrying is reported when a failed deployment is submitted
+	// again
+	DeploymentRetrying DeploymentState = "Retrying"
+	// DeploymentRollingBack is reported when a failed deployment is being
+	// rolled back to the previous known-good state
+	DeploymentRollingBack DeploymentState = "RollingBack"
+)
+
+// progress reports an intermediate state of the deployment
+func (o DeploymentOptions) progress(state DeploymentState, format string, args ...interface{}) {
+	if o.Progress != nil {
+		o.Progress(state, fmt.Sprintf(format, args...))
+	}
+}
+
+// onErrorDeployment returns the ARM onErrorDeployment setting matching the
+// rollback options
+func (o DeploymentOptions) onErrorDeployment() *resourcesSDK.OnErrorDeployment {
+	if o.RollbackDeploymentName == "" {
+		return &resourcesSDK.OnErrorDeployment{
+			Type: resourcesSDK.LastSuccessful,
+		}
+	}
+	return &resourcesSDK.OnErrorDeployment{
+		Type:           resourcesSDK.SpecificDeployment,
+		DeploymentName: &o.RollbackDeploymentName,
+	}
+}
+
+// debugSetting returns the ARM debugSetting matching the detail level, or
+// nil when it isn't set
+func (o DeploymentOptions) debugSetting() *resourcesSDK.DebugSetting {
+	if o.DebugDetailLevel == "" {
+		return nil
+	}
+	detailLevel := string(o.DebugDetailLevel)
+	return &resourcesSDK.DebugSetting{
+		DetailLevel: &detailLevel,
+	}
+}
+
+// RollbackError is returned when a deployment failed and the deployer tried
+// to roll back to the previous known-good state. It reports both the original
+// failure and the outcome of the rollback.
+type RollbackError struct {
+	// Err is the error that failed the deployment
+	Err error
+	// RollbackDeploymentName is the deployment that was redeployed
+	RollbackDeploymentName string
+	// RollbackErr is set when the rollback itself failed
+	RollbackErr error
+}
+
+func (e *RollbackError) Error() string {
+	if e.RollbackErr != nil {
+		return fmt.Sprintf(
+			`%s; rollback to deployment "%s" failed: %s`,
+			e.Err,
+			e.RollbackDeploymentName,
+			e.RollbackErr,
+		)
+	}
+	return fmt.Sprintf(
+		`%s; rolled back to deployment "%s"`,
+		e.Err,
+		e.RollbackDeploymentName,
+	)
+}
+
+func (e *RollbackError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,59 @@
+package templates
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRollbackError(t *testing.T) {
+	deployErr := errors.New("deployment has failed")
+
+	err := &RollbackError{Err: deployErr, RollbackDeploymentName: "storage"}
+	assert.Equal(t, `deployment has failed; rolled back to deployment "storage"`, err.Error())
+	assert.True(t, errors.Is(err, deployErr))
+
+	err.RollbackErr = errors.New("rollback deployment has failed")
+	assert.Equal(t, `deployment has failed; rollback to deployment "storage" failed: rollback deployment has failed`, err.Error())
+}
+
+func TestDeploymentOptions_Progress(t *testing.T) {
+	// Without a callback, progress is not reported
+	DeploymentOptions{}.progress(DeploymentRetrying, "redeploying %q", "storage")
+
+	var states []DeploymentState
+	var messages []string
+	options := DeploymentOptions{
+		Progress: func(state DeploymentState, message string) {
+			states = append(states, state)
+			messages = append(messages, message)
+		},
+	}
+	options.progress(DeploymentRetrying, "redeploying %q", "storage")
+	options.progress(DeploymentRollingBack, "rolling back to %q", "storage-1")
+
+	assert.Equal(t, []DeploymentState{DeploymentRetrying, DeploymentRollingBack}, states)
+	assert.Equal(t, []string{`redeploying "storage"`, `rolling back to "storage-1"`}, messages)
+}
+
+func TestParseDebugDetailLevel(t *testing.T) {
+	for _, value := range []string{"", "none", "requestContent", "responseContent", "requestContent,responseContent"} {
+		level, err := ParseDebugDetailLevel(value)
+		assert.NoError(t, err)
+		assert.Equal(t, DebugDetailLevel(value), level)
+	}
+
+	_, err := ParseDebugDetailLevel("all")
+	assert.EqualError(t, err, `invalid debugDetailLevel "all", expected one of none, requestContent, responseContent or requestContent,responseContent`)
+}
+
+func TestDeploymentOptions_DebugSetting(t *testing.T) {
+	// Without a detail level, ARM's default is used
+	assert.Nil(t, DeploymentOptions{}.debugSetting())
+
+	setting := DeploymentOptions{DebugDetailLevel: DebugDetailLevelAll}.debugSetting()
+	if assert.NotNil(t, setting) && assert.NotNil(t, setting.DetailLevel) {
+		assert.Equal(t, "requestContent,responseContent", *setting.DetailLevel)
+	}
+}
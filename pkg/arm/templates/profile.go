@@ -0,0 +1,108 @@
+package templates
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest"
+)
+
+// APIVersionProfile pins the api-version of the resource management API the
+// deployer calls, for clouds such as Azure Stack Hub that only support older
+// versions than the SDK uses
+type APIVersionProfile struct {
+	// Name is the name of the profile, as used by the Azure CLI
+	Name string
+	// Resources is the api-version of Microsoft.Resources. When empty the
+	// versions of the SDK are used.
+	Resources string
+}
+
+// LatestAPIVersionProfile uses the api-versions of the SDK
+var LatestAPIVersionProfile = APIVersionProfile{Name: "latest"}
+
+// apiVersionProfiles are the Azure Stack Hub profiles the deployer supports
+var apiVersionProfiles = map[string]APIVersionProfile{
+	LatestAPIVersionProfile.Name: LatestAPIVersionProfile,
+	"2020-09-01-hybrid":          {Name: "2020-09-01-hybrid", Resources: "2019-10-01"},
+	"2019-03-01-hybrid":          {Name: "2019-03-01-hybrid", Resources: "2018-05-01"},
+}
+
+// GetAPIVersionProfile returns the profile with the given name, defaulting to
+// LatestAPIVersionProfile when it is empty
+func GetAPIVersionProfile(name string) (APIVersionProfile, error) {
+	if name == "" {
+		return LatestAPIVersionProfile, nil
+	}
+	profile, ok := apiVersionProfiles[strings.ToLower(name)]
+	if !ok {
+		var names []string
+		for profileName := range apiVersionProfiles {
+			names = append(names, profileName)
+		}
+		sort.Strings(names)
+		return APIVersionProfile{}, fmt.Errorf(
+			`invalid API version profile "%s", expected one of %s`,
+			name,
+			strings.Join(names, ", "),
+		)
+	}
+	return profile, nil
+}
+
+// isLatest reports whether the profile uses the api-versions of the SDK
+func (p APIVersionProfile) isLatest() bool {
+	return p.Resources == ""
+}
+
+// validateOptions rejects the deployment options that the resource manager
+// of the profile doesn't support. The request body of a deployment keeps the
+// shape of the SDK's api-version, but Azure Stack Hub doesn't act on
+// onErrorDeployment or debugSetting, so the options sending them are only
+// available with the latest profile.
+func (p APIVersionProfile) validateOptions(options DeploymentOptions) error {
+	if p.isLatest() {
+		return nil
+	}
+	var unsupported []string
+	if options.OnFailedDeployment == OnFailedDeploymentRollback {
+		unsupported = append(unsupported, "onFailedDeployment "+string(OnFailedDeploymentRollback))
+	}
+	if options.RollbackDeploymentName != "" {
+		unsupported = append(unsupported, "rollbackDeploymentName")
+	}
+	if options.RollbackOnFailure {
+		unsupported = append(unsupported, "rollbackOnFailure")
+	}
+	if options.DebugDetailLevel != "" {
+		unsupported = append(unsupported, "debugDetailLevel")
+	}
+	if len(unsupported) == 0 {
+		return nil
+	}
+	return fmt.Errorf(
+		"%s can't be used with the API version profile %s, which doesn't support onErrorDeployment and debugSetting",
+		strings.Join(unsupported, ", "),
+		p.Name,
+	)
+}
+
+// WithAPIVersion returns a PrepareDecorator that rewrites the api-version of
+// every request to the one of the profile. It is meant to be set as the
+// RequestInspector of the resources clients.
+func (p APIVersionProfile) WithAPIVersion() autorest.PrepareDecorator {
+	return func(prep autorest.Preparer) autorest.Preparer {
+		return autorest.PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			r, err := prep.Prepare(r)
+			if err != nil || p.isLatest() {
+				return r, err
+			}
+			query := r.URL.Query()
+			query.Set("api-version", p.Resources)
+			r.URL.RawQuery = query.Encode()
+			return r, nil
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package templates
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetAPIVersionProfile(t *testing.T) {
+	profile, err := GetAPIVersionProfile("")
+	require.NoError(t, err)
+	assert.Equal(t, LatestAPIVersionProfile, profile)
+
+	profile, err = GetAPIVersionProfile("2020-09-01-hybrid")
+	require.NoError(t, err)
+	assert.Equal(t, "2019-10-01", profile.Resources)
+
+	_, err = GetAPIVersionProfile("2018-03-01-hybrid")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid API version profile "2018-03-01-hybrid"`)
+}
+
+func TestAPIVersionProfile_WithAPIVersion(t *testing.T) {
+	testcases := []struct {
+		profile    string
+		apiVersion string
+	}{
+		{"latest", "2019-05-01"},
+		{"2020-09-01-hybrid", "2019-10-01"},
+		{"2019-03-01-hybrid", "2018-05-01"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.profile, func(t *testing.T) {
+			profile, err := GetAPIVersionProfile(tc.profile)
+			require.NoError(t, err)
+
+			req, err := autorest.Prepare(
+				&http.Request{},
+				autorest.WithBaseURL("https://management.local.azurestack.external"),
+				autorest.WithPath("/subscriptions/sub/resourcegroups/rg"),
+				autorest.WithQueryParameters(map[string]interface{}{"api-version": "2019-05-01"}),
+				profile.WithAPIVersion(),
+			)
+			require.NoError(t, err)
+			assert.Equal(t, tc.apiVersion, req.URL.Query().Get("api-version"))
+		})
+	}
+}
+
+func TestAPIVersionProfile_ValidateOptions(t *testing.T) {
+	options := DeploymentOptions{
+		OnFailedDeployment: OnFailedDeploymentRollback,
+		RollbackOnFailure:  true,
+		DebugDetailLevel:   DebugDetailLevelAll,
+	}
+	assert.NoError(t, LatestAPIVersionProfile.validateOptions(options))
+
+	profile, err := GetAPIVersionProfile("2019-03-01-hybrid")
+	require.NoError(t, err)
+	assert.EqualError(t, profile.validateOptions(options),
+		"onFailedDeployment rollback, rollbackOnFailure, debugDetailLevel can't be used with the API version profile 2019-03-01-hybrid, which doesn't support onErrorDeployment and debugSetting")
+	assert.NoError(t, profile.validateOptions(DeploymentOptions{OnFailedDeployment: OnFailedDeploymentRedeploy}))
+}
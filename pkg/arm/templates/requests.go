@@ -0,0 +1,93 @@
+package templates
+
+import (
+	"net/http"
+
+	"get.porter.sh/porter/pkg/tracing"
+	"github.com/Azure/go-autorest/autorest"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// The headers identifying ARM requests. ARM echoes the correlation id sent
+// by the client, and returns the id it gave the request, so that Azure
+// support can trace a deployment.
+const (
+	HeaderCorrelationRequestID = "x-ms-correlation-request-id"
+	HeaderRequestID            = "x-ms-request-id"
+)
+
+// ARMRequest is a request sent to ARM, with the ids ARM returned for it
+type ARMRequest struct {
+	Method        string
+	URL           string
+	StatusCode    int
+	RequestID     string
+	CorrelationID string
+}
+
+// IsWrite reports whether the request changes resources, as opposed to a
+// read such as the polling of a deployment
+func (r ARMRequest) IsWrite() bool {
+	return r.Method != http.MethodGet && r.Method != http.MethodHead
+}
+
+// RequestTracker sends a correlation id with every request of the clients
+// it tracks, and reports the ids ARM returned for them. Each request is
+// traced in a span, a child of the span of the context of the request.
+type RequestTracker struct {
+	// CorrelationID is sent as the x-ms-correlation-request-id header. It
+	// isn't sent when empty.
+	CorrelationID string
+	// OnResponse is called with each response. It may be nil.
+	OnResponse func(request ARMRequest)
+}
+
+// Track sends the requests of the client with the correlation id and
+// reports their responses, including the polling of long-running operations
+func (t *RequestTracker) Track(client *autorest.Client) {
+	sender := client.Sender
+	if sender == nil {
+		sender = autorest.CreateSender()
+	}
+	client.Sender = autorest.DecorateSender(sender, t.withTracking())
+}
+
+// withTracking sets the correlation id header of the requests and reports
+// the ids of the responses to OnResponse
+func (t *RequestTracker) withTracking() autorest.SendDecorator {
+	return func(s autorest.Sender) autorest.Sender {
+		return autorest.SenderFunc(func(r *http.Request) (resp *http.Response, err error) {
+			ctx, log := tracing.StartSpanWithName(
+				r.Context(),
+				"HTTP "+r.Method,
+				attribute.String(attributeHTTPMethod, r.Method),
+				attribute.String(attributeHTTPURL, r.URL.String()),
+			)
+			defer func() { EndSpan(ctx, log, err) }()
+
+			if t.CorrelationID != "" {
+				r.Header.Set(HeaderCorrelationRequestID, t.CorrelationID)
+			}
+			resp, err = s.Do(r)
+			if resp == nil {
+				return resp, err
+			}
+			request := ARMRequest{
+				Method:        r.Method,
+				URL:           r.URL.String(),
+				StatusCode:    resp.StatusCode,
+				RequestID:     resp.Header.Get(HeaderRequestID),
+				CorrelationID: resp.Header.Get(HeaderCorrelationRequestID),
+			}
+			log.SetAttributes(
+				attribute.Int(attributeHTTPStatusCode, request.StatusCode),
+				attribute.String(attributeRequestID, request.RequestID),
+				attribute.String(attributeCorrelationID, request.CorrelationID),
+			)
+			if t.OnResponse != nil {
+				t.OnResponse(request)
+			}
+			return resp, err
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package templates
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestTracker_Track(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HeaderRequestID, "request-"+r.Method)
+		w.Header().Set(HeaderCorrelationRequestID, r.Header.Get(HeaderCorrelationRequestID))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	var requests []ARMRequest
+	tracker := &RequestTracker{
+		CorrelationID: "00000000-0000-0000-0000-0000000000c0",
+		OnResponse: func(request ARMRequest) {
+			requests = append(requests, request)
+		},
+	}
+	client := autorest.NewClientWithUserAgent("test")
+	tracker.Track(&client)
+
+	req, err := autorest.Prepare(&http.Request{}, autorest.AsPut(), autorest.WithBaseURL(server.URL), autorest.WithPath("/deployments/storage"))
+	require.NoError(t, err)
+	resp, err := client.Send(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	require.Len(t, requests, 1)
+	assert.Equal(t, ARMRequest{
+		Method:        http.MethodPut,
+		URL:           server.URL + "/deployments/storage",
+		StatusCode:    http.StatusCreated,
+		RequestID:     "request-PUT",
+		CorrelationID: "00000000-0000-0000-0000-0000000000c0",
+	}, requests[0], "the correlation id is sent with the request")
+	assert.True(t, requests[0].IsWrite())
+	assert.False(t, ARMRequest{Method: http.MethodGet}.IsWrite())
+}
+
+func TestRequestTracker_WithoutCorrelationID(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get(HeaderCorrelationRequestID))
+	}))
+	defer server.Close()
+
+	// Without a callback, responses aren't reported
+	tracker := &RequestTracker{}
+	client := autorest.NewClientWithUserAgent("test")
+	tracker.Track(&client)
+
+	req, err := autorest.Prepare(&http.Request{}, autorest.AsGet(), autorest.WithBaseURL(server.URL))
+	require.NoError(t, err)
+	resp, err := client.Send(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+}
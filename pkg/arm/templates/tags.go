@@ -0,0 +1,144 @@
+package templates
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest"
+)
+
+// deploymentTagsAPIVersion is the first version of the deployments API that
+// accepts tags on the deployment itself
+const deploymentTagsAPIVersion = "2020-06-01"
+
+// nonTaggableResourceTypes are common resource types that reject tags
+var nonTaggableResourceTypes = map[string]bool{
+	"microsoft.authorization/locks":                         true,
+	"microsoft.authorization/policyassignments":             true,
+	"microsoft.authorization/roleassignments":               true,
+	"microsoft.authorization/roledefinitions":               true,
+	"microsoft.network/virtualnetworks/subnets":             true,
+	"microsoft.resources/deployments":                       true,
+	"microsoft.storage/storageaccounts/blobservices":        true,
+	"microsoft.storage/storageaccounts/fileservices":        true,
+	"microsoft.storage/storageaccounts/queueservices":       true,
+	"microsoft.storage/storageaccounts/tableservices":       true,
+	"microsoft.keyvault/vaults/accesspolicies":              true,
+	"microsoft.sql/servers/firewallrules":                   true,
+	"microsoft.web/sites/config":                            true,
+	"microsoft.insights/diagnosticsettings":                 true,
+	"microsoft.network/networksecuritygroups/securityrules": true,
+}
+
+// withDeploymentTags returns a PrepareDecorator that adds tags to the body of
+// a deployment create request. The SDK version used by the deployer predates
+// deployment tags, so the request is sent with a newer api-version that
+// supports them.
+func withDeploymentTags(tags map[string]string) autorest.PrepareDecorator {
+	return func(p autorest.Preparer) autorest.Preparer {
+		return autorest.PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			r, err := p.Prepare(r)
+			if err != nil || r.Method != http.MethodPut || r.Body == nil {
+				return r, err
+			}
+
+			body, err := io.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				return r, fmt.Errorf("error reading deployment request: %s", err)
+			}
+			var deployment map[string]interface{}
+			if err = json.Unmarshal(body, &deployment); err != nil {
+				return r, fmt.Errorf("error decoding deployment request: %s", err)
+			}
+			deployment["tags"] = tags
+			if body, err = json.Marshal(deployment); err != nil {
+				return r, fmt.Errorf("error encoding deployment request: %s", err)
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+
+			query := r.URL.Query()
+			query.Set("api-version", deploymentTagsAPIVersion)
+			r.URL.RawQuery = query.Encode()
+			return r, nil
+		})
+	}
+}
+
+// injectResourceTags adds the tags to every taggable resource in the
+// template, including child resources. Tags already set on a resource win
+// over the injected ones. Nested deployment templates are left alone.
+func injectResourceTags(
+	armTemplate map[string]interface{},
+	tags map[string]string,
+) error {
+	resources, _ := armTemplate["resources"].([]interface{})
+	return injectTagsIntoResources(resources, tags)
+}
+
+func injectTagsIntoResources(
+	resources []interface{},
+	tags map[string]string,
+) error {
+	for _, r := range resources {
+		resource, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if children, ok := resource["resources"].([]interface{}); ok {
+			if err := injectTagsIntoResources(children, tags); err != nil {
+				return err
+			}
+		}
+
+		resourceType, _ := resource["type"].(string)
+		if !isTaggable(resourceType) {
+			continue
+		}
+		switch existing := resource["tags"].(type) {
+		case nil:
+			resourceTags := map[string]interface{}{}
+			for key, val := range tags {
+				resourceTags[key] = val
+			}
+			resource["tags"] = resourceTags
+		case map[string]interface{}:
+			for key, val := range tags {
+				if _, ok := existing[key]; !ok {
+					existing[key] = val
+				}
+			}
+		case string:
+			// The tags are a template expression, so merge at deployment time
+			if !strings.HasPrefix(existing, "[") || !strings.HasSuffix(existing, "]") {
+				continue
+			}
+			injected, err := json.Marshal(tags)
+			if err != nil {
+				return fmt.Errorf("error encoding resource tags: %s", err)
+			}
+			resource["tags"] = fmt.Sprintf(
+				"[union(json('%s'), %s)]",
+				strings.ReplaceAll(string(injected), "'", "''"),
+				existing[1:len(existing)-1],
+			)
+		}
+	}
+	return nil
+}
+
+// isTaggable reports whether tags can be set on the resource type. Extension
+// resources, such as those deployed with a /providers/ segment in their type,
+// are skipped along with the known non-taggable types.
+func isTaggable(resourceType string) bool {
+	resourceType = strings.ToLower(resourceType)
+	if resourceType == "" || strings.Contains(resourceType, "/providers/") {
+		return false
+	}
+	return !nonTaggableResourceTypes[resourceType]
+}
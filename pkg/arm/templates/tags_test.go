@@ -0,0 +1,58 @@
+package templates
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInjectResourceTags(t *testing.T) {
+	var template map[string]interface{}
+	err := json.Unmarshal([]byte(`{
+		"resources": [
+			{"type": "Microsoft.Storage/storageAccounts", "tags": {"owner": "app-team"}, "resources": [
+				{"type": "Microsoft.Storage/storageAccounts/blobServices"}
+			]},
+			{"type": "Microsoft.Web/sites", "tags": "[parameters('tags')]"},
+			{"type": "Microsoft.Authorization/roleAssignments"}
+		]
+	}`), &template)
+	require.NoError(t, err)
+
+	err = injectResourceTags(template, map[string]string{"owner": "porter", "porter-installation": "mysql"})
+	require.NoError(t, err)
+
+	resources := template["resources"].([]interface{})
+	storage := resources[0].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"owner": "app-team", "porter-installation": "mysql"}, storage["tags"])
+	blobServices := storage["resources"].([]interface{})[0].(map[string]interface{})
+	assert.NotContains(t, blobServices, "tags")
+	site := resources[1].(map[string]interface{})
+	assert.Equal(t, `[union(json('{"owner":"porter","porter-installation":"mysql"}'), parameters('tags'))]`, site["tags"])
+	roleAssignment := resources[2].(map[string]interface{})
+	assert.NotContains(t, roleAssignment, "tags")
+}
+
+func TestWithDeploymentTags(t *testing.T) {
+	req, err := autorest.Prepare(&http.Request{},
+		autorest.AsPut(),
+		autorest.WithBaseURL("https://management.azure.com"),
+		autorest.WithPath("/subscriptions/sub/resourcegroups/rg/providers/Microsoft.Resources/deployments/storage"),
+		autorest.WithQueryParameters(map[string]interface{}{"api-version": "2019-05-01"}),
+		autorest.WithJSON(map[string]interface{}{"properties": map[string]interface{}{"mode": "Incremental"}}),
+		withDeploymentTags(map[string]string{"porter-installation": "mysql"}),
+	)
+	require.NoError(t, err)
+
+	assert.Equal(t, deploymentTagsAPIVersion, req.URL.Query().Get("api-version"))
+	body, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"properties": {"mode": "Incremental"}, "tags": {"porter-installation": "mysql"}}`, string(bytes.TrimSpace(body)))
+	assert.Equal(t, int64(len(body)), req.ContentLength)
+}
@@ -8,14 +8,16 @@ import (
 
 	"get.porter.sh/mixin/arm/pkg/arm/auth"
 	"get.porter.sh/porter/pkg/portercontext"
-	resourcesSDK "github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2017-05-10/resources"
+	resourcesSDK "github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
 	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/stretchr/testify/assert"
 )
 
 func newTestDeployer(ctx *portercontext.TestContext) Deployer {
 	env, _ := azure.EnvironmentFromName("")
-	authorizer, _ := auth.GetBearerTokenAuthorizer(env, "", "", "", "")
+	authorizer, _ := auth.GetBearerTokenAuthorizer(auth.ServicePrincipalTokenParameters{
+		AzureEnvironment: env,
+	})
 	resourceDeploymentsClient := resourcesSDK.NewDeploymentsClientWithBaseURI(
 		"",
 		"",
@@ -27,7 +29,7 @@ func newTestDeployer(ctx *portercontext.TestContext) Deployer {
 		"",
 	)
 	resourceGroupsClient.Authorizer = authorizer
-	return NewDeployer(ctx.Context, resourceGroupsClient, resourceDeploymentsClient)
+	return NewDeployer(ctx.Context, resourceGroupsClient, resourceDeploymentsClient, LatestAPIVersionProfile)
 
 }
 func TestLoadTemplate(t *testing.T) {
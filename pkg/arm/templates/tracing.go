@@ -0,0 +1,41 @@
+package templates
+
+import (
+	"context"
+
+	"get.porter.sh/porter/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The attributes of the spans of the deployer
+const (
+	attributeDeploymentName = "arm.deployment.name"
+	attributeResourceGroup  = "arm.resourceGroup"
+	attributeHTTPMethod     = "http.method"
+	attributeHTTPURL        = "http.url"
+	attributeHTTPStatusCode = "http.status_code"
+	attributeRequestID      = "arm.requestId"
+	attributeCorrelationID  = "arm.correlationId"
+)
+
+// deploymentAttributes returns the attributes identifying a deployment
+func deploymentAttributes(deploymentName string, resourceGroupName string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String(attributeDeploymentName, deploymentName),
+		attribute.String(attributeResourceGroup, resourceGroupName),
+	}
+}
+
+// EndSpan ends the span of the context, which log traces, and marks it
+// failed with the error when it is set. The error isn't logged, the caller
+// returns it.
+func EndSpan(ctx context.Context, log tracing.TraceLogger, err error) {
+	if err != nil {
+		span := trace.SpanFromContext(ctx)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	log.EndSpan()
+}
@@ -0,0 +1,73 @@
+package arm
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	arm "get.porter.sh/mixin/arm/pkg/arm/templates"
+	"get.porter.sh/porter/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// The attributes of the spans of a step
+const (
+	attributeCorrelationId         = "arm.correlationId"
+	attributeDeploymentName        = "arm.deployment.name"
+	attributeResourceGroup         = "arm.resourceGroup"
+	attributeSubscriptionId        = "arm.subscriptionId"
+	attributeInstallationName      = "porter.installation.name"
+	attributeInstallationNamespace = "porter.installation.namespace"
+	attributeExecutionStatus       = "arm.status"
+	attributeTemplate              = "arm.template"
+)
+
+// stepPhase is a phase of a step, such as authenticating or deploying. It is
+// traced as a span, and how long it took is printed in debug mode.
+type stepPhase struct {
+	m             *Mixin
+	ctx           context.Context
+	log           tracing.TraceLogger
+	name          string
+	correlationId string
+	startedOn     time.Time
+}
+
+// startPhase starts the span of a phase of the step. The spans of the
+// deployer are children of the span of the returned context.
+func (m *Mixin) startPhase(ctx context.Context, correlationId string, name string, attrs ...attribute.KeyValue) (context.Context, *stepPhase) {
+	ctx, log := tracing.StartSpanWithName(ctx, name, attrs...)
+	return ctx, &stepPhase{
+		m:             m,
+		ctx:           ctx,
+		log:           log,
+		name:          name,
+		correlationId: correlationId,
+		startedOn:     time.Now(),
+	}
+}
+
+// end ends the span of the phase, marking it failed when err is set, and
+// returns err
+func (p *stepPhase) end(err error) error {
+	arm.EndSpan(p.ctx, p.log, err)
+	if p.m.DebugMode {
+		prefix := ""
+		if p.correlationId != "" {
+			prefix = fmt.Sprintf("[correlationId: %s] ", p.correlationId)
+		}
+		fmt.Fprintf(p.m.Err, "%sDEBUG %s took %s\n", prefix, p.name, time.Since(p.startedOn).Round(time.Millisecond))
+	}
+	return err
+}
+
+// stepAttributes returns the attributes identifying the deployment of a step
+func stepAttributes(installArguments InstallArguments, installation installationMetadata, correlationId string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String(attributeCorrelationId, correlationId),
+		attribute.String(attributeDeploymentName, installArguments.Name),
+		attribute.String(attributeResourceGroup, installArguments.ResourceGroup),
+		attribute.String(attributeInstallationName, installation.Name),
+		attribute.String(attributeInstallationNamespace, installation.Namespace),
+	}
+}
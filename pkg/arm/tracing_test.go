@@ -0,0 +1,25 @@
+package arm
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStepPhase_End(t *testing.T) {
+	m := NewTestMixin(t)
+	_, phase := m.startPhase(context.Background(), "correlation-id", "auth")
+	deployErr := errors.New("invalid client secret")
+	assert.Equal(t, deployErr, phase.end(deployErr), "the error of the phase is returned")
+	assert.Empty(t, m.TestContext.GetError(), "phases are only timed in debug mode")
+
+	m.DebugMode = true
+	_, phase = m.startPhase(context.Background(), "correlation-id", "auth")
+	assert.NoError(t, phase.end(nil))
+	_, phase = m.startPhase(context.Background(), "", "validate")
+	assert.NoError(t, phase.end(nil))
+	assert.Contains(t, m.TestContext.GetError(), "[correlationId: correlation-id] DEBUG auth took ")
+	assert.Contains(t, m.TestContext.GetError(), "\nDEBUG validate took ", "phases before the correlation id is known aren't prefixed")
+}